@@ -130,8 +130,43 @@ contract PrivyChain is Ownable, ReentrancyGuard, Pausable {
         bool isEncrypted,
         string calldata metadata
     ) external onlyAuthorizedUploader whenNotPaused {
-        require(cid != bytes32(0), "Invalid CID");
         require(fileRecords[cid].uploader == address(0), "File already recorded");
+        _recordUpload(cid, fileSize, isEncrypted, metadata);
+    }
+    
+    /**
+     * @dev Records several uploads in one transaction. CIDs that are already
+     * recorded are skipped, so one duplicate does not revert the whole batch.
+     * @param cids CIDs of the uploaded files
+     * @param fileSizes Size of each file in bytes
+     * @param isEncrypted Whether each file is encrypted
+     * @param metadata JSON metadata string for each file
+     */
+    function batchRecordUpload(
+        bytes32[] calldata cids,
+        uint256[] calldata fileSizes,
+        bool[] calldata isEncrypted,
+        string[] calldata metadata
+    ) external onlyAuthorizedUploader whenNotPaused {
+        require(
+            cids.length == fileSizes.length && cids.length == isEncrypted.length && cids.length == metadata.length,
+            "Array length mismatch"
+        );
+        
+        for (uint256 i = 0; i < cids.length; i++) {
+            if (fileRecords[cids[i]].uploader == address(0)) {
+                _recordUpload(cids[i], fileSizes[i], isEncrypted[i], metadata[i]);
+            }
+        }
+    }
+    
+    function _recordUpload(
+        bytes32 cid,
+        uint256 fileSize,
+        bool isEncrypted,
+        string calldata metadata
+    ) internal {
+        require(cid != bytes32(0), "Invalid CID");
         require(fileSize > 0, "File size must be greater than 0");
         
         FileRecord memory newRecord = FileRecord({
@@ -222,6 +257,28 @@ contract PrivyChain is Ownable, ReentrancyGuard, Pausable {
         address grantee,
         uint256 duration
     ) external fileExists(cid) onlyFileOwner(cid) whenNotPaused {
+        _grantAccess(cid, grantee, duration);
+    }
+    
+    /**
+     * @dev Grants access to a file for several addresses in one transaction
+     * @param cid The CID of the file
+     * @param grantees The addresses to grant access to
+     * @param durations Duration of access in seconds for each grantee (0 for permanent)
+     */
+    function batchGrantAccess(
+        bytes32 cid,
+        address[] calldata grantees,
+        uint256[] calldata durations
+    ) external fileExists(cid) onlyFileOwner(cid) whenNotPaused {
+        require(grantees.length == durations.length, "Array length mismatch");
+        
+        for (uint256 i = 0; i < grantees.length; i++) {
+            _grantAccess(cid, grantees[i], durations[i]);
+        }
+    }
+    
+    function _grantAccess(bytes32 cid, address grantee, uint256 duration) internal {
         require(grantee != address(0), "Invalid grantee address");
         require(grantee != msg.sender, "Cannot grant access to yourself");
         
@@ -2,8 +2,7 @@ import { useState, useRef, useCallback } from "react";
 import { fileToBase64, formatFileSize, getFileIcon } from "../utils";
 import {
   validateUploadRequest,
-  generateUploadMessage,
-  signMessage,
+  createAuthHeaders,
 } from "../utils/web3";
 import PrivyChainAPI from "../lib/api";
 import type { UploadRequest, UploadResponse } from "../types";
@@ -71,8 +70,7 @@ const FileUpload = ({
       const base64Data = await fileToBase64(file);
       console.log("📦 File converted to base64, size:", base64Data.length);
 
-      // Prepare upload data for signing
-      const uploadData = {
+      const uploadRequest: UploadRequest = {
         file: base64Data,
         file_name: file.name,
         content_type: file.type || "application/octet-stream",
@@ -82,35 +80,24 @@ const FileUpload = ({
           tags: ["document", "upload"],
           version: "1.0",
         },
-        user_address: userAddress,
       };
 
       console.log("📋 Upload data prepared:", {
-        file_name: uploadData.file_name,
-        content_type: uploadData.content_type,
-        should_encrypt: uploadData.should_encrypt,
-        user_address: uploadData.user_address,
-        file_size: uploadData.file.length,
+        file_name: uploadRequest.file_name,
+        content_type: uploadRequest.content_type,
+        should_encrypt: uploadRequest.should_encrypt,
+        file_size: uploadRequest.file.length,
       });
 
-      // Generate message for signing
-      const message = generateUploadMessage(uploadData);
-
-      // Sign the message
+      // The server takes the uploader from the signed auth headers
       console.log("🔐 Signing message...");
-      const signature = await signMessage(message, userAddress);
+      const auth = await createAuthHeaders(userAddress);
       console.log("✅ Message signed successfully");
 
-      // Prepare upload request
-      const uploadRequest: UploadRequest = {
-        ...uploadData,
-        signature: signature,
-      };
-
       // Upload to API
       setUploadProgress((prev) => ({ ...prev, [file.name]: 50 }));
       console.log("🚀 Uploading to API...");
-      const response = await PrivyChainAPI.uploadFile(uploadRequest);
+      const response = await PrivyChainAPI.uploadFile(uploadRequest, auth);
       console.log("✅ Upload successful:", response);
 
       setUploadProgress((prev) => ({ ...prev, [file.name]: 100 }));
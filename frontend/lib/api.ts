@@ -20,6 +20,7 @@ import type {
     PerformanceMetrics,
     SystemMetrics,
 } from '../types';
+import type { AuthHeaders } from '../utils/web3';
 
 const API_BASE_URL = process.env.NEXT_PUBLIC_API_URL || 'https://privychain-dot-chainguardai.uc.r.appspot.com';
 
@@ -74,16 +75,18 @@ export class PrivyChainAPI {
     }
 
     // File Operations
-    static async uploadFile(request: UploadRequest): Promise<UploadResponse> {
-        const response = await api.post<ApiResponse<UploadResponse>>('/upload', request);
+    // Calls that act for a wallet take its AuthHeaders (see createAuthHeaders); the
+    // server identifies the caller from those, not from addresses in the body
+    static async uploadFile(request: UploadRequest, auth: AuthHeaders): Promise<UploadResponse> {
+        const response = await api.post<ApiResponse<UploadResponse>>('/upload', request, { headers: { ...auth } });
         if (!response.data.success) {
             throw new Error(response.data.error || 'Failed to upload file');
         }
         return response.data.data!;
     }
 
-    static async retrieveFile(request: RetrieveRequest): Promise<RetrieveResponse> {
-        const response = await api.post<ApiResponse<RetrieveResponse>>('/retrieve', request);
+    static async retrieveFile(request: RetrieveRequest, auth: AuthHeaders): Promise<RetrieveResponse> {
+        const response = await api.post<ApiResponse<RetrieveResponse>>('/retrieve', request, { headers: { ...auth } });
         if (!response.data.success) {
             throw new Error(response.data.error || 'Failed to retrieve file');
         }
@@ -91,24 +94,24 @@ export class PrivyChainAPI {
     }
 
     // Access Control
-    static async grantAccess(request: AccessGrantRequest): Promise<AccessGrantResponse> {
-        const response = await api.post<ApiResponse<AccessGrantResponse>>('/access/grant', request);
+    static async grantAccess(request: AccessGrantRequest, auth: AuthHeaders): Promise<AccessGrantResponse> {
+        const response = await api.post<ApiResponse<AccessGrantResponse>>('/access/grant', request, { headers: { ...auth } });
         if (!response.data.success) {
             throw new Error(response.data.error || 'Failed to grant access');
         }
         return response.data.data!;
     }
 
-    static async revokeAccess(request: AccessRevokeRequest): Promise<void> {
-        const response = await api.post<ApiResponse<void>>('/access/revoke', request);
+    static async revokeAccess(request: AccessRevokeRequest, auth: AuthHeaders): Promise<void> {
+        const response = await api.post<ApiResponse<void>>('/access/revoke', request, { headers: { ...auth } });
         if (!response.data.success) {
             throw new Error(response.data.error || 'Failed to revoke access');
         }
     }
 
     // Rewards
-    static async claimReward(request: RewardClaimRequest): Promise<RewardClaimResponse> {
-        const response = await api.post<ApiResponse<RewardClaimResponse>>('/rewards/claim', request);
+    static async claimReward(request: RewardClaimRequest, auth: AuthHeaders): Promise<RewardClaimResponse> {
+        const response = await api.post<ApiResponse<RewardClaimResponse>>('/rewards/claim', request, { headers: { ...auth } });
         if (!response.data.success) {
             throw new Error(response.data.error || 'Failed to claim reward');
         }
@@ -2,11 +2,7 @@ import { useState, useEffect, useCallback } from "react";
 import Head from "next/head";
 import { useWallet } from "./_app";
 import {
-  generateRetrieveMessage,
-  generateAccessMessage,
-  generateRevokeMessage,
-  generateRewardMessage,
-  signMessage,
+  createAuthHeaders,
 } from "../utils/web3";
 import PrivyChainAPI from "../lib/api";
 import { formatFileSize, formatFilcoins } from "../utils";
@@ -116,16 +112,10 @@ export default function FilesPage() {
 
     setRetrievingFile(cid);
     try {
-      // Generate message for signing
-      const message = generateRetrieveMessage(cid);
-      const signature = await signMessage(message, userAddress);
+      const auth = await createAuthHeaders(userAddress);
 
       // Retrieve file
-      const response = await PrivyChainAPI.retrieveFile({
-        cid,
-        user_address: userAddress,
-        signature,
-      });
+      const response = await PrivyChainAPI.retrieveFile({ cid }, auth);
 
       // Download file
       const blob = new Blob([atob(response.file)], {
@@ -157,23 +147,19 @@ export default function FilesPage() {
       return;
 
     try {
-      // Generate message for signing
-      const message = generateAccessMessage(
-        accessGrantForm.cid,
-        accessGrantForm.grantee
-      );
-      const signature = await signMessage(message, userAddress);
+      const auth = await createAuthHeaders(userAddress);
 
       // Grant access
       const request: AccessGrantRequest = {
         cid: accessGrantForm.cid,
         grantee: accessGrantForm.grantee,
-        duration: accessGrantForm.duration,
-        granter: userAddress,
-        signature,
+        // 0 is the "Permanent" option; the backend requires it to be explicit
+        ...(accessGrantForm.duration === 0
+          ? { permanent: true }
+          : { duration: accessGrantForm.duration }),
       };
 
-      const response = await PrivyChainAPI.grantAccess(request);
+      const response = await PrivyChainAPI.grantAccess(request, auth);
 
       showNotification(
         "success",
@@ -194,19 +180,15 @@ export default function FilesPage() {
     if (!userAddress) return;
 
     try {
-      // Generate message for signing
-      const message = generateRevokeMessage(cid, grantee);
-      const signature = await signMessage(message, userAddress);
+      const auth = await createAuthHeaders(userAddress);
 
       // Revoke access
       const request: AccessRevokeRequest = {
         cid,
         grantee,
-        granter: userAddress,
-        signature,
       };
 
-      await PrivyChainAPI.revokeAccess(request);
+      await PrivyChainAPI.revokeAccess(request, auth);
 
       showNotification(
         "success",
@@ -223,18 +205,14 @@ export default function FilesPage() {
 
     setClaimingReward(cid);
     try {
-      // Generate message for signing
-      const message = generateRewardMessage(cid);
-      const signature = await signMessage(message, userAddress);
+      const auth = await createAuthHeaders(userAddress);
 
       // Claim reward
       const request: RewardClaimRequest = {
         cid,
-        user_address: userAddress,
-        signature,
       };
 
-      const response = await PrivyChainAPI.claimReward(request);
+      const response = await PrivyChainAPI.claimReward(request, auth);
 
       showNotification(
         "success",
@@ -1,7 +1,7 @@
 import { useState, useEffect, useCallback } from "react";
 import Head from "next/head";
 import { useWallet } from "./_app";
-import { generateRewardMessage, signMessage } from "../utils/web3";
+import { createAuthHeaders } from "../utils/web3";
 import PrivyChainAPI from "../lib/api";
 import { formatFileSize, formatFilcoins, formatDate } from "../utils";
 import type { UserStats, FileRecord, RewardClaimRequest } from "../types";
@@ -90,18 +90,14 @@ export default function RewardsPage() {
 
     setClaimingReward(cid);
     try {
-      // Generate message for signing
-      const message = generateRewardMessage(cid);
-      const signature = await signMessage(message, userAddress);
+      const auth = await createAuthHeaders(userAddress);
 
       // Claim reward
       const request: RewardClaimRequest = {
         cid,
-        user_address: userAddress,
-        signature,
       };
 
-      const response = await PrivyChainAPI.claimReward(request);
+      const response = await PrivyChainAPI.claimReward(request, auth);
 
       showNotification(
         "success",
@@ -89,8 +89,6 @@ export interface UploadRequest {
         tags?: string[];
         version?: string;
     };
-    user_address: string;
-    signature: string;
 }
 
 export interface UploadResponse {
@@ -110,8 +108,6 @@ export interface UploadResponse {
 
 export interface RetrieveRequest {
     cid: string;
-    user_address: string;
-    signature: string;
 }
 
 export interface RetrieveResponse {
@@ -125,8 +121,7 @@ export interface AccessGrantRequest {
     cid: string;
     grantee: string;
     duration?: number;
-    granter: string;
-    signature: string;
+    permanent?: boolean;
 }
 
 export interface AccessGrantResponse {
@@ -139,8 +134,6 @@ export interface AccessGrantResponse {
 
 export interface RewardClaimRequest {
     cid: string;
-    user_address: string;
-    signature: string;
 }
 
 export interface RewardClaimResponse {
@@ -231,6 +224,4 @@ export interface WalletState {
 export interface AccessRevokeRequest {
     cid: string;
     grantee: string;
-    granter: string;
-    signature: string;
 }
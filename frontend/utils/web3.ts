@@ -11,51 +11,22 @@ export function formatAddress(address: string): string {
     return `${address.slice(0, 6)}...${address.slice(-4)}`;
 }
 
-// Message generation functions that match the API documentation
-export function generateMessage(action: string, data: any): string {
-    // Generate consistent message format for signing
-    const timestamp = Math.floor(Date.now() / 1000);
-    const message = `PrivyChain ${action}\n${JSON.stringify(data)}\nTimestamp: ${timestamp}`;
-    return message;
+// Headers the API's requireAuth checks: a signature over
+// "PrivyChain Authentication\nTimestamp: <ms>", accepted for a few minutes
+export interface AuthHeaders {
+    'x-user-address': string;
+    'x-timestamp': string;
+    'x-signature': string;
 }
 
-export function generateUploadMessage(data: any): string {
-    // For upload requests, sign the file content and metadata
-    // Based on the API documentation, this should match the backend expectation
-    const message = `data_to_authenticate: ${JSON.stringify({
-        file: data.file,
-        file_name: data.file_name,
-        content_type: data.content_type,
-        should_encrypt: data.should_encrypt,
-        metadata: data.metadata,
-        user_address: data.user_address
-    })}`;
-    console.log('🔐 Generated upload message for signing:', message.substring(0, 100) + '...');
-    return message;
-}
-
-export function generateRetrieveMessage(cid: string): string {
-    // For retrieve requests, sign the CID
-    const message = `data_to_authenticate: ${cid}`;
-    return message;
-}
-
-export function generateAccessMessage(cid: string, grantee: string): string {
-    // For access grant requests, sign the CID and grantee
-    const message = `data_to_authenticate: ${cid + grantee}`;
-    return message;
-}
-
-export function generateRevokeMessage(cid: string, grantee: string): string {
-    // For access revoke requests, sign the CID and grantee
-    const message = `data_to_authenticate: ${cid + grantee}`;
-    return message;
-}
-
-export function generateRewardMessage(cid: string): string {
-    // For reward claim requests, sign the CID
-    const message = `data_to_authenticate: ${cid}`;
-    return message;
+export async function createAuthHeaders(address: string): Promise<AuthHeaders> {
+    const timestamp = String(Date.now());
+    const signature = await signMessage(`PrivyChain Authentication\nTimestamp: ${timestamp}`, address);
+    return {
+        'x-user-address': address,
+        'x-timestamp': timestamp,
+        'x-signature': signature,
+    };
 }
 
 // Real wallet signing using ethers
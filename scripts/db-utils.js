@@ -42,13 +42,62 @@ class DatabaseManager {
         const backupDir = path.dirname(backupPath);
         await fs.mkdir(backupDir, { recursive: true });
 
-        // Copy database file
-        await fs.copyFile(DB_PATH, backupPath);
+        // VACUUM INTO writes a consistent snapshot even while the server is running,
+        // unlike copying the file mid-write
+        const db = await this.connect();
+        await db.run('VACUUM INTO ?', [backupPath]);
         
         console.log(`✅ Database backed up to: ${backupPath}`);
         return backupPath;
     }
 
+    // Replace the database with a backup. Stop the server first. Refuses to overwrite
+    // a database that already holds files unless force is set, and keeps a
+    // pre-restore snapshot of whatever it replaces.
+    async restore(backupPath, { force = false } = {}) {
+        if (!backupPath) {
+            throw new Error('Backup path is required');
+        }
+
+        const backup = await open({ filename: backupPath, driver: sqlite3.Database, mode: sqlite3.OPEN_READONLY });
+        try {
+            const integrity = await backup.get('PRAGMA integrity_check');
+            if (integrity.integrity_check !== 'ok') {
+                throw new Error(`Backup failed integrity check: ${integrity.integrity_check}`);
+            }
+        } finally {
+            await backup.close();
+        }
+
+        let populated = false;
+        try {
+            await fs.access(DB_PATH);
+            const db = await this.connect();
+            const table = await db.get("SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'file_records'");
+            populated = !!table && (await db.get('SELECT COUNT(*) as count FROM file_records')).count > 0;
+        } catch (error) {
+            if (error.code !== 'ENOENT') throw error;
+        }
+
+        if (populated && !force) {
+            throw new Error(`${DB_PATH} already contains file records - pass --force to overwrite it`);
+        }
+
+        if (populated) {
+            const timestamp = new Date().toISOString().replace(/[:.]/g, '-');
+            const snapshot = await this.backup(`./backups/privychain-pre-restore-${timestamp}.db`);
+            console.log(`💾 Current database saved to: ${snapshot}`);
+        }
+
+        await this.close();
+        await fs.copyFile(backupPath, DB_PATH);
+        await fs.rm(`${DB_PATH}-wal`, { force: true });
+        await fs.rm(`${DB_PATH}-shm`, { force: true });
+
+        console.log(`✅ Database restored from: ${backupPath}`);
+        return DB_PATH;
+    }
+
     async getStats() {
         const db = await this.connect();
         
@@ -129,6 +178,10 @@ async function main() {
                 await dbManager.backup(backupPath);
                 break;
 
+            case 'restore':
+                await dbManager.restore(process.argv[3], { force: process.argv.includes('--force') });
+                break;
+
             case 'cleanup':
                 const days = parseInt(process.argv[3]) || 30;
                 console.log(`🧹 Cleaning up data older than ${days} days...`);
@@ -145,11 +198,13 @@ async function main() {
                 console.log('Commands:');
                 console.log('  stats                    Show database statistics');
                 console.log('  backup [path]           Create database backup');
+                console.log('  restore <path> [--force] Restore a backup (stop the server first)');
                 console.log('  cleanup [days]          Clean up old data (default: 30 days)');
                 console.log('');
                 console.log('Examples:');
                 console.log('  node scripts/db-utils.js stats');
                 console.log('  node scripts/db-utils.js backup ./my-backup.db');
+                console.log('  node scripts/db-utils.js restore ./my-backup.db');
                 console.log('  node scripts/db-utils.js cleanup 7');
         }
     } catch (error) {
@@ -2,12 +2,18 @@ import express from 'express';
 import cors from 'cors';
 import rateLimit from 'express-rate-limit';
 import { create } from '@web3-storage/w3up-client';
+import { CarReader } from '@ipld/car';
 import { ethers } from 'ethers';
 import crypto from 'crypto';
 import fs from 'fs/promises';
+import net from 'net';
+import { fileURLToPath } from 'url';
 import path from 'path';
 import sqlite3 from 'sqlite3';
 import { open } from 'sqlite';
+import zlib from 'zlib';
+import { EventEmitter } from 'events';
+import { AsyncLocalStorage } from 'async_hooks';
 import dotenv from 'dotenv';
 
 dotenv.config();
@@ -15,27 +21,323 @@ dotenv.config();
 const app = express(); 
 const PORT = process.env.PORT || 8080;
 
+// Deployment environment, validated at startup. Behaviour that should differ per
+// environment checks isProduction() instead of reading NODE_ENV.
+const ENVIRONMENTS = ['development', 'staging', 'production'];
+const ENVIRONMENT = (process.env.NODE_ENV || process.env.ENVIRONMENT || 'development').toLowerCase();
+const isProduction = () => ENVIRONMENT === 'production';
+
+// Raw error messages (SQL, RPC, paths) in error responses' details. Opt-in rather than
+// tied to NODE_ENV, which defaults to development when a deployment leaves it unset.
+const exposeErrorDetails = () => process.env.EXPOSE_ERROR_DETAILS === 'true';
+
+// Largest file accepted by any upload route. JSON bodies carry files base64-encoded
+// (4/3 of the bytes), so their cap is that plus room for the rest of the request.
+const MAX_FILE_SIZE_BYTES = parseInt(process.env.MAX_FILE_SIZE_BYTES) || 100 * 1024 * 1024;
+const MAX_FILE_SIZE_LABEL = `${Math.round(MAX_FILE_SIZE_BYTES / 1024 / 1024)}MB`;
+const MAX_JSON_BODY_BYTES = parseInt(process.env.MAX_JSON_BODY_BYTES) ||
+    Math.ceil(MAX_FILE_SIZE_BYTES * 4 / 3) + 1024 * 1024;
+
+// Reject an oversized JSON body from its Content-Length before reading any of it.
+// Chunked bodies are cut off by express.json's limit instead; raw upload-session
+// chunks are not JSON and have their own limit.
+function limitJsonBody(req, res, next) {
+    if (req.is('application/json') && parseInt(req.headers['content-length']) > MAX_JSON_BODY_BYTES) {
+        return res.status(413).json({
+            success: false,
+            error: `Request body exceeds ${MAX_JSON_BODY_BYTES} bytes`
+        });
+    }
+    next();
+}
+
+// Machine-readable codes for error responses. Handlers that know why they failed set
+// one explicitly (sendError passes through our own error.code); any other
+// { success: false } response gets the code for its HTTP status.
+const ERROR_CODES_BY_STATUS = {
+    400: 'INVALID_REQUEST',
+    401: 'UNAUTHORIZED',
+    403: 'FORBIDDEN',
+    404: 'NOT_FOUND',
+    409: 'CONFLICT',
+    410: 'GONE',
+    413: 'PAYLOAD_TOO_LARGE',
+    422: 'UNPROCESSABLE',
+    429: 'RATE_LIMITED',
+    502: 'UPSTREAM_ERROR',
+    503: 'SERVICE_UNAVAILABLE',
+    504: 'TIMEOUT'
+};
+
+// HTTP status for each code this server assigns to the errors it throws. Their
+// messages are written for callers, so they are returned as details outside
+// development too.
+const ERROR_STATUS_BY_CODE = {
+    FILE_TOO_LARGE: 413,
+    TIMEOUT: 504,
+    CIRCUIT_OPEN: 503,
+    STORAGE_NOT_CONFIGURED: 503,
+    INSUFFICIENT_FUNDS: 503,
+    CANCELLED: 500,
+    ENCRYPTION_FAILED: 500
+};
+
+function errorCodeForStatus(status) {
+    return ERROR_CODES_BY_STATUS[status] || (status >= 500 ? 'INTERNAL_ERROR' : 'INVALID_REQUEST');
+}
+
+function appError(code, message) {
+    const error = new Error(message);
+    error.code = code;
+    return error;
+}
+
+// Status, code and details for a caught error. Upstream HTTP failures (gateway,
+// storage provider) keep their meaning; anything unrecognised gets fallbackStatus.
+function describeError(error, fallbackStatus = 500) {
+    if (ERROR_STATUS_BY_CODE[error?.code]) {
+        return { status: ERROR_STATUS_BY_CODE[error.code], code: error.code, details: error.message };
+    }
+    if (error?.status === 413) {
+        return { status: 413, code: 'FILE_TOO_LARGE', details: error.message };
+    }
+    if (error?.status === 404) {
+        return { status: 404, code: 'NOT_FOUND', details: error.message };
+    }
+    if (error?.status >= 500) {
+        return { status: 502, code: 'UPSTREAM_ERROR', details: error.message };
+    }
+
+    const details = exposeErrorDetails() ? error?.message : undefined;
+    if (typeof error?.code === 'string' && error.code.startsWith('SQLITE_')) {
+        return { status: 500, code: 'DATABASE_ERROR', details };
+    }
+    return { status: fallbackStatus, code: errorCodeForStatus(fallbackStatus), details };
+}
+
+// Send an error response for a caught error, keeping its status and code instead
+// of replacing them with a generic 500
+function sendError(res, message, error, fallbackStatus = 500) {
+    const { status, code, details } = describeError(error, fallbackStatus);
+    return res.status(status).json({ success: false, error: message, code, details });
+}
+
+function errorCodes(req, res, next) {
+    const json = res.json;
+    res.json = function (body) {
+        if (res.statusCode >= 400 && body && body.success === false && !body.code) {
+            body = { ...body, code: errorCodeForStatus(res.statusCode) };
+        }
+        return json.call(res, body);
+    };
+    next();
+}
+
+// One log line per API call. Fields named in LOG_REDACT_FIELDS (matched
+// case-insensitively, at any depth) are replaced, and other long strings are
+// reduced to their length so file bytes never reach the log.
+const LOG_REDACT_FIELDS = new Set((process.env.LOG_REDACT_FIELDS ||
+    'file,data,chunk,signature,key_signature,authorization,cookie,token,private_key,wrapped_key,password,secret,share')
+    .split(',').map(field => field.trim().toLowerCase()).filter(Boolean));
+const LOG_MAX_STRING_LENGTH = 256;
+const REQUEST_LOG_EXCLUDE_PATHS = (process.env.REQUEST_LOG_EXCLUDE_PATHS || '/health,/metrics')
+    .split(',').map(p => p.trim()).filter(Boolean);
+
+function redactForLog(value, depth = 0) {
+    if (typeof value === 'string') {
+        return value.length > LOG_MAX_STRING_LENGTH ? `[${value.length} chars]` : value;
+    }
+    if (Buffer.isBuffer(value)) {
+        return `[${value.length} bytes]`;
+    }
+    if (!value || typeof value !== 'object') {
+        return value;
+    }
+    if (depth >= 4) {
+        return '[object]';
+    }
+    if (Array.isArray(value)) {
+        return value.slice(0, 20).map(item => redactForLog(item, depth + 1));
+    }
+
+    const redacted = {};
+    for (const [key, item] of Object.entries(value)) {
+        redacted[key] = LOG_REDACT_FIELDS.has(key.toLowerCase()) ? '[REDACTED]' : redactForLog(item, depth + 1);
+    }
+    return redacted;
+}
+
+function requestLogger(req, res, next) {
+    const supplied = req.headers['x-request-id'];
+    req.id = typeof supplied === 'string' && /^[\w.-]{1,64}$/.test(supplied) ? supplied : crypto.randomUUID();
+    res.set('X-Request-Id', req.id);
+
+    if (process.env.REQUEST_LOGGING === 'false' ||
+        REQUEST_LOG_EXCLUDE_PATHS.some(p => req.path === p || req.path.startsWith(p + '/'))) {
+        return next();
+    }
+
+    const started = process.hrtime.bigint();
+    res.on('finish', () => {
+        const body = req.body && typeof req.body === 'object' && !Buffer.isBuffer(req.body) && Object.keys(req.body).length > 0 ?
+            redactForLog(req.body) : undefined;
+        console.log(`📝 ${JSON.stringify({
+            request_id: req.id,
+            method: req.method,
+            path: req.path,
+            status: res.statusCode,
+            latency_ms: Number((process.hrtime.bigint() - started) / 1000n) / 1000,
+            user_address: req.user?.address || req.body?.user_address || req.query?.user_address || null,
+            ip: req.ip,
+            query: Object.keys(req.query).length > 0 ? redactForLog(req.query) : undefined,
+            body,
+            headers: redactForLog({
+                authorization: req.headers.authorization,
+                'user-agent': req.headers['user-agent'],
+                'x-app-id': req.headers['x-app-id']
+            })
+        })}`);
+    });
+    next();
+}
+
+// Proxies allowed to set X-Forwarded-For, so req.ip (used for rate limiting and
+// request logs) is the client rather than the load balancer. TRUSTED_PROXIES is
+// a hop count, or a list of IPs, CIDR ranges and the names loopback, linklocal
+// and uniquelocal. Trusting every hop would let any client pick its own IP.
+const TRUST_PROXY_NAMES = ['loopback', 'linklocal', 'uniquelocal'];
+
+function parseTrustedProxies(raw) {
+    if (!raw) {
+        return { value: false };
+    }
+    if (/^\d+$/.test(raw.trim())) {
+        return { value: parseInt(raw) };
+    }
+
+    const entries = raw.split(',').map(entry => entry.trim()).filter(Boolean);
+    for (const entry of entries) {
+        const [address, prefix] = entry.split('/');
+        const family = net.isIP(address);
+        const maxPrefix = family === 4 ? 32 : 128;
+        const valid = TRUST_PROXY_NAMES.includes(entry) ||
+            (family && (prefix === undefined || (/^\d+$/.test(prefix) && parseInt(prefix) <= maxPrefix)));
+        if (!valid) {
+            return { error: `TRUSTED_PROXIES entry "${entry}" is not an IP, CIDR range or one of ${TRUST_PROXY_NAMES.join(', ')}` };
+        }
+    }
+    return { value: entries };
+}
+
+const trustedProxies = parseTrustedProxies(process.env.TRUSTED_PROXIES);
+app.set('trust proxy', trustedProxies.error ? false : trustedProxies.value);
+
+// Security headers. Each can be overridden through its variable, or dropped with
+// the value "off"; SECURITY_HEADERS=false drops them all. The defaults suit an API
+// that only serves JSON and file downloads. HSTS is only sent in production.
+const SECURITY_HEADER_DEFAULTS = [
+    ['Content-Security-Policy', 'SECURITY_CSP', "default-src 'none'; frame-ancestors 'none'"],
+    ['X-Content-Type-Options', 'SECURITY_CONTENT_TYPE_OPTIONS', 'nosniff'],
+    ['X-Frame-Options', 'SECURITY_FRAME_OPTIONS', 'DENY'],
+    ['Referrer-Policy', 'SECURITY_REFERRER_POLICY', 'no-referrer'],
+    ['Strict-Transport-Security', 'SECURITY_HSTS', isProduction() ? 'max-age=15552000; includeSubDomains' : 'off']
+];
+const SECURITY_HEADERS = process.env.SECURITY_HEADERS === 'false' ? [] :
+    SECURITY_HEADER_DEFAULTS
+        .map(([header, variable, fallback]) => [header, process.env[variable] ?? fallback])
+        .filter(([, value]) => value && value !== 'off');
+
+function securityHeaders(req, res, next) {
+    for (const [header, value] of SECURITY_HEADERS) {
+        res.set(header, value);
+    }
+    next();
+}
+
 // Middleware
+app.use(securityHeaders);
 app.use(cors());
-app.use(express.json({ limit: '100mb' }));
+app.use(requestLogger);
+app.use(errorCodes);
+app.use(limitJsonBody);
+app.use(express.json({ limit: MAX_JSON_BODY_BYTES }));
 app.use(rateLimit({
     windowMs: parseInt(process.env.RATE_LIMIT_WINDOW_MS) || 15 * 60 * 1000,
     max: parseInt(process.env.RATE_LIMIT_MAX_REQUESTS) || 100
 }));
 
+// Response compression (gzip, optionally brotli) for text-like bodies
+const COMPRESSIBLE_TYPES = /^(text\/|application\/(json|javascript|xml)|image\/svg\+xml)/;
+const COMPRESSION_MIN_BYTES = parseInt(process.env.COMPRESSION_MIN_BYTES) || 1024;
+const COMPRESSION_EXCLUDE_PATHS = (process.env.COMPRESSION_EXCLUDE_PATHS || '/metrics')
+    .split(',').map(p => p.trim()).filter(Boolean);
+
+function compressionMiddleware(req, res, next) {
+    if (process.env.COMPRESSION_ENABLED === 'false' || req.method === 'HEAD' ||
+        COMPRESSION_EXCLUDE_PATHS.some(p => req.path === p || req.path.startsWith(p + '/'))) {
+        return next();
+    }
+
+    // Negotiated with q-values, so "gzip;q=0" or a missing header means no compression
+    const offered = process.env.COMPRESSION_BROTLI === 'true' ? ['br', 'gzip'] : ['gzip'];
+    const encoding = req.acceptsEncodings(offered) || null;
+
+    if (!encoding) {
+        return next();
+    }
+
+    const send = res.send;
+    res.send = function (body) {
+        res.send = send;
+
+        if (typeof body === 'string' && !res.get('Content-Type')) {
+            res.type('html');
+        }
+
+        const contentType = res.get('Content-Type') || '';
+        const buffer = typeof body === 'string' ? Buffer.from(body) : body;
+
+        if (!Buffer.isBuffer(buffer) || buffer.length < COMPRESSION_MIN_BYTES ||
+            !COMPRESSIBLE_TYPES.test(contentType) || res.get('Content-Encoding') ||
+            res.statusCode === 204 || res.statusCode === 304) {
+            return send.call(res, body);
+        }
+
+        const compress = encoding === 'br' ? zlib.brotliCompress : zlib.gzip;
+        compress(buffer, (error, compressed) => {
+            if (error) {
+                return send.call(res, body);
+            }
+            res.set('Content-Encoding', encoding);
+            res.vary('Accept-Encoding');
+            send.call(res, compressed);
+        });
+        return res;
+    };
+
+    next();
+}
+
+app.use(compressionMiddleware);
+
 // Global state
 let w3upClient = null;
 let db = null;
+let replicaDb = null;
+let keyStore = null;
+let contentScanner = null;
 
 // PrivyChain Contract ABI
 const PRIVYCHAIN_ABI = [
     // File operations
     "function recordUpload(bytes32 cid, uint256 fileSize, bool isEncrypted, string calldata metadata) external",
     "function claimUploadReward(bytes32 cid) external",
+    "function batchRecordUpload(bytes32[] calldata cids, uint256[] calldata fileSizes, bool[] calldata isEncrypted, string[] calldata metadata) external",
     "function batchClaimRewards(bytes32[] calldata cids) external",
     
     // Access control
     "function grantAccess(bytes32 cid, address grantee, uint256 duration) external",
+    "function batchGrantAccess(bytes32 cid, address[] calldata grantees, uint256[] calldata durations) external",
     "function revokeAccess(bytes32 cid, address grantee) external",
     "function hasAccess(bytes32 cid, address viewer) external view returns (bool)",
     
@@ -62,32 +364,238 @@ const PRIVYCHAIN_ABI = [
 ];
 
 
+// RPC calls are bounded so a hung endpoint cannot stall request handlers or workers.
+// Confirmation waits get their own, longer budget since blocks can be slow.
+const BLOCKCHAIN_TIMEOUT_MS = parseInt(process.env.BLOCKCHAIN_TIMEOUT_MS) || 30000;
+const BLOCKCHAIN_CONFIRM_TIMEOUT_MS = parseInt(process.env.BLOCKCHAIN_CONFIRM_TIMEOUT_MS) || 180000;
+const RPC_RECONNECT_MAX_ATTEMPTS = parseInt(process.env.RPC_RECONNECT_MAX_ATTEMPTS) || 5;
+const RPC_RECONNECT_BASE_DELAY_MS = parseInt(process.env.RPC_RECONNECT_BASE_DELAY_MS) || 1000;
+const RPC_ENDPOINT_COOLDOWN_MS = parseInt(process.env.RPC_ENDPOINT_COOLDOWN_MS) || 30000;
+const RPC_CONNECTION_ERROR_CODES = [
+    'NETWORK_ERROR', 'SERVER_ERROR', 'TIMEOUT',
+    'ECONNREFUSED', 'ECONNRESET', 'ETIMEDOUT', 'ENOTFOUND', 'EAI_AGAIN'
+];
+
+// Circuit breaker for an external dependency. After failureThreshold consecutive
+// failures it opens and calls fail fast with code 'CIRCUIT_OPEN'; once resetTimeoutMs
+// has passed a single probe call is let through (half-open) and its outcome closes or
+// re-opens the circuit. isFailure decides which errors count - a 404 or a revert means
+// the dependency answered, so it counts as a success.
+class CircuitBreaker {
+    constructor(name, options = {}) {
+        this.name = name;
+        this.failureThreshold = options.failureThreshold || 5;
+        this.resetTimeoutMs = options.resetTimeoutMs || 30000;
+        this.state = 'closed';
+        this.failures = 0;
+        this.openedAt = null;
+        this.probing = false;
+        this.lastError = null;
+    }
+
+    async execute(operation, isFailure = () => true) {
+        if (this.state === 'open') {
+            if (Date.now() - this.openedAt < this.resetTimeoutMs) {
+                throw this.openError();
+            }
+            this.state = 'half_open';
+        }
+
+        const probe = this.state === 'half_open';
+        if (probe) {
+            if (this.probing) throw this.openError();
+            this.probing = true;
+        }
+
+        try {
+            const result = await operation();
+            this.recordSuccess();
+            return result;
+        } catch (error) {
+            if (isFailure(error)) {
+                this.recordFailure(error);
+            } else {
+                this.recordSuccess();
+            }
+            throw error;
+        } finally {
+            if (probe) this.probing = false;
+        }
+    }
+
+    recordSuccess() {
+        if (this.state !== 'closed') {
+            console.log(`✅ ${this.name} circuit closed`);
+        }
+        this.state = 'closed';
+        this.failures = 0;
+        this.openedAt = null;
+    }
+
+    recordFailure(error) {
+        this.failures++;
+        this.lastError = error.message;
+        if (this.state === 'half_open' || (this.state === 'closed' && this.failures >= this.failureThreshold)) {
+            console.log(`⚠️ ${this.name} circuit opened after ${this.failures} failures: ${error.message}`);
+            this.state = 'open';
+            this.openedAt = Date.now();
+        }
+    }
+
+    openError() {
+        const error = new Error(`${this.name} is unavailable (circuit open), try again later`);
+        error.code = 'CIRCUIT_OPEN';
+        return error;
+    }
+
+    getState() {
+        return {
+            state: this.state,
+            consecutive_failures: this.failures,
+            opened_at: this.openedAt ? new Date(this.openedAt).toISOString() : null,
+            retry_at: this.openedAt ? new Date(this.openedAt + this.resetTimeoutMs).toISOString() : null,
+            last_error: this.lastError
+        };
+    }
+}
+
+const CIRCUIT_FAILURE_THRESHOLD = parseInt(process.env.CIRCUIT_FAILURE_THRESHOLD) || 5;
+const CIRCUIT_RESET_TIMEOUT_MS = parseInt(process.env.CIRCUIT_RESET_TIMEOUT_MS) || 30000;
+const storageBreaker = new CircuitBreaker('Storage', {
+    failureThreshold: CIRCUIT_FAILURE_THRESHOLD,
+    resetTimeoutMs: CIRCUIT_RESET_TIMEOUT_MS
+});
+const rpcBreaker = new CircuitBreaker('Blockchain RPC', {
+    failureThreshold: CIRCUIT_FAILURE_THRESHOLD,
+    resetTimeoutMs: CIRCUIT_RESET_TIMEOUT_MS
+});
+
+// ETHEREUM_RPC may list several endpoints separated by commas
+function parseRpcUrls(value) {
+    return (value || '').split(',').map(url => url.trim()).filter(Boolean);
+}
+
+// Endpoint origin only - RPC paths often carry provider API keys
+function describeRpcUrl(url) {
+    try {
+        return new URL(url).origin;
+    } catch (error) {
+        return 'invalid-url';
+    }
+}
+
 // Complete Contract Service Class with Automatic Rewards
+// Chain access goes through ethers providers, which is also the seam for tests:
+// pass providerFactory(url, network) to hand out a stub or in-process provider
+// instead of a JsonRpcProvider. Everything else (wallet, contract) is built on it.
 class PrivyChainContractService {
-    constructor() {
+    constructor(options = {}) {
+        this.providerFactory = options.providerFactory || null;
         this.provider = null;
         this.contract = null;
         this.wallet = null;
         this.isReady = false;
+        this.endpoints = [];
+        this.activeRpcIndex = 0;
+        this.readCursor = 0;
+        this.network = null;
+        this.reconnecting = null;
+    }
+
+    // Address the backend signs transactions with, derived from PRIVATE_KEY without
+    // touching the network so operators can fund it even while RPC is down
+    getSignerAddress() {
+        if (this.wallet) return this.wallet.address;
+        try {
+            return process.env.PRIVATE_KEY ? new ethers.Wallet(process.env.PRIVATE_KEY).address : null;
+        } catch (error) {
+            return null;
+        }
+    }
+
+    // Check blockchain settings before touching the network. Misconfiguration throws
+    // so startup fails with a clear message instead of leaving a half-built service.
+    validateConfig() {
+        const { ETHEREUM_RPC, PRIVATE_KEY, CONTRACT_ADDRESS } = process.env;
+
+        if (parseRpcUrls(ETHEREUM_RPC).length === 0) {
+            if (CONTRACT_ADDRESS || PRIVATE_KEY) {
+                throw new Error('Invalid configuration: ETHEREUM_RPC is required when CONTRACT_ADDRESS or PRIVATE_KEY is set');
+            }
+            return false;
+        }
+
+        for (const url of parseRpcUrls(ETHEREUM_RPC)) {
+            let rpcUrl;
+            try {
+                rpcUrl = new URL(url);
+            } catch (error) {
+                throw new Error(`Invalid configuration: ETHEREUM_RPC entry is not a valid URL (${url})`);
+            }
+            if (!['http:', 'https:'].includes(rpcUrl.protocol)) {
+                throw new Error(`Invalid configuration: ETHEREUM_RPC must list http(s) URLs, got ${rpcUrl.protocol}`);
+            }
+        }
+
+        if (CONTRACT_ADDRESS && !ethers.isAddress(CONTRACT_ADDRESS)) {
+            throw new Error(`Invalid configuration: CONTRACT_ADDRESS is not a valid address (${CONTRACT_ADDRESS})`);
+        }
+
+        if (PRIVATE_KEY && !ethers.isHexString(PRIVATE_KEY.startsWith('0x') ? PRIVATE_KEY : `0x${PRIVATE_KEY}`, 32)) {
+            throw new Error('Invalid configuration: PRIVATE_KEY must be a 32-byte hex string');
+        }
+
+        try {
+            new ethers.Interface(PRIVYCHAIN_ABI);
+        } catch (error) {
+            throw new Error(`Invalid configuration: contract ABI could not be parsed (${error.message})`);
+        }
+
+        return true;
     }
 
+    // Connect to the RPC endpoint and contract. Returns false when blockchain support
+    // is simply not configured; throws when it is configured but unusable.
     async initialize() {
+        console.log('🔗 Initializing PrivyChain contract service...');
+
+        if (!this.validateConfig()) {
+            console.log('⚠️ No RPC endpoint configured, blockchain features disabled');
+            return false;
+        }
+
+        this.endpoints = parseRpcUrls(process.env.ETHEREUM_RPC).map(url => ({
+            url,
+            provider: null,
+            contract: null,
+            healthy: true,
+            consecutiveFailures: 0,
+            failedAt: null,
+            lastError: null
+        }));
+
         try {
-            console.log('🔗 Initializing PrivyChain contract service...');
-            
-            // Create provider
-            this.provider = new ethers.JsonRpcProvider(process.env.ETHEREUM_RPC);
-            
-            // Test connection
-            const blockNumber = await this.provider.getBlockNumber();
-            console.log(`✅ Network connected, block: ${blockNumber}`);
+            // Connect to the first reachable endpoint
+            let blockNumber = null;
+            let lastError = null;
+            for (let index = 0; index < this.endpoints.length && blockNumber === null; index++) {
+                try {
+                    blockNumber = await this.connect(index);
+                } catch (error) {
+                    lastError = error;
+                    console.log(`⚠️ RPC endpoint ${describeRpcUrl(this.endpoints[index].url)} unavailable: ${error.message}`);
+                }
+            }
+            if (blockNumber === null) {
+                throw lastError;
+            }
+            console.log(`✅ Network connected via ${this.activeRpcEndpoint()}, block: ${blockNumber}`);
             
             // Setup wallet
-            if (process.env.PRIVATE_KEY) {
-                this.wallet = new ethers.Wallet(process.env.PRIVATE_KEY, this.provider);
+            if (this.wallet) {
                 console.log(`✅ Wallet connected: ${this.wallet.address}`);
                 
-                const balance = await this.provider.getBalance(this.wallet.address);
+                const balance = await this.withDeadline(() => this.provider.getBalance(this.wallet.address));
                 console.log(`💰 Wallet balance: ${ethers.formatEther(balance)} FIL`);
             }
 
@@ -95,32 +603,30 @@ class PrivyChainContractService {
             if (process.env.CONTRACT_ADDRESS) {
                 console.log(`🔍 Checking contract: ${process.env.CONTRACT_ADDRESS}`);
                 
-                const code = await this.provider.getCode(process.env.CONTRACT_ADDRESS);
+                const code = await this.withDeadline(() => this.provider.getCode(process.env.CONTRACT_ADDRESS));
                 console.log(`📄 Contract code length: ${code.length}`);
                 
-                if (code.length > 2) {
-                    console.log(`✅ Contract exists!`);
-                    
-                    // Create contract instance with complete ABI
-                    this.contract = new ethers.Contract(
-                        process.env.CONTRACT_ADDRESS,
-                        PRIVYCHAIN_ABI,
-                        this.wallet || this.provider
-                    );
-                    
-                    // Test contract call
-                    try {
-                        const totalFiles = await this.contract.totalFilesStored();
-                        console.log(`📊 Contract stats: ${totalFiles} files stored`);
-                        this.isReady = true;
-                    } catch (callError) {
-                        console.log(`⚠️ Contract call failed: ${callError.message}`);
-                        this.isReady = true; // Still mark as ready
-                    }
-                    
-                } else {
-                    console.log(`❌ No contract code found`);
+                if (code.length <= 2) {
+                    throw new Error(`no contract code found at ${process.env.CONTRACT_ADDRESS}`);
+                }
+
+                console.log(`✅ Contract exists!`);
+                
+                // Create contract instance with complete ABI
+                this.contract = new ethers.Contract(
+                    process.env.CONTRACT_ADDRESS,
+                    PRIVYCHAIN_ABI,
+                    this.wallet || this.provider
+                );
+                
+                // Test contract call
+                try {
+                    const totalFiles = await this.withDeadline(() => this.contract.totalFilesStored());
+                    console.log(`📊 Contract stats: ${totalFiles} files stored`);
+                } catch (callError) {
+                    console.log(`⚠️ Contract call failed: ${callError.message}`);
                 }
+                this.isReady = true;
             } else {
                 console.log('⚠️ No contract address configured');
             }
@@ -128,9 +634,168 @@ class PrivyChainContractService {
             return this.isReady;
             
         } catch (error) {
-            console.error('❌ Contract service initialization failed:', error.message);
-            return false;
+            this.endpoints.forEach(endpoint => endpoint.provider?.destroy());
+            this.provider = null;
+            this.wallet = null;
+            this.contract = null;
+            throw new Error(`Blockchain initialization failed: ${error.message}`);
+        }
+    }
+
+    // Fresh provider for an RPC URL. Once the chain is known it is passed in as a
+    // static network, so a dead endpoint does not retry network detection forever.
+    createProvider(url) {
+        if (this.providerFactory) {
+            return this.providerFactory(url, this.network);
+        }
+        const rpcRequest = new ethers.FetchRequest(url);
+        rpcRequest.timeout = BLOCKCHAIN_TIMEOUT_MS;
+        return this.network
+            ? new ethers.JsonRpcProvider(rpcRequest, this.network, { staticNetwork: this.network })
+            : new ethers.JsonRpcProvider(rpcRequest);
+    }
+
+    // Dial the endpoint at index and pin the wallet and contract to it. All writes
+    // go through this one provider so nonces and pending state stay consistent.
+    // Returns the current block number.
+    async connect(index) {
+        const endpoint = this.endpoints[index];
+        const provider = this.createProvider(endpoint.url);
+
+        let blockNumber;
+        try {
+            blockNumber = await this.raceDeadline(() => provider.getBlockNumber());
+            this.network ||= await this.raceDeadline(() => provider.getNetwork());
+        } catch (error) {
+            provider.destroy();
+            this.markUnhealthy(endpoint, error);
+            throw error;
+        }
+
+        const previous = endpoint.provider;
+        endpoint.provider = provider;
+        endpoint.contract = null;
+        this.markHealthy(endpoint);
+
+        this.provider = provider;
+        this.activeRpcIndex = index;
+
+        if (this.wallet) {
+            this.wallet = this.wallet.connect(provider);
+        } else if (process.env.PRIVATE_KEY) {
+            this.wallet = new ethers.Wallet(process.env.PRIVATE_KEY, provider);
+        }
+        if (this.contract) {
+            this.contract = this.contract.connect(this.wallet || provider);
+        }
+
+        previous?.destroy();
+        return blockNumber;
+    }
+
+    // Re-dial after a connection failure, rotating through the configured endpoints
+    // with exponential backoff. Concurrent callers share a single attempt.
+    reconnect() {
+        if (!this.reconnecting) {
+            this.reconnecting = this.redial().finally(() => {
+                this.reconnecting = null;
+            });
+        }
+        return this.reconnecting;
+    }
+
+    async redial() {
+        for (let attempt = 0; attempt < RPC_RECONNECT_MAX_ATTEMPTS; attempt++) {
+            const index = (this.activeRpcIndex + 1 + attempt) % this.endpoints.length;
+            await new Promise(resolve => setTimeout(resolve, RPC_RECONNECT_BASE_DELAY_MS * 2 ** attempt));
+
+            try {
+                await this.connect(index);
+                console.log(`🔌 Reconnected to RPC endpoint ${this.activeRpcEndpoint()}`);
+                return true;
+            } catch (error) {
+                console.log(`⚠️ RPC reconnect attempt ${attempt + 1} to ${describeRpcUrl(this.endpoints[index].url)} failed: ${error.message}`);
+            }
+        }
+
+        console.error(`❌ Could not reconnect to any RPC endpoint after ${RPC_RECONNECT_MAX_ATTEMPTS} attempts`);
+        return false;
+    }
+
+    // Run a read-only call, round-robin across endpoints and failing over to the next
+    // one on connection errors. operation receives (contract, provider) bound to the
+    // chosen endpoint. Endpoints that recently failed are skipped during their cooldown.
+    async read(operation, options = {}) {
+        let lastError = null;
+
+        for (const endpoint of this.readOrder()) {
+            try {
+                endpoint.provider ||= this.createProvider(endpoint.url);
+                if (this.contract) {
+                    endpoint.contract ||= this.contract.connect(endpoint.provider);
+                }
+
+                const result = await this.raceDeadline(
+                    () => operation(endpoint.contract, endpoint.provider), options
+                );
+                this.markHealthy(endpoint);
+                return result;
+            } catch (error) {
+                if (options.signal?.aborted || !this.isConnectionError(error)) {
+                    throw error;
+                }
+                this.markUnhealthy(endpoint, error);
+                console.log(`⚠️ RPC read via ${describeRpcUrl(endpoint.url)} failed (${error.code}), failing over`);
+                lastError = error;
+            }
         }
+
+        throw lastError;
+    }
+
+    readOrder() {
+        const count = this.endpoints.length;
+        const start = this.readCursor++ % count;
+        const rotated = this.endpoints.map((_, i) => this.endpoints[(start + i) % count]);
+        const now = Date.now();
+        const available = rotated.filter(endpoint =>
+            endpoint.healthy || now - endpoint.failedAt >= RPC_ENDPOINT_COOLDOWN_MS
+        );
+        return available.length > 0 ? available : rotated;
+    }
+
+    markHealthy(endpoint) {
+        endpoint.healthy = true;
+        endpoint.consecutiveFailures = 0;
+    }
+
+    markUnhealthy(endpoint, error) {
+        endpoint.healthy = false;
+        endpoint.consecutiveFailures += 1;
+        endpoint.failedAt = Date.now();
+        endpoint.lastError = error.message;
+    }
+
+    isConnectionError(error) {
+        return RPC_CONNECTION_ERROR_CODES.includes(error?.code) ||
+            RPC_CONNECTION_ERROR_CODES.includes(error?.cause?.code);
+    }
+
+    // Origin of the endpoint currently used for writes, for health reporting
+    activeRpcEndpoint() {
+        return this.provider ? describeRpcUrl(this.endpoints[this.activeRpcIndex].url) : null;
+    }
+
+    // Per-endpoint health, for health reporting
+    endpointHealth() {
+        return this.endpoints.map((endpoint, index) => ({
+            endpoint: describeRpcUrl(endpoint.url),
+            active: !!this.provider && index === this.activeRpcIndex,
+            healthy: endpoint.healthy,
+            consecutiveFailures: endpoint.consecutiveFailures,
+            lastFailureAt: endpoint.failedAt ? new Date(endpoint.failedAt).toISOString() : null,
+            lastError: endpoint.lastError
+        }));
     }
 
     // Convert string CID to bytes32
@@ -139,8 +804,91 @@ class PrivyChainContractService {
         return ethers.keccak256(ethers.toUtf8Bytes(cleanCid));
     }
 
+    // Run a blockchain operation bounded by options.timeoutMs (default BLOCKCHAIN_TIMEOUT_MS)
+    // and cancelled early when options.signal aborts, e.g. because the client went away.
+    // A transaction that was already broadcast still mines; only the wait is abandoned.
+    // Connection errors trigger a reconnect and one retry unless options.retry is false,
+    // so operations must read this.provider / this.contract when invoked.
+    // Timeouts and connection errors that survive failover count against rpcBreaker;
+    // options.circuit = false opts out (confirmation waits, where slow blocks are normal).
+    async withDeadline(operation, options = {}) {
+        if (options.circuit === false) {
+            return this.withReconnect(operation, options);
+        }
+        return rpcBreaker.execute(
+            () => this.withReconnect(operation, options),
+            (error) => !options.signal?.aborted && this.isConnectionError(error)
+        );
+    }
+
+    async withReconnect(operation, options = {}) {
+        const provider = this.provider;
+
+        try {
+            return await this.raceDeadline(operation, options);
+        } catch (error) {
+            if (options.retry === false || options.signal?.aborted || !this.isConnectionError(error)) {
+                throw error;
+            }
+
+            console.log(`⚠️ RPC connection error (${error.code}), reconnecting...`);
+            // Another caller may already have moved us to a fresh provider
+            if (this.provider === provider) {
+                this.markUnhealthy(this.endpoints[this.activeRpcIndex], error);
+                if (!(await this.reconnect())) {
+                    throw error;
+                }
+            }
+            return this.raceDeadline(operation, options);
+        }
+    }
+
+    async raceDeadline(operation, options = {}) {
+        const { signal } = options;
+        const timeoutMs = options.timeoutMs || BLOCKCHAIN_TIMEOUT_MS;
+
+        if (signal?.aborted) {
+            throw new Error('Blockchain operation cancelled');
+        }
+
+        let timer = null;
+        let onAbort = null;
+        const deadline = new Promise((_, reject) => {
+            timer = setTimeout(() => {
+                const error = new Error(`Blockchain operation timed out after ${timeoutMs}ms`);
+                error.code = 'TIMEOUT';
+                reject(error);
+            }, timeoutMs);
+            onAbort = () => reject(new Error('Blockchain operation cancelled'));
+            signal?.addEventListener('abort', onAbort, { once: true });
+        });
+
+        try {
+            return await Promise.race([operation(), deadline]);
+        } finally {
+            clearTimeout(timer);
+            signal?.removeEventListener('abort', onAbort);
+        }
+    }
+
+    // Wait for a sent transaction to be mined, using the confirmation budget. A slow
+    // block is not a connection problem, so the wait is not retried.
+    async waitForReceipt(tx, options = {}) {
+        const receipt = await this.withDeadline(() => this.provider.waitForTransaction(tx.hash), {
+            signal: options.signal,
+            timeoutMs: options.confirmTimeoutMs || BLOCKCHAIN_CONFIRM_TIMEOUT_MS,
+            retry: false,
+            circuit: false
+        });
+
+        if (receipt.status !== 1) {
+            throw new Error(`Transaction ${tx.hash} reverted`);
+        }
+        return receipt;
+    }
+
     // Record file upload on blockchain
-    async recordFileUpload(cid, fileSize, isEncrypted, metadata, uploaderAddress) {
+    async recordFileUpload(cid, fileSize, isEncrypted, metadata, uploaderAddress, options = {}) {
         if (!this.isReady || !this.wallet) {
             console.log('⚠️ Contract not ready or no wallet, skipping blockchain recording');
             return null;
@@ -153,17 +901,18 @@ class PrivyChainContractService {
             const metadataJson = JSON.stringify(metadata || {});
             
             // Estimate gas
-            const gasEstimate = await this.contract.recordUpload.estimateGas(
+            const gasEstimate = await this.withDeadline(() => this.contract.recordUpload.estimateGas(
                 cidBytes32,
                 fileSize,
                 isEncrypted,
                 metadataJson
-            );
+            ), options);
             
             console.log(`⛽ Estimated gas: ${gasEstimate.toString()}`);
+            await this.ensureFunds(gasEstimate * 120n / 100n, options);
             
             // Send transaction
-            const tx = await this.contract.recordUpload(
+            const tx = await this.withDeadline(() => this.contract.recordUpload(
                 cidBytes32,
                 fileSize,
                 isEncrypted,
@@ -171,64 +920,155 @@ class PrivyChainContractService {
                 {
                     gasLimit: gasEstimate * 120n / 100n
                 }
-            );
+            ), { ...options, retry: false });
             
             console.log(`📤 Transaction sent: ${tx.hash}`);
-            const receipt = await tx.wait();
+            const receipt = await this.waitForReceipt(tx, options);
             
             console.log(`✅ File recorded on blockchain! Block: ${receipt.blockNumber}`);
             return receipt.hash;
             
         } catch (error) {
             console.error('❌ Failed to record file on blockchain:', error.message);
+            // An unfunded signer is an operator problem worth reporting, not a silent skip
+            if (error.code === 'INSUFFICIENT_FUNDS') throw error;
             return null;
         }
     }
 
-    // Enhanced claim reward method for auto-distribution
-    async claimUploadReward(cid) {
+    // Record several uploads in one batchRecordUpload transaction. entries are
+    // { cid, fileSize, isEncrypted, metadata }. CIDs already on-chain are skipped
+    // by the contract, so a retried batch does not revert.
+    async recordFileUploads(entries, options = {}) {
+        if (!this.isReady || !this.wallet) {
+            throw new Error('Contract not ready or no wallet for batch recording');
+        }
+
+        console.log(`📝 Recording ${entries.length} file uploads on blockchain in one transaction`);
+
+        const args = [
+            entries.map(entry => this.cidToBytes32(entry.cid)),
+            entries.map(entry => entry.fileSize),
+            entries.map(entry => !!entry.isEncrypted),
+            entries.map(entry => JSON.stringify(entry.metadata || {}))
+        ];
+
+        const gasEstimate = await this.withDeadline(() => this.contract.batchRecordUpload.estimateGas(...args), options);
+        console.log(`⛽ Batch gas estimate: ${gasEstimate.toString()}`);
+        await this.ensureFunds(gasEstimate * 120n / 100n, options);
+
+        const tx = await this.withDeadline(() => this.contract.batchRecordUpload(...args, {
+            gasLimit: gasEstimate * 120n / 100n
+        }), { ...options, retry: false });
+
+        console.log(`📤 Batch transaction sent: ${tx.hash}`);
+        const receipt = await this.waitForReceipt(tx, options);
+
+        console.log(`✅ ${entries.length} files recorded on blockchain! Block: ${receipt.blockNumber}`);
+        return receipt.hash;
+    }
+
+    // Claim rewards for several recorded files in one transaction. The contract skips
+    // files that are not eligible, so per-file amounts are not reported.
+    async batchClaimRewards(cids, options = {}) {
         if (!this.isReady || !this.wallet) {
             console.log('⚠️ Contract not ready or no wallet for reward claiming');
             return null;
         }
 
-        try {
-            console.log(`🏆 Claiming upload reward for CID: ${cid}`);
-            
-            const cidBytes32 = this.cidToBytes32(cid);
+        const cidsBytes32 = cids.map(cid => this.cidToBytes32(cid));
+        const gasEstimate = await this.withDeadline(
+            () => this.contract.batchClaimRewards.estimateGas(cidsBytes32), options
+        );
+        await this.ensureFunds(gasEstimate * 120n / 100n, options);
+
+        const tx = await this.withDeadline(() => this.contract.batchClaimRewards(cidsBytes32, {
+            gasLimit: gasEstimate * 120n / 100n
+        }), { ...options, retry: false });
+
+        console.log(`📤 Batch reward claim transaction sent: ${tx.hash}`);
+        const receipt = await this.waitForReceipt(tx, options);
+        return receipt.hash;
+    }
+
+    // Throws INSUFFICIENT_FUNDS (with required/available in wei) when the signer cannot
+    // pay for gasLimit at current fees, so the transaction is never sent to fail on-chain
+    async ensureFunds(gasLimit, options = {}) {
+        const [balance, feeData] = await Promise.all([
+            this.withDeadline(() => this.provider.getBalance(this.wallet.address), options),
+            this.withDeadline(() => this.provider.getFeeData(), options)
+        ]);
+        const required = gasLimit * (feeData.maxFeePerGas ?? feeData.gasPrice ?? 0n);
+
+        if (balance < required) {
+            const error = new Error(
+                `Insufficient funds for gas: requires ${ethers.formatEther(required)} FIL, ` +
+                `signer ${this.wallet.address} has ${ethers.formatEther(balance)} FIL`
+            );
+            error.code = 'INSUFFICIENT_FUNDS';
+            error.required = required.toString();
+            error.available = balance.toString();
+            throw error;
+        }
+    }
+
+    // Enhanced claim reward method for auto-distribution
+    async claimUploadReward(cid, options = {}) {
+        if (!this.isReady || !this.wallet) {
+            console.log('⚠️ Contract not ready or no wallet for reward claiming');
+            return null;
+        }
+
+        try {
+            console.log(`🏆 Claiming upload reward for CID: ${cid}`);
+            
+            const cidBytes32 = this.cidToBytes32(cid);
             
-            // Check current reward balance before claiming
-            const balanceBefore = await this.contract.userRewardBalance(this.wallet.address);
+            // Check current reward balance before claiming. Balance reads stay on the
+            // write endpoint so the before/after difference is not skewed by a lagging node.
+            const balanceBefore = await this.withDeadline(
+                () => this.contract.userRewardBalance(this.wallet.address), options
+            );
             console.log(`💰 User balance before: ${ethers.formatEther(balanceBefore)} FIL`);
             
             // Check if reward already claimed
+            let fileRecord;
             try {
-                const fileRecord = await this.contract.getFileRecord(cidBytes32);
-                if (fileRecord.rewardClaimed) {
-                    throw new Error('Reward already claimed for this file');
-                }
-                console.log(`📋 File record found, reward not yet claimed`);
+                fileRecord = await this.getFileRecord(cid, options);
             } catch (recordError) {
-                if (recordError.message.includes('already claimed')) {
-                    throw recordError;
-                }
+                if (options.signal?.aborted) throw recordError;
                 console.log('⚠️ Could not check file record, proceeding with claim...');
             }
+
+            if (fileRecord === null) {
+                throw new Error('File is not recorded on the blockchain');
+            }
+            if (fileRecord?.rewardClaimed) {
+                throw new Error('Reward already claimed for this file');
+            }
+            if (fileRecord) {
+                console.log(`📋 File record found, reward not yet claimed`);
+            }
             
             // Estimate gas for claiming
-            const gasEstimate = await this.contract.claimUploadReward.estimateGas(cidBytes32);
+            const gasEstimate = await this.withDeadline(
+                () => this.contract.claimUploadReward.estimateGas(cidBytes32), options
+            );
             console.log(`⛽ Claim gas estimate: ${gasEstimate.toString()}`);
+            await this.ensureFunds(gasEstimate * 120n / 100n, options);
             
             // Send claim transaction
-            const tx = await this.contract.claimUploadReward(cidBytes32, {
+            const tx = await this.withDeadline(() => this.contract.claimUploadReward(cidBytes32, {
                 gasLimit: gasEstimate * 120n / 100n
-            });
+            }), { ...options, retry: false });
             
             console.log(`📤 Reward claim transaction sent: ${tx.hash}`);
-            const receipt = await tx.wait();
+            const receipt = await this.waitForReceipt(tx, options);
             
             // Check balance after claiming to get actual reward amount
-            const balanceAfter = await this.contract.userRewardBalance(this.wallet.address);
+            const balanceAfter = await this.withDeadline(
+                () => this.contract.userRewardBalance(this.wallet.address), options
+            );
             const rewardAmount = balanceAfter - balanceBefore;
             
             console.log(`✅ Reward claimed successfully!`);
@@ -256,6 +1096,100 @@ class PrivyChainContractService {
         }
     }
 
+    // Grant access to a file on-chain. duration is in seconds; 0 means permanent.
+    // The server wallet records uploads, so it is the on-chain owner allowed to grant.
+    async grantFileAccess(cid, grantee, duration, options = {}) {
+        if (!this.isReady || !this.wallet) {
+            console.log('⚠️ Contract not ready or no wallet for access grant');
+            return null;
+        }
+
+        console.log(`🔐 Granting on-chain access to ${grantee} for CID: ${cid}`);
+
+        const cidBytes32 = this.cidToBytes32(cid);
+        const tx = await this.withDeadline(
+            () => this.contract.grantAccess(cidBytes32, grantee, duration),
+            { ...options, retry: false }
+        );
+
+        console.log(`📤 Access grant transaction sent: ${tx.hash}`);
+        const receipt = await this.waitForReceipt(tx, options);
+
+        console.log(`✅ Access granted on blockchain! Block: ${receipt.blockNumber}`);
+        return receipt.hash;
+    }
+
+    // Grant several addresses access to one file in a single transaction.
+    // durations[i] applies to grantees[i]; 0 means permanent.
+    async grantFileAccessBatch(cid, grantees, durations, options = {}) {
+        if (!this.isReady || !this.wallet) {
+            console.log('⚠️ Contract not ready or no wallet for access grant');
+            return null;
+        }
+
+        console.log(`🔐 Granting on-chain access to ${grantees.length} addresses for CID: ${cid}`);
+
+        const tx = await this.withDeadline(
+            () => this.contract.batchGrantAccess(this.cidToBytes32(cid), grantees, durations),
+            { ...options, retry: false }
+        );
+
+        console.log(`📤 Batch access grant transaction sent: ${tx.hash}`);
+        const receipt = await this.waitForReceipt(tx, options);
+
+        console.log(`✅ Access granted on blockchain! Block: ${receipt.blockNumber}`);
+        return receipt.hash;
+    }
+
+    // Dry-run a contract write against the pending state without sending a transaction.
+    // Resolves to { ok: true } or { ok: false, reason } with the decoded revert reason;
+    // RPC failures are thrown. Runs on the write endpoint, whose pending state matters.
+    async simulate(method, args = [], options = {}) {
+        if (!this.isReady || !this.wallet) {
+            throw new Error('Contract not ready or no wallet for simulation');
+        }
+
+        try {
+            await this.withDeadline(
+                () => this.contract[method].staticCall(...args, { blockTag: 'pending' }),
+                options
+            );
+            return { ok: true };
+        } catch (error) {
+            if (error.code !== 'CALL_EXCEPTION') {
+                throw error;
+            }
+            return {
+                ok: false,
+                reason: error.reason || error.revert?.name || error.shortMessage || 'execution reverted'
+            };
+        }
+    }
+
+    // Look up a transaction: not_found, pending, confirmed or failed
+    async getTransactionStatus(txHash, options = {}) {
+        if (!this.provider) {
+            return null;
+        }
+
+        return this.read(async (contract, provider) => {
+            const receipt = await provider.getTransactionReceipt(txHash);
+
+            if (!receipt) {
+                const tx = await provider.getTransaction(txHash);
+                return { txHash, status: tx ? 'pending' : 'not_found' };
+            }
+
+            return {
+                txHash,
+                status: receipt.status === 1 ? 'confirmed' : 'failed',
+                blockNumber: receipt.blockNumber,
+                confirmations: await receipt.confirmations(),
+                gasUsed: receipt.gasUsed.toString()
+            };
+        }, options);
+    }
+
     // Calculate reward for file
     async calculateReward(fileSize, isEncrypted) {
         if (!this.isReady) {
@@ -263,7 +1197,7 @@ class PrivyChainContractService {
         }
 
         try {
-            const reward = await this.contract.calculateReward(fileSize, isEncrypted);
+            const reward = await this.read(contract => contract.calculateReward(fileSize, isEncrypted));
             return ethers.formatEther(reward);
         } catch (error) {
             console.error('❌ Failed to calculate reward:', error.message);
@@ -285,14 +1219,14 @@ class PrivyChainContractService {
                 baseReward,
                 sizeMultiplier,
                 encryptionBonus
-            ] = await Promise.all([
-                this.contract.totalFilesStored(),
-                this.contract.totalRewardsDistributed(),
-                this.contract.totalStorageUsed(),
-                this.contract.baseRewardAmount(),
-                this.contract.sizeMultiplier(),
-                this.contract.encryptionBonus()
-            ]);
+            ] = await this.read(contract => Promise.all([
+                contract.totalFilesStored(),
+                contract.totalRewardsDistributed(),
+                contract.totalStorageUsed(),
+                contract.baseRewardAmount(),
+                contract.sizeMultiplier(),
+                contract.encryptionBonus()
+            ]));
 
             return {
                 totalFiles: totalFiles.toString(),
@@ -315,7 +1249,7 @@ class PrivyChainContractService {
         }
 
         try {
-            const balance = await this.contract.userRewardBalance(userAddress);
+            const balance = await this.read(contract => contract.userRewardBalance(userAddress));
             return ethers.formatEther(balance);
         } catch (error) {
             console.error('❌ Failed to get user reward balance:', error.message);
@@ -328,927 +1262,8843 @@ class PrivyChainContractService {
         return this.isReady;
     }
 
-    // Get file record from blockchain
-    async getFileRecord(cid) {
+    // Get file record from blockchain. The contract returns a zero-valued struct
+    // for unknown CIDs instead of reverting, so a zero uploader means "not recorded"
+    // and yields null. RPC failures are thrown so callers can tell the two apart.
+    async getFileRecord(cid, options = {}) {
+        if (!this.isReady) {
+            return null;
+        }
+
+        const cidBytes32 = this.cidToBytes32(cid);
+        const record = await this.read(contract => contract.getFileRecord(cidBytes32), options);
+
+        if (record.uploader === ethers.ZeroAddress) {
+            return null;
+        }
+
+        return {
+            cid: record.cid,
+            uploader: record.uploader,
+            timestamp: record.timestamp.toString(),
+            recordedAt: new Date(Number(record.timestamp) * 1000).toISOString(),
+            fileSize: record.fileSize.toString(),
+            isEncrypted: record.isEncrypted,
+            rewardClaimed: record.rewardClaimed,
+            metadata: record.metadata
+        };
+    }
+
+    // On-chain grant for (cid, grantee), or null if there never was one. expiresAt is
+    // null for grants without an expiry (duration 0, which the contract stores as uint256 max).
+    async getAccessGrant(cid, grantee, options = {}) {
         if (!this.isReady) {
             return null;
         }
 
+        const grant = await this.read(contract => contract.getAccessGrant(this.cidToBytes32(cid), grantee), options);
+        if (grant.grantee === ethers.ZeroAddress) {
+            return null;
+        }
+
+        return {
+            granter: grant.granter,
+            grantee: grant.grantee,
+            expiresAt: grant.expiresAt > 0n && grant.expiresAt !== ethers.MaxUint256 ?
+                new Date(Number(grant.expiresAt) * 1000).toISOString() : null,
+            isActive: grant.isActive
+        };
+    }
+
+    // Check whether a CID has been recorded on-chain
+    async checkFileExists(cid, options = {}) {
         try {
-            const cidBytes32 = this.cidToBytes32(cid);
-            const record = await this.contract.getFileRecord(cidBytes32);
-            
-            return {
-                cid: record[0],
-                uploader: record[1],
-                timestamp: record[2].toString(),
-                fileSize: record[3].toString(),
-                isEncrypted: record[4],
-                rewardClaimed: record[5],
-                metadata: record[6]
-            };
+            return (await this.getFileRecord(cid, options)) !== null;
         } catch (error) {
             console.error('❌ Failed to get file record from blockchain:', error.message);
-            return null;
+            return false;
         }
     }
 
     // Check if user has access to file
-    async checkFileAccess(cid, userAddress) {
+    async checkFileAccess(cid, userAddress, options = {}) {
         if (!this.isReady) {
             return false;
         }
 
         try {
             const cidBytes32 = this.cidToBytes32(cid);
-            return await this.contract.hasAccess(cidBytes32, userAddress);
+            return await this.read(contract => contract.hasAccess(cidBytes32, userAddress), options);
         } catch (error) {
             console.error('❌ Failed to check file access:', error.message);
             return false;
         }
     }
-}
 
-// Initialize contract service
-const contractService = new PrivyChainContractService();
+    // Fetch and decode FileUploaded, RewardClaimed and AccessGranted logs in a block range.
+    // Event sync uses the pinned provider so block heights and logs come from one node.
+    async fetchEvents(fromBlock, toBlock) {
+        const iface = this.contract.interface;
+        const topics = ['FileUploaded', 'RewardClaimed', 'AccessGranted']
+            .map(name => iface.getEvent(name).topicHash);
 
-// Initialize database
-async function initializeDatabase() {
-    console.log('📊 Initializing database...');
-    
-    const dbPath = process.env.DATABASE_PATH || './privychain.db';
-    
-    db = await open({
-        filename: dbPath,
-        driver: sqlite3.Database
-    });
+        const logs = await this.withDeadline(() => this.provider.getLogs({
+            address: process.env.CONTRACT_ADDRESS,
+            topics: [topics],
+            fromBlock,
+            toBlock
+        }));
 
-    // Create tables
-    await db.exec(`
-        CREATE TABLE IF NOT EXISTS file_records (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            cid TEXT UNIQUE NOT NULL,
-            uploader_addr TEXT NOT NULL,
-            file_size INTEGER NOT NULL,
-            is_encrypted BOOLEAN NOT NULL DEFAULT 0,
-            file_name TEXT NOT NULL,
-            content_type TEXT,
-            metadata TEXT,
-            tx_hash TEXT,
-            status TEXT DEFAULT 'pending',
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-            updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-        );
+        return logs.map(log => {
+            const parsed = iface.parseLog(log);
+            return {
+                name: parsed.name,
+                args: parsed.args,
+                blockNumber: log.blockNumber,
+                txHash: log.transactionHash,
+                logIndex: log.index
+            };
+        });
+    }
 
-        CREATE TABLE IF NOT EXISTS access_grants (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            cid TEXT NOT NULL,
-            granter_addr TEXT NOT NULL,
-            grantee_addr TEXT NOT NULL,
-            expires_at DATETIME,
-            is_active BOOLEAN DEFAULT 1,
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-        );
+    // Poll the chain for contract events starting at fromBlock, calling onEvents for
+    // each processed range in order. onEvents receives (events, lastBlock) and should
+    // persist lastBlock so a restart resumes where it left off. Returns a stop function.
+    subscribeEvents(fromBlock, onEvents, options = {}) {
+        const intervalMs = options.intervalMs || 15000;
+        const maxRange = options.maxRange || 2000;
+        let nextBlock = fromBlock;
+        let stopped = false;
+        let timer = null;
 
-        CREATE TABLE IF NOT EXISTS encryption_keys (
-            user_address TEXT PRIMARY KEY,
-            public_key TEXT NOT NULL,
-            key_id TEXT NOT NULL,
-            created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-        );
-    `);
+        const poll = async () => {
+            if (stopped) return;
 
-    console.log('✅ Database initialized');
-}
+            try {
+                const latest = await this.withDeadline(() => this.provider.getBlockNumber());
 
-// Initialize Web3.Storage w3up client
-async function initializeW3up() {
-    console.log('🔧 Initializing Web3.Storage w3up client...');
-    
-    try {
-        w3upClient = await create();
-        
-        // Check if already logged in
-        const accounts = w3upClient.accounts();
-        if (Object.keys(accounts).length === 0) {
-            console.log('⚠️  No w3up account found.');
-            
-            if (process.env.WEB3_STORAGE_TOKEN) {
-                console.log('💡 Found WEB3_STORAGE_TOKEN in your config.');
-                console.log('💡 This JS backend uses w3up client instead of the legacy token.');
-                console.log('💡 Your existing w3up configuration should work automatically.');
+                while (!stopped && nextBlock <= latest) {
+                    const toBlock = Math.min(nextBlock + maxRange - 1, latest);
+                    const events = await this.fetchEvents(nextBlock, toBlock);
+                    await onEvents(events, toBlock);
+                    nextBlock = toBlock + 1;
+                }
+            } catch (error) {
+                console.error('❌ Event subscription poll failed:', error.message);
             }
-            console.log('💡 If needed, run: npm run setup');
-            return false;
-        }
-        
-        // Check current space
-        const currentSpace = w3upClient.currentSpace();
-        if (!currentSpace) {
-            const spaces = Object.values(w3upClient.spaces());
-            if (spaces.length > 0) {
-                await w3upClient.setCurrentSpace(spaces[0].did());
-                console.log(`✅ Using existing space: ${spaces[0].did()}`);
-            } else {
-                console.log('⚠️  No current space set. Run: npm run setup');
-                return false;
+
+            if (!stopped) {
+                timer = setTimeout(poll, intervalMs);
             }
-        } else {
-            console.log(`✅ Using space: ${currentSpace.did()}`);
-        }
-        
-        console.log('✅ w3up client ready!');
-        return true;
-    } catch (error) {
-        console.error('❌ Failed to initialize w3up:', error.message);
-        console.log('💡 Run: npm run setup if you need to reconfigure');
-        return false;
+        };
+
+        poll();
+
+        return () => {
+            stopped = true;
+            if (timer) clearTimeout(timer);
+        };
     }
 }
 
-// Encryption utilities
-class EncryptionService {
-    static generateKey() {
-        return crypto.randomBytes(32); // AES-256 key
-    }
+// Initialize contract service
+const contractService = new PrivyChainContractService();
 
-    static encrypt(data, key) {
-        const iv = crypto.randomBytes(16);
-        const cipher = crypto.createCipher('aes-256-gcm', key);
-        cipher.setAAD(Buffer.from('privychain', 'utf8'));
-        
-        let encrypted = cipher.update(data);
-        encrypted = Buffer.concat([encrypted, cipher.final()]);
-        
-        const authTag = cipher.getAuthTag();
-        return Buffer.concat([iv, authTag, encrypted]);
+// In-process fan-out of per-CID status changes (status, reward_claimed,
+// access_granted) to Server-Sent Events subscribers
+class FileEventBroker {
+    constructor() {
+        this.emitter = new EventEmitter();
+        this.emitter.setMaxListeners(0);
     }
 
-    static decrypt(encryptedData, key) {
-        const iv = encryptedData.slice(0, 16);
-        const authTag = encryptedData.slice(16, 32);
-        const encrypted = encryptedData.slice(32);
-        
-        const decipher = crypto.createDecipher('aes-256-gcm', key);
-        decipher.setAAD(Buffer.from('privychain', 'utf8'));
-        decipher.setAuthTag(authTag);
-        
-        let decrypted = decipher.update(encrypted);
-        decrypted = Buffer.concat([decrypted, decipher.final()]);
-        return decrypted;
+    publish(cid, type, data = {}) {
+        this.emitter.emit(cid, { type, cid, data, at: new Date().toISOString() });
     }
 
-    static async getUserKey(userAddress) {
-        let keyRecord = await db.get(
-            'SELECT * FROM encryption_keys WHERE user_address = ?',
-            [userAddress]
-        );
-        
-        if (!keyRecord) {
-            const key = this.generateKey();
-            await db.run(
-                'INSERT INTO encryption_keys (user_address, public_key, key_id) VALUES (?, ?, ?)',
-                [userAddress, key.toString('hex'), `key_${Date.now()}`]
-            );
-            return key;
-        }
-        
-        return Buffer.from(keyRecord.public_key, 'hex');
+    // Returns an unsubscribe function
+    subscribe(cid, listener) {
+        this.emitter.on(cid, listener);
+        return () => this.emitter.off(cid, listener);
     }
 }
 
-class AuthService {
-    static isValidAddress(address) {
-        try {
-            return ethers.isAddress(address);
-        } catch (error) {
-            console.error('Address validation error:', error);
-            return false;
-        }
+const fileEventBroker = new FileEventBroker();
+
+// Outbox worker - records uploads on-chain from the blockchain_jobs table
+class BlockchainJobWorker {
+    constructor() {
+        this.timer = null;
+        this.polling = false;
+        this.pollIntervalMs = parseInt(process.env.BLOCKCHAIN_JOB_POLL_INTERVAL_MS) || 10000;
+        this.maxAttempts = parseInt(process.env.BLOCKCHAIN_JOB_MAX_ATTEMPTS) || 5;
+        this.batchSize = parseInt(process.env.BLOCKCHAIN_JOB_BATCH_SIZE) || 10;
+        this.recordBatchSize = parseInt(process.env.BLOCKCHAIN_RECORD_BATCH_SIZE) || 20;
+        this.recordBatchMaxWaitMs = parseInt(process.env.BLOCKCHAIN_RECORD_BATCH_MAX_WAIT_MS) || 60000;
     }
 
-    static validateRequest(req) {
-        const errors = [];
-        
-        if (!req.user_address) {
-            errors.push({ field: 'user_address', message: 'User address is required' });
-        } else if (!this.isValidAddress(req.user_address)) {
-            errors.push({ field: 'user_address', message: 'Invalid Ethereum address' });
-        }
-        
-        return errors;
+    // Blockchain recording only makes sense when a contract and signer are configured
+    static isEnabled() {
+        return !!(process.env.CONTRACT_ADDRESS && process.env.PRIVATE_KEY);
     }
-    
-    // Keep these methods for any remaining code that might reference them
-    static verifySignature(address, signature, message) {
-        console.log('⚠️  Signature verification bypassed');
-        return true;
+
+    // In batch mode record_upload jobs wait in the queue and are recorded together in
+    // one batchRecordUpload transaction, trading confirmation latency for gas
+    static isBatchingEnabled() {
+        return process.env.BLOCKCHAIN_BATCH_ENABLED === 'true';
     }
-    
-    static isValidSignatureFormat(signature) {
-        return signature && 
-               signature.startsWith('0x') && 
-               signature.length === 132;
+
+    static async enqueue(cid, jobType, payload) {
+        const result = await db.run(`
+            INSERT INTO blockchain_jobs (cid, job_type, payload, status)
+            VALUES (?, ?, ?, 'pending')
+        `, [cid, jobType, JSON.stringify(payload || {})]);
+        return result.lastID;
     }
-}
-// API Routes
 
-// Health check
-app.get('/health', (req, res) => {
-    res.json({
-        success: true,
-        data: {
-            status: 'healthy',
-            service: 'privychain-backend',
-            version: '1.0.0',
-            timestamp: new Date().toISOString(),
-            w3up_ready: w3upClient !== null,
-            database_ready: db !== null,
-            contract_ready: contractService.isReady,
-            environment: {
-                node_env: process.env.NODE_ENV || process.env.ENVIRONMENT,
-                has_web3_token: !!process.env.WEB3_STORAGE_TOKEN,
-                has_contract: !!process.env.CONTRACT_ADDRESS,
-                has_private_key: !!process.env.PRIVATE_KEY,
-                skip_signature_verification: process.env.SKIP_SIGNATURE_VERIFICATION === 'true'
-            }
+    start() {
+        if (this.timer) return;
+        console.log(`⏱️ Blockchain job worker polling every ${this.pollIntervalMs}ms`);
+        this.timer = setInterval(() => this.poll(), this.pollIntervalMs);
+        this.poll();
+    }
+
+    stop() {
+        if (this.timer) {
+            clearInterval(this.timer);
+            this.timer = null;
         }
-    });
-});
+    }
 
-// File upload with automatic reward distribution
-app.post('/upload', async (req, res) => {
-    try {
-        const { file, file_name, content_type, should_encrypt, metadata, user_address } = req.body;
-        
-        // Basic validation only
-        if (!file || !file_name || !user_address) {
-            return res.status(400).json({
-                success: false,
-                error: 'Missing required fields: file, file_name, user_address'
-            });
+    async poll() {
+        if (this.polling || !contractService.isContractReady()) {
+            return;
         }
-        
-        // Validate Ethereum address format
-        if (!AuthService.isValidAddress(user_address)) {
-            return res.status(400).json({
-                success: false,
+
+        this.polling = true;
+        try {
+            const batching = BlockchainJobWorker.isBatchingEnabled();
+            if (batching) {
+                await this.runRecordBatch();
+            }
+
+            const jobs = await db.all(`
+                SELECT id FROM blockchain_jobs
+                WHERE status = 'pending' AND next_attempt_at <= datetime('now')
+                  AND (? = 0 OR job_type != 'record_upload')
+                ORDER BY id ASC
+                LIMIT ?
+            `, [batching ? 1 : 0, this.batchSize]);
+
+            for (const job of jobs) {
+                await this.runJob(job.id);
+            }
+        } catch (error) {
+            console.error('❌ Blockchain job poll failed:', error.message);
+        } finally {
+            this.polling = false;
+        }
+    }
+
+    // Upload handlers try their job inline so the response can report the tx hash.
+    // In batch mode the job is left queued for the next batch instead.
+    async runUploadJob(jobId) {
+        if (BlockchainJobWorker.isBatchingEnabled()) {
+            return null;
+        }
+        return this.runJob(jobId);
+    }
+
+    // Flush due record_upload jobs as one transaction once enough are queued or the
+    // oldest has waited recordBatchMaxWaitMs. Every file in the batch shares the tx hash.
+    async runRecordBatch() {
+        const due = await db.get(`
+            SELECT COUNT(*) as count, (julianday('now') - julianday(MIN(created_at))) * 86400000 as waited_ms
+            FROM blockchain_jobs
+            WHERE status = 'pending' AND job_type = 'record_upload' AND next_attempt_at <= datetime('now')
+        `);
+
+        if (due.count === 0 || (due.count < this.recordBatchSize && due.waited_ms < this.recordBatchMaxWaitMs)) {
+            return null;
+        }
+
+        const candidates = await db.all(`
+            SELECT id FROM blockchain_jobs
+            WHERE status = 'pending' AND job_type = 'record_upload' AND next_attempt_at <= datetime('now')
+            ORDER BY id ASC
+            LIMIT ?
+        `, [this.recordBatchSize]);
+
+        const jobs = [];
+        for (const candidate of candidates) {
+            const claim = await db.run(`
+                UPDATE blockchain_jobs
+                SET status = 'processing', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+                WHERE id = ? AND status = 'pending'
+            `, [candidate.id]);
+            if (claim.changes > 0) {
+                jobs.push(await db.get('SELECT * FROM blockchain_jobs WHERE id = ?', [candidate.id]));
+            }
+        }
+
+        if (jobs.length === 0) {
+            return null;
+        }
+
+        let txHash;
+        try {
+            txHash = await contractService.recordFileUploads(jobs.map(job => {
+                const payload = JSON.parse(job.payload || '{}');
+                return {
+                    cid: job.cid,
+                    fileSize: payload.file_size,
+                    isEncrypted: payload.is_encrypted,
+                    metadata: payload.metadata
+                };
+            }));
+        } catch (error) {
+            for (const job of jobs) {
+                await this.handleFailure(job, error);
+            }
+            return null;
+        }
+
+        await withTransaction(async () => {
+            for (const job of jobs) {
+                await db.run(`
+                    UPDATE blockchain_jobs
+                    SET status = 'completed', tx_hash = ?, last_error = NULL, updated_at = CURRENT_TIMESTAMP
+                    WHERE id = ?
+                `, [txHash, job.id]);
+                await db.run(`
+                    UPDATE file_records
+                    SET status = 'confirmed', tx_hash = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+                    WHERE cid = ?
+                `, [txHash, job.cid]);
+            }
+        });
+
+        const cids = jobs.map(job => job.cid);
+        for (const cid of cids) {
+            fileEventBroker.publish(cid, 'status', { status: 'confirmed', tx_hash: txHash });
+        }
+
+        // Reward claiming is best-effort - the user can still claim manually
+        try {
+            const rewardTxHash = await contractService.batchClaimRewards(cids);
+            if (rewardTxHash) {
+                for (const cid of cids) {
+                    await db.run(`
+                        UPDATE file_records SET reward_claimed = 1, reward_tx_hash = ?, version = version + 1
+                        WHERE cid = ?
+                    `, [rewardTxHash, cid]);
+                    fileEventBroker.publish(cid, 'reward_claimed', { tx_hash: rewardTxHash });
+                }
+            }
+        } catch (rewardError) {
+            console.log(`⚠️ Batch reward error: ${rewardError.message}`);
+        }
+
+        return { txHash, count: jobs.length };
+    }
+
+    // Claim a pending job and process it. Returns the job result, or null if the
+    // job was already taken by someone else or could not be completed this time.
+    async runJob(jobId) {
+        if (!contractService.isContractReady()) {
+            return null;
+        }
+
+        const claim = await db.run(`
+            UPDATE blockchain_jobs
+            SET status = 'processing', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+            WHERE id = ? AND status = 'pending'
+        `, [jobId]);
+
+        if (claim.changes === 0) {
+            return null;
+        }
+
+        const job = await db.get('SELECT * FROM blockchain_jobs WHERE id = ?', [jobId]);
+
+        try {
+            const result = await this.processJob(job);
+            await withDbRetry(() => db.run(`
+                UPDATE blockchain_jobs
+                SET status = 'completed', tx_hash = ?, last_error = NULL, updated_at = CURRENT_TIMESTAMP
+                WHERE id = ?
+            `, [result.txHash, job.id]));
+            return result;
+        } catch (error) {
+            await this.handleFailure(job, error);
+            return null;
+        }
+    }
+
+    async processJob(job) {
+        const payload = JSON.parse(job.payload || '{}');
+
+        switch (job.job_type) {
+            case 'record_upload': {
+                // A job reset to pending after a crash may already have been mined;
+                // sending it again would revert, so an existing record counts as done
+                const alreadyRecorded = await contractService.checkFileExists(job.cid);
+                const txHash = alreadyRecorded
+                    ? (await db.get('SELECT tx_hash FROM file_records WHERE cid = ?', [job.cid]))?.tx_hash || null
+                    : await contractService.recordFileUpload(
+                        job.cid,
+                        payload.file_size,
+                        payload.is_encrypted,
+                        payload.metadata,
+                        payload.uploader
+                    );
+
+                if (!txHash && !alreadyRecorded) {
+                    throw new Error('Blockchain recording failed');
+                }
+
+                // The transaction is already mined; don't lose that to a momentary lock
+                await withDbRetry(() => db.run(`
+                    UPDATE file_records
+                    SET status = 'confirmed', tx_hash = COALESCE(?, tx_hash), version = version + 1, updated_at = CURRENT_TIMESTAMP
+                    WHERE cid = ?
+                `, [txHash, job.cid]));
+                fileEventBroker.publish(job.cid, 'status', { status: 'confirmed', tx_hash: txHash });
+
+                // Reward claiming is best-effort - the user can still claim manually
+                let reward = null;
+                try {
+                    reward = await contractService.claimUploadReward(job.cid);
+                    if (reward) {
+                        await db.run(`
+                            UPDATE file_records SET reward_claimed = 1, reward_tx_hash = ?, version = version + 1
+                            WHERE cid = ?
+                        `, [reward.txHash, job.cid]);
+                        fileEventBroker.publish(job.cid, 'reward_claimed', { tx_hash: reward.txHash, amount: reward.amount });
+                    }
+                } catch (rewardError) {
+                    console.log(`⚠️ Auto-reward error: ${rewardError.message}`);
+                }
+
+                return { txHash, reward };
+            }
+            default:
+                throw new Error(`Unknown blockchain job type: ${job.job_type}`);
+        }
+    }
+
+    async handleFailure(job, error) {
+        console.error(`❌ Blockchain job ${job.id} (${job.job_type}) failed:`, error.message);
+
+        if (job.attempts >= this.maxAttempts) {
+            await withDbRetry(() => db.run(`
+                UPDATE blockchain_jobs
+                SET status = 'failed', last_error = ?, updated_at = CURRENT_TIMESTAMP
+                WHERE id = ?
+            `, [error.message, job.id]));
+            // Only a pending record can fail - never move a confirmed one backwards
+            const failed = await withDbRetry(() => db.run(`
+                UPDATE file_records SET status = 'failed', version = version + 1, updated_at = CURRENT_TIMESTAMP
+                WHERE cid = ? AND status = 'pending'
+            `, [job.cid]));
+            if (failed.changes > 0) {
+                fileEventBroker.publish(job.cid, 'status', { status: 'failed', error: error.message });
+            }
+            return;
+        }
+
+        // Exponential backoff: 30s, 60s, 120s, ...
+        const delaySeconds = 30 * Math.pow(2, job.attempts - 1);
+        await withDbRetry(() => db.run(`
+            UPDATE blockchain_jobs
+            SET status = 'pending', last_error = ?,
+                next_attempt_at = datetime('now', '+' || ? || ' seconds'),
+                updated_at = CURRENT_TIMESTAMP
+            WHERE id = ?
+        `, [error.message, delaySeconds, job.id]));
+    }
+}
+
+const blockchainJobWorker = new BlockchainJobWorker();
+
+// Indexes contract events into the database so on-chain state drives record status
+class ChainEventIndexer {
+    static SYNC_KEY = 'events_last_block';
+
+    constructor() {
+        this.unsubscribe = null;
+        this.retryTimer = null;
+        this.processing = false;
+        this.maxAttempts = parseInt(process.env.EVENT_MAX_ATTEMPTS) || 5;
+    }
+
+    async start() {
+        if (this.unsubscribe || !contractService.isContractReady()) return;
+
+        // Reprocess events whose backoff has elapsed, independent of new blocks
+        this.retryTimer = setInterval(() => this.processPending(), parseInt(process.env.EVENT_RETRY_INTERVAL_MS) || 60000);
+
+        const saved = await getSyncState(ChainEventIndexer.SYNC_KEY);
+        let fromBlock;
+        if (saved !== null) {
+            fromBlock = parseInt(saved) + 1;
+        } else if (process.env.EVENT_SYNC_START_BLOCK) {
+            fromBlock = parseInt(process.env.EVENT_SYNC_START_BLOCK);
+        } else {
+            fromBlock = await contractService.provider.getBlockNumber();
+        }
+
+        console.log(`📡 Indexing contract events from block ${fromBlock}`);
+        this.unsubscribe = contractService.subscribeEvents(
+            fromBlock,
+            (events, lastBlock) => this.handleEvents(events, lastBlock),
+            {
+                intervalMs: parseInt(process.env.EVENT_SYNC_INTERVAL_MS) || 15000,
+                maxRange: parseInt(process.env.EVENT_SYNC_BLOCK_RANGE) || 2000
+            }
+        );
+    }
+
+    stop() {
+        if (this.unsubscribe) {
+            this.unsubscribe();
+            this.unsubscribe = null;
+        }
+        if (this.retryTimer) {
+            clearInterval(this.retryTimer);
+            this.retryTimer = null;
+        }
+    }
+
+    // Persist new events to chain_events and advance the sync marker together, then
+    // apply them. A failing event is retried with backoff by the reprocessor and
+    // dead-lettered after EVENT_MAX_ATTEMPTS instead of blocking later blocks.
+    async handleEvents(events, lastBlock) {
+        const ordered = [...events].sort((a, b) => a.blockNumber - b.blockNumber || a.logIndex - b.logIndex);
+
+        await withTransaction(async () => {
+            for (const event of ordered) {
+                // Rescanned ranges redeliver logs - the event id keeps each one unique
+                await db.run(`
+                    INSERT OR IGNORE INTO chain_events
+                    (event_id, event_name, block_number, log_index, tx_hash, payload, status)
+                    VALUES (?, ?, ?, ?, ?, ?, 'pending')
+                `, [
+                    `${event.txHash}:${event.logIndex}`,
+                    event.name,
+                    event.blockNumber,
+                    event.logIndex,
+                    event.txHash,
+                    JSON.stringify(event.args.toObject(), (key, value) => typeof value === 'bigint' ? value.toString() : value)
+                ]);
+            }
+            await setSyncState(ChainEventIndexer.SYNC_KEY, lastBlock);
+        });
+
+        if (events.length > 0) {
+            console.log(`📡 Indexed ${events.length} contract events up to block ${lastBlock}`);
+        }
+
+        await this.processPending();
+    }
+
+    // Apply pending events in chain order
+    async processPending() {
+        if (this.processing) return;
+        this.processing = true;
+
+        try {
+            const pending = await db.all(`
+                SELECT * FROM chain_events
+                WHERE status = 'pending' AND next_attempt_at <= datetime('now')
+                ORDER BY block_number ASC, log_index ASC
+                LIMIT 500
+            `);
+
+            for (const row of pending) {
+                await this.processEvent(row);
+            }
+        } catch (error) {
+            console.error('❌ Event processing failed:', error.message);
+        } finally {
+            this.processing = false;
+        }
+    }
+
+    // Handlers queue subscriber notifications, which are only published once the
+    // transaction has committed
+    async processEvent(row) {
+        const event = { name: row.event_name, txHash: row.tx_hash, args: JSON.parse(row.payload) };
+        const notifications = [];
+        const notify = (cid, type, data) => notifications.push([cid, type, data]);
+
+        try {
+            await withTransaction(async () => {
+                // A retried transaction starts over, so do its notifications
+                notifications.length = 0;
+                switch (event.name) {
+                    case 'FileUploaded':
+                        await this.onFileUploaded(event, notify);
+                        break;
+                    case 'RewardClaimed':
+                        await this.onRewardClaimed(event, notify);
+                        break;
+                    case 'AccessGranted':
+                        await this.onAccessGranted(event, notify);
+                        break;
+                }
+
+                await db.run(`
+                    UPDATE chain_events
+                    SET status = 'processed', attempts = attempts + 1, last_error = NULL, processed_at = CURRENT_TIMESTAMP
+                    WHERE event_id = ?
+                `, [row.event_id]);
+            });
+
+            notifications.forEach(([cid, type, data]) => fileEventBroker.publish(cid, type, data));
+        } catch (error) {
+            const attempts = row.attempts + 1;
+            const deadLetter = attempts >= this.maxAttempts;
+            console.error(`❌ Failed to apply ${row.event_name} ${row.event_id} (attempt ${attempts}):`, error.message);
+
+            await db.run(`
+                UPDATE chain_events
+                SET status = ?, attempts = ?, last_error = ?,
+                    next_attempt_at = datetime('now', '+' || ? || ' seconds')
+                WHERE event_id = ?
+            `, [deadLetter ? 'dead_letter' : 'pending', attempts, error.message, 30 * Math.pow(2, attempts - 1), row.event_id]);
+        }
+    }
+
+    async onFileUploaded(event, notify) {
+        const cidHash = event.args.cid;
+        const fileRecord = await db.get('SELECT cid, status FROM file_records WHERE cid_hash = ?', [cidHash]);
+
+        await db.run(`
+            UPDATE file_records
+            SET status = 'confirmed', tx_hash = COALESCE(tx_hash, ?), version = version + 1, updated_at = CURRENT_TIMESTAMP
+            WHERE cid_hash = ?
+        `, [event.txHash, cidHash]);
+
+        // The upload is on-chain, so any outstanding recording job is done
+        await db.run(`
+            UPDATE blockchain_jobs
+            SET status = 'completed', tx_hash = COALESCE(tx_hash, ?), updated_at = CURRENT_TIMESTAMP
+            WHERE job_type = 'record_upload' AND status IN ('pending', 'failed')
+            AND cid IN (SELECT cid FROM file_records WHERE cid_hash = ?)
+        `, [event.txHash, cidHash]);
+
+        if (fileRecord && fileRecord.status !== 'confirmed') {
+            notify(fileRecord.cid, 'status', { status: 'confirmed', tx_hash: event.txHash });
+        }
+    }
+
+    async onRewardClaimed(event, notify) {
+        const fileRecord = await db.get('SELECT cid, reward_claimed FROM file_records WHERE cid_hash = ?', [event.args.cid]);
+
+        await db.run(`
+            UPDATE file_records
+            SET reward_claimed = 1, reward_tx_hash = COALESCE(reward_tx_hash, ?), version = version + 1, updated_at = CURRENT_TIMESTAMP
+            WHERE cid_hash = ?
+        `, [event.txHash, event.args.cid]);
+
+        if (fileRecord && !fileRecord.reward_claimed) {
+            notify(fileRecord.cid, 'reward_claimed', { tx_hash: event.txHash });
+        }
+    }
+
+    async onAccessGranted(event, notify) {
+        const fileRecord = await db.get('SELECT * FROM file_records WHERE cid_hash = ?', [event.args.cid]);
+        if (!fileRecord) return;
+
+        const grantee = event.args.grantee;
+        // The contract uses uint256 max for permanent grants
+        const expiresAt = BigInt(event.args.expiresAt) === ethers.MaxUint256 ?
+            new Date('2099-12-31').toISOString() :
+            new Date(Number(event.args.expiresAt) * 1000).toISOString();
+
+        const existing = await db.get(`
+            SELECT id FROM access_grants
+            WHERE cid = ? AND LOWER(grantee_addr) = LOWER(?) AND is_active = 1
+        `, [fileRecord.cid, grantee]);
+
+        if (existing) {
+            await db.run('UPDATE access_grants SET expires_at = ?, expiry_notified_at = NULL WHERE id = ?', [expiresAt, existing.id]);
+        } else {
+            await db.run(`
+                INSERT INTO access_grants (cid, granter_addr, grantee_addr, expires_at, is_active)
+                VALUES (?, ?, ?, ?, 1)
+            `, [fileRecord.cid, fileRecord.uploader_addr, grantee, expiresAt]);
+        }
+
+        notify(fileRecord.cid, 'access_granted', { grantee: grantee.toLowerCase(), expires_at: expiresAt });
+    }
+}
+
+const chainEventIndexer = new ChainEventIndexer();
+
+// Periodically repairs file records stuck in 'pending': records with a tx hash are
+// settled from the chain receipt, records without one are checked on-chain and
+// re-enqueued for recording if no job is still working on them.
+class FileStatusReconciler {
+    constructor() {
+        this.timer = null;
+        this.running = false;
+        this.intervalMs = parseInt(process.env.RECONCILE_INTERVAL_MS) || 5 * 60 * 1000;
+        this.staleMinutes = parseInt(process.env.RECONCILE_STALE_MINUTES) || 15;
+        this.batchSize = parseInt(process.env.RECONCILE_BATCH_SIZE) || 50;
+    }
+
+    start() {
+        if (this.timer) return;
+        console.log(`🩺 Reconciling pending uploads older than ${this.staleMinutes}m every ${this.intervalMs}ms`);
+        this.timer = setInterval(() => this.run(), this.intervalMs);
+    }
+
+    stop() {
+        if (this.timer) {
+            clearInterval(this.timer);
+            this.timer = null;
+        }
+    }
+
+    async run() {
+        if (this.running || !contractService.isContractReady()) return;
+        this.running = true;
+
+        try {
+            const stale = await db.all(`
+                SELECT * FROM file_records
+                WHERE status = 'pending' AND deleted_at IS NULL
+                AND created_at <= datetime('now', '-' || ? || ' minutes')
+                ORDER BY created_at ASC, id ASC
+                LIMIT ?
+            `, [this.staleMinutes, this.batchSize]);
+
+            for (const fileRecord of stale) {
+                try {
+                    await this.reconcile(fileRecord);
+                } catch (error) {
+                    console.error(`❌ Reconcile failed for ${fileRecord.cid}:`, error.message);
+                }
+            }
+        } catch (error) {
+            console.error('❌ Reconcile run failed:', error.message);
+        } finally {
+            this.running = false;
+        }
+    }
+
+    async reconcile(fileRecord) {
+        if (fileRecord.tx_hash) {
+            const receipt = await contractService.getTransactionStatus(fileRecord.tx_hash);
+
+            // No provider to ask; try again on the next pass
+            if (!receipt) {
+                return;
+            }
+            if (receipt.status === 'confirmed' || receipt.status === 'failed') {
+                await this.settle(fileRecord, receipt.status, fileRecord.tx_hash);
+                return;
+            }
+            if (receipt.status === 'pending') {
+                return;
+            }
+            // not_found: the transaction was dropped, so fall through and record again
+            console.log(`🩺 Transaction ${fileRecord.tx_hash} for ${fileRecord.cid} was dropped`);
+        }
+
+        // Recorded on-chain but the confirmation never reached the database
+        if (await contractService.checkFileExists(fileRecord.cid)) {
+            await this.settle(fileRecord, 'confirmed', fileRecord.tx_hash);
+            return;
+        }
+
+        const activeJob = await db.get(`
+            SELECT id FROM blockchain_jobs
+            WHERE cid = ? AND job_type = 'record_upload' AND status IN ('pending', 'processing')
+        `, [fileRecord.cid]);
+        if (activeJob) return;
+
+        const jobId = await BlockchainJobWorker.enqueue(fileRecord.cid, 'record_upload', {
+            file_size: fileRecord.file_size,
+            is_encrypted: !!fileRecord.is_encrypted,
+            metadata: JSON.parse(fileRecord.metadata || '{}'),
+            uploader: fileRecord.uploader_addr
+        });
+        console.log(`🩺 Re-enqueued blockchain recording for ${fileRecord.cid} (job ${jobId})`);
+    }
+
+    // Only moves records out of 'pending', so it cannot undo a concurrent confirmation
+    async settle(fileRecord, status, txHash) {
+        const result = await db.run(`
+            UPDATE file_records SET status = ?, tx_hash = COALESCE(?, tx_hash), version = version + 1, updated_at = CURRENT_TIMESTAMP
+            WHERE id = ? AND status = 'pending'
+        `, [status, txHash, fileRecord.id]);
+
+        if (result.changes > 0) {
+            console.log(`🩺 Reconciled ${fileRecord.cid}: pending → ${status}`);
+            fileEventBroker.publish(fileRecord.cid, 'status', { status, tx_hash: txHash });
+        }
+    }
+}
+
+const fileStatusReconciler = new FileStatusReconciler();
+
+// Periodically checks that stored content is still retrievable from the gateway,
+// least recently checked first. A record is marked 'unavailable' only after several
+// consecutive misses (a single gateway hiccup is not data loss) and goes back to
+// 'confirmed' as soon as its content is found again.
+class StorageAvailabilityChecker {
+    constructor() {
+        this.timer = null;
+        this.running = false;
+        this.intervalMs = parseInt(process.env.AVAILABILITY_CHECK_INTERVAL_MS) || 60 * 60 * 1000;
+        this.batchSize = parseInt(process.env.AVAILABILITY_CHECK_BATCH_SIZE) || 100;
+        this.failureThreshold = parseInt(process.env.AVAILABILITY_FAILURE_THRESHOLD) || 3;
+        this.stats = { runs: 0, checked: 0, available: 0, missing: 0, errors: 0, last_run_at: null };
+    }
+
+    static isEnabled() {
+        return process.env.AVAILABILITY_CHECK_ENABLED !== 'false';
+    }
+
+    start() {
+        if (this.timer) return;
+        console.log(`📡 Checking storage availability of ${this.batchSize} files every ${this.intervalMs}ms`);
+        this.timer = setInterval(() => this.run(), this.intervalMs);
+    }
+
+    stop() {
+        if (this.timer) {
+            clearInterval(this.timer);
+            this.timer = null;
+        }
+    }
+
+    async run() {
+        if (this.running || !StorageService.isConfigured()) return;
+        this.running = true;
+
+        try {
+            const records = await db.all(`
+                SELECT id, cid, status, availability_failures, storage_provider FROM file_records
+                WHERE status IN ('confirmed', 'unavailable') AND deleted_at IS NULL
+                ORDER BY last_availability_check IS NOT NULL, last_availability_check ASC, id ASC
+                LIMIT ?
+            `, [this.batchSize]);
+
+            for (const fileRecord of records) {
+                await this.check(fileRecord);
+            }
+
+            this.stats.runs++;
+            this.stats.last_run_at = new Date().toISOString();
+        } catch (error) {
+            console.error('❌ Availability check run failed:', error.message);
+        } finally {
+            this.running = false;
+        }
+    }
+
+    async check(fileRecord) {
+        const available = await StorageService.isAvailable(fileRecord.cid, { provider: fileRecord.storage_provider });
+        this.stats.checked++;
+
+        // Gateway errors and timeouts say nothing about the content itself
+        if (available === null) {
+            this.stats.errors++;
+            await db.run('UPDATE file_records SET last_availability_check = CURRENT_TIMESTAMP WHERE id = ?', [fileRecord.id]);
+            return;
+        }
+
+        if (available) {
+            this.stats.available++;
+            await db.run(`
+                UPDATE file_records SET availability_failures = 0, last_availability_check = CURRENT_TIMESTAMP,
+                    status = CASE WHEN status = 'unavailable' THEN 'confirmed' ELSE status END
+                WHERE id = ?
+            `, [fileRecord.id]);
+            if (fileRecord.status === 'unavailable') {
+                console.log(`📡 ${fileRecord.cid} is retrievable again`);
+                fileEventBroker.publish(fileRecord.cid, 'status', { status: 'confirmed' });
+            }
+            return;
+        }
+
+        this.stats.missing++;
+        const failures = fileRecord.availability_failures + 1;
+        const becameUnavailable = fileRecord.status === 'confirmed' && failures >= this.failureThreshold;
+
+        await db.run(`
+            UPDATE file_records SET availability_failures = ?, last_availability_check = CURRENT_TIMESTAMP,
+                status = CASE WHEN ? THEN 'unavailable' ELSE status END
+            WHERE id = ?
+        `, [failures, becameUnavailable ? 1 : 0, fileRecord.id]);
+
+        if (becameUnavailable) {
+            console.log(`🚨 ${fileRecord.cid} is no longer retrievable from storage`);
+            fileEventBroker.publish(fileRecord.cid, 'status', { status: 'unavailable' });
+        }
+    }
+
+    async getMetrics() {
+        const counts = await db.all(`
+            SELECT status, COUNT(*) as count FROM file_records
+            WHERE status IN ('confirmed', 'unavailable')
+            GROUP BY status
+        `);
+        const byStatus = Object.fromEntries(counts.map(row => [row.status, row.count]));
+        const total = (byStatus.confirmed || 0) + (byStatus.unavailable || 0);
+
+        return {
+            confirmed_files: byStatus.confirmed || 0,
+            unavailable_files: byStatus.unavailable || 0,
+            availability_ratio: total > 0 ? (byStatus.confirmed || 0) / total : null,
+            failure_threshold: this.failureThreshold,
+            ...this.stats
+        };
+    }
+}
+
+const storageAvailabilityChecker = new StorageAvailabilityChecker();
+
+// Warns before time-limited access runs out. Active grants expiring within
+// GRANT_EXPIRY_WARNING_HOURS get one 'grant_expiring' event on the file's event
+// stream and, when GRANT_EXPIRY_WEBHOOK_URL is set, a webhook POST (signed with
+// GRANT_EXPIRY_WEBHOOK_SECRET in X-PrivyChain-Signature). A grant is marked notified
+// once delivered, so a failed webhook is retried on the next run.
+class GrantExpiryNotifier {
+    constructor() {
+        this.timer = null;
+        this.running = false;
+        this.intervalMs = parseInt(process.env.GRANT_EXPIRY_CHECK_INTERVAL_MS) || 15 * 60 * 1000;
+        this.windowMs = (parseFloat(process.env.GRANT_EXPIRY_WARNING_HOURS) || 24) * 60 * 60 * 1000;
+        this.webhookUrl = process.env.GRANT_EXPIRY_WEBHOOK_URL || null;
+        this.webhookSecret = process.env.GRANT_EXPIRY_WEBHOOK_SECRET || null;
+    }
+
+    static isEnabled() {
+        return process.env.GRANT_EXPIRY_NOTIFICATIONS_ENABLED !== 'false';
+    }
+
+    start() {
+        if (this.timer) return;
+        console.log(`⏰ Warning about grants expiring within ${this.windowMs / 3600000}h`);
+        this.timer = setInterval(() => this.run(), this.intervalMs);
+        this.run();
+    }
+
+    stop() {
+        if (this.timer) {
+            clearInterval(this.timer);
+            this.timer = null;
+        }
+    }
+
+    async run() {
+        if (this.running) return;
+        this.running = true;
+
+        try {
+            const now = new Date();
+            const grants = await db.all(`
+                SELECT id, app_id, cid, granter_addr, grantee_addr, group_id, expires_at FROM access_grants
+                WHERE is_active = 1 AND expiry_notified_at IS NULL
+                AND expires_at > ? AND expires_at <= ?
+            `, [now.toISOString(), new Date(now.getTime() + this.windowMs).toISOString()]);
+
+            for (const grant of grants) {
+                await this.notify(grant);
+            }
+        } catch (error) {
+            console.error('❌ Grant expiry check failed:', error.message);
+        } finally {
+            this.running = false;
+        }
+    }
+
+    async notify(grant) {
+        const event = {
+            grant_id: grant.id,
+            app_id: grant.app_id,
+            cid: grant.cid,
+            granter: grant.granter_addr,
+            grantee: grant.grantee_addr || null,
+            group_id: grant.group_id,
+            expires_at: grant.expires_at
+        };
+
+        if (this.webhookUrl) {
+            try {
+                await this.deliver(event);
+            } catch (error) {
+                console.log(`⚠️ Grant expiry webhook failed for grant ${grant.id}:`, error.message);
+                return;
+            }
+        }
+
+        fileEventBroker.publish(grant.cid, 'grant_expiring', event);
+        await db.run('UPDATE access_grants SET expiry_notified_at = CURRENT_TIMESTAMP WHERE id = ?', [grant.id]);
+    }
+
+    async deliver(event) {
+        const body = JSON.stringify({ type: 'grant.expiring', data: event, sent_at: new Date().toISOString() });
+        const headers = { 'Content-Type': 'application/json' };
+        if (this.webhookSecret) {
+            headers['X-PrivyChain-Signature'] = crypto.createHmac('sha256', this.webhookSecret).update(body).digest('hex');
+        }
+
+        const response = await fetch(this.webhookUrl, {
+            method: 'POST',
+            headers,
+            body,
+            signal: AbortSignal.timeout(10000)
+        });
+        if (!response.ok) {
+            throw new Error(`Webhook responded ${response.status}`);
+        }
+    }
+}
+
+const grantExpiryNotifier = new GrantExpiryNotifier();
+
+// Database backups: snapshots via VACUUM INTO into BACKUP_DIR, every
+// BACKUP_INTERVAL_HOURS when BACKUP_SCHEDULE_ENABLED=true. With BACKUP_ENCRYPTION_KEY
+// (32-byte hex) each backup is also encrypted and uploaded to storage - never in the
+// clear, since IPFS content is public. Backups older than BACKUP_RETENTION_DAYS are
+// deleted locally and, where the client supports it, removed from storage.
+const BACKUP_DIR = process.env.BACKUP_DIR || './backups';
+
+class BackupScheduler {
+    constructor() {
+        this.timer = null;
+        this.running = false;
+        this.intervalMs = (parseFloat(process.env.BACKUP_INTERVAL_HOURS) || 24) * 60 * 60 * 1000;
+        this.retentionDays = parseInt(process.env.BACKUP_RETENTION_DAYS) || 7;
+        this.lastRun = null;
+        this.lastError = null;
+    }
+
+    static isEnabled() {
+        return process.env.BACKUP_SCHEDULE_ENABLED === 'true';
+    }
+
+    start() {
+        if (this.timer) return;
+        console.log(`💾 Backing up the database every ${this.intervalMs / 3600000}h, keeping ${this.retentionDays} days`);
+        this.timer = setInterval(() => this.run(), this.intervalMs);
+    }
+
+    stop() {
+        if (this.timer) {
+            clearInterval(this.timer);
+            this.timer = null;
+        }
+    }
+
+    async run() {
+        if (this.running) return;
+        this.running = true;
+
+        try {
+            await this.createBackup('scheduled');
+            await this.prune();
+            this.lastError = null;
+        } catch (error) {
+            this.lastError = error.message;
+            console.error('❌ Scheduled backup failed:', error.message);
+        } finally {
+            this.lastRun = new Date().toISOString();
+            this.running = false;
+        }
+    }
+
+    async createBackup(trigger) {
+        await fs.mkdir(BACKUP_DIR, { recursive: true });
+        const timestamp = new Date().toISOString().replace(/[:.]/g, '-');
+        const backupPath = path.join(BACKUP_DIR, `privychain-backup-${timestamp}.db`);
+
+        await db.run('VACUUM INTO ?', [backupPath]);
+        const data = await fs.readFile(backupPath);
+        const sha256 = crypto.createHash('sha256').update(data).digest('hex');
+
+        let storageCid = null;
+        const encryptionKey = process.env.BACKUP_ENCRYPTION_KEY;
+        if (encryptionKey && StorageService.isConfigured()) {
+            try {
+                const encrypted = EncryptionService.encrypt(data, Buffer.from(encryptionKey, 'hex'), 'chacha20-poly1305');
+                storageCid = await StorageService.upload(encrypted, `${path.basename(backupPath)}.enc`, 'application/octet-stream');
+            } catch (error) {
+                console.error('⚠️ Backup upload to storage failed, kept locally:', error.message);
+            }
+        }
+
+        const result = await db.run(`
+            INSERT INTO database_backups (path, size_bytes, sha256, storage_cid, trigger)
+            VALUES (?, ?, ?, ?, ?)
+        `, [backupPath, data.length, sha256, storageCid, trigger]);
+
+        console.log(`💾 Database backed up to ${backupPath}${storageCid ? ` and ${storageCid}` : ''}`);
+        return db.get('SELECT * FROM database_backups WHERE id = ?', [result.lastID]);
+    }
+
+    async prune() {
+        const expired = await db.all(`
+            SELECT * FROM database_backups
+            WHERE pruned_at IS NULL AND created_at <= datetime('now', '-' || ? || ' days')
+        `, [this.retentionDays]);
+
+        for (const backup of expired) {
+            await fs.rm(backup.path, { force: true });
+            const storage = StorageService.current();
+            if (backup.storage_cid && typeof storage?.remove === 'function') {
+                try {
+                    await storage.remove(backup.storage_cid, { shards: true });
+                } catch (error) {
+                    console.log(`⚠️ Could not remove backup ${backup.storage_cid} from storage:`, error.message);
+                }
+            }
+            await db.run('UPDATE database_backups SET pruned_at = CURRENT_TIMESTAMP WHERE id = ?', [backup.id]);
+        }
+
+        if (expired.length > 0) {
+            console.log(`🧹 Pruned ${expired.length} backups older than ${this.retentionDays} days`);
+        }
+    }
+
+    getStatus() {
+        return {
+            enabled: !!this.timer,
+            interval_hours: this.intervalMs / 3600000,
+            retention_days: this.retentionDays,
+            uploads_to_storage: !!process.env.BACKUP_ENCRYPTION_KEY,
+            last_run_at: this.lastRun,
+            last_error: this.lastError
+        };
+    }
+}
+
+const backupScheduler = new BackupScheduler();
+
+// Initialize database
+async function initializeDatabase() {
+    console.log('📊 Initializing database...');
+    
+    const dbPath = process.env.DATABASE_PATH || './privychain.db';
+    
+    db = await open({
+        filename: dbPath,
+        driver: sqlite3.Database
+    });
+    instrumentDatabase(db);
+    serializeWrites(db);
+
+    // Optional read replica (e.g. a Litestream/LiteFS copy), opened read-only
+    if (process.env.DATABASE_REPLICA_PATH) {
+        replicaDb = await open({
+            filename: process.env.DATABASE_REPLICA_PATH,
+            driver: sqlite3.Database,
+            mode: sqlite3.OPEN_READONLY
+        });
+        instrumentDatabase(replicaDb);
+        console.log(`📚 Read replica: ${process.env.DATABASE_REPLICA_PATH}`);
+    }
+
+    // Schema steps, applied in order by runMigrations. Never edit or reorder a step
+    // once released - its checksum is recorded and startup fails if it changes; add a
+    // new step instead. Every step is also safe to run against a database that
+    // predates schema_migrations, which records them all on its first start.
+    await runMigrations([
+        { name: 'create_base_tables', sql: `
+            CREATE TABLE IF NOT EXISTS file_records (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                cid TEXT UNIQUE NOT NULL,
+                uploader_addr TEXT NOT NULL,
+                file_size INTEGER NOT NULL,
+                is_encrypted BOOLEAN NOT NULL DEFAULT 0,
+                file_name TEXT NOT NULL,
+                content_type TEXT,
+                metadata TEXT,
+                tx_hash TEXT,
+                status TEXT DEFAULT 'pending',
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            CREATE TABLE IF NOT EXISTS access_grants (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                cid TEXT NOT NULL,
+                granter_addr TEXT NOT NULL,
+                grantee_addr TEXT NOT NULL,
+                expires_at DATETIME,
+                is_active BOOLEAN DEFAULT 1,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            -- key_material is a symmetric file key in its key store's wrapped form. It is
+            -- secret and must never be returned by the API.
+            CREATE TABLE IF NOT EXISTS encryption_keys (
+                app_id TEXT NOT NULL DEFAULT 'default',
+                user_address TEXT NOT NULL,
+                key_material TEXT NOT NULL,
+                key_id TEXT NOT NULL,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                PRIMARY KEY (app_id, user_address)
+            );
+
+            -- Outbox for on-chain recording, written in the same transaction as the file record
+            CREATE TABLE IF NOT EXISTS blockchain_jobs (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                cid TEXT NOT NULL,
+                job_type TEXT NOT NULL,
+                payload TEXT,
+                status TEXT NOT NULL DEFAULT 'pending',
+                attempts INTEGER NOT NULL DEFAULT 0,
+                last_error TEXT,
+                tx_hash TEXT,
+                next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            CREATE INDEX IF NOT EXISTS idx_blockchain_jobs_status ON blockchain_jobs(status, next_attempt_at);
+
+            CREATE TABLE IF NOT EXISTS user_roles (
+                user_address TEXT PRIMARY KEY,
+                role TEXT NOT NULL DEFAULT 'user',
+                assigned_by TEXT,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            -- Cached responses for requests carrying an Idempotency-Key header
+            CREATE TABLE IF NOT EXISTS idempotency_keys (
+                idempotency_key TEXT NOT NULL,
+                endpoint TEXT NOT NULL,
+                request_hash TEXT NOT NULL,
+                status TEXT NOT NULL DEFAULT 'processing',
+                status_code INTEGER,
+                response_body TEXT,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                expires_at DATETIME NOT NULL,
+                PRIMARY KEY (idempotency_key, endpoint)
+            );
+
+            -- Every contract event the indexer has seen, keyed by tx hash + log index,
+            -- with its processing state (pending / processed / dead_letter)
+            CREATE TABLE IF NOT EXISTS chain_events (
+                event_id TEXT PRIMARY KEY,
+                event_name TEXT NOT NULL,
+                block_number INTEGER NOT NULL,
+                log_index INTEGER NOT NULL,
+                tx_hash TEXT NOT NULL,
+                payload TEXT NOT NULL,
+                status TEXT NOT NULL DEFAULT 'pending',
+                attempts INTEGER NOT NULL DEFAULT 0,
+                last_error TEXT,
+                next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                processed_at DATETIME
+            );
+
+            CREATE INDEX IF NOT EXISTS idx_chain_events_status ON chain_events(status, block_number, log_index);
+
+            -- Named sets of addresses that can be granted access together
+            CREATE TABLE IF NOT EXISTS access_groups (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                name TEXT NOT NULL,
+                owner_addr TEXT NOT NULL,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                UNIQUE(owner_addr, name)
+            );
+
+            CREATE TABLE IF NOT EXISTS access_group_members (
+                group_id INTEGER NOT NULL REFERENCES access_groups(id),
+                member_addr TEXT NOT NULL,
+                added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                PRIMARY KEY (group_id, member_addr)
+            );
+
+            CREATE INDEX IF NOT EXISTS idx_access_group_members_addr ON access_group_members(member_addr);
+
+            -- Wallet-less download links. The token's HMAC binds id, CID, expiry and password.
+            CREATE TABLE IF NOT EXISTS share_links (
+                id TEXT PRIMARY KEY,
+                app_id TEXT NOT NULL DEFAULT 'default',
+                cid TEXT NOT NULL,
+                created_by TEXT NOT NULL,
+                expires_at TEXT NOT NULL,
+                password_hash TEXT,
+                max_downloads INTEGER,
+                downloads_used INTEGER NOT NULL DEFAULT 0,
+                failed_attempts INTEGER NOT NULL DEFAULT 0,
+                locked_until TEXT,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            -- Resumable uploads: chunks are appended to a file under UPLOAD_SESSION_DIR
+            -- and received_bytes is the next offset the client must send
+            CREATE TABLE IF NOT EXISTS upload_sessions (
+                id TEXT PRIMARY KEY,
+                app_id TEXT NOT NULL DEFAULT 'default',
+                user_address TEXT NOT NULL,
+                options TEXT NOT NULL,
+                total_size INTEGER NOT NULL,
+                received_bytes INTEGER NOT NULL DEFAULT 0,
+                status TEXT NOT NULL DEFAULT 'open',
+                expires_at TEXT NOT NULL,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            -- Database backups, local path plus optional encrypted copy in storage
+            CREATE TABLE IF NOT EXISTS database_backups (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                path TEXT NOT NULL,
+                size_bytes INTEGER NOT NULL,
+                sha256 TEXT NOT NULL,
+                storage_cid TEXT,
+                trigger TEXT NOT NULL,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                pruned_at DATETIME
+            );
+
+            -- Files inside a directory upload; access is controlled by the parent record
+            CREATE TABLE IF NOT EXISTS file_entries (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                parent_cid TEXT NOT NULL REFERENCES file_records(cid),
+                path TEXT NOT NULL,
+                file_size INTEGER NOT NULL,
+                content_type TEXT,
+                UNIQUE (parent_cid, path)
+            );
+
+            -- Append-only record of access-control decisions
+            CREATE TABLE IF NOT EXISTS access_log (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                cid TEXT NOT NULL,
+                actor TEXT,
+                action TEXT NOT NULL,
+                decision TEXT NOT NULL,
+                reason TEXT,
+                created_at TEXT NOT NULL
+            );
+
+            CREATE INDEX IF NOT EXISTS idx_access_log_created ON access_log(created_at, id);
+            CREATE INDEX IF NOT EXISTS idx_access_log_cid ON access_log(cid, created_at);
+
+            CREATE TRIGGER IF NOT EXISTS access_log_no_update BEFORE UPDATE ON access_log
+            BEGIN
+                SELECT RAISE(ABORT, 'access_log is append-only');
+            END;
+
+            CREATE TRIGGER IF NOT EXISTS access_log_no_delete BEFORE DELETE ON access_log
+            BEGIN
+                SELECT RAISE(ABORT, 'access_log is append-only');
+            END;
+
+            -- Check values for wallet-derived keys. The key itself is never stored.
+            CREATE TABLE IF NOT EXISTS wallet_key_checks (
+                user_address TEXT PRIMARY KEY,
+                key_check TEXT NOT NULL,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            -- Key/value progress markers for background processes (e.g. last indexed block)
+            CREATE TABLE IF NOT EXISTS sync_state (
+                key TEXT PRIMARY KEY,
+                value TEXT,
+                updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            -- Signed proof-of-upload, issued once the upload is confirmed on-chain.
+            -- receipt is the exact canonical JSON that was signed.
+            CREATE TABLE IF NOT EXISTS upload_receipts (
+                cid TEXT PRIMARY KEY,
+                receipt TEXT NOT NULL,
+                signature TEXT NOT NULL,
+                signer TEXT NOT NULL,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+
+            -- Requests to export a user's server-side key, wrapped under public_key.
+            -- status: pending -> approved (by an admin) -> completed, or rejected
+            CREATE TABLE IF NOT EXISTS key_export_requests (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                app_id TEXT NOT NULL,
+                user_address TEXT NOT NULL,
+                public_key TEXT NOT NULL,
+                status TEXT NOT NULL DEFAULT 'pending',
+                decided_by TEXT,
+                decided_at DATETIME,
+                completed_at DATETIME,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+            );
+        ` },
+        // Columns added after the initial schema
+        { name: 'add_file_records_cid_hash', column: ['file_records', 'cid_hash', 'TEXT'] },
+        { name: 'add_file_records_reward_claimed', column: ['file_records', 'reward_claimed', 'BOOLEAN NOT NULL DEFAULT 0'] },
+        { name: 'add_file_records_reward_tx_hash', column: ['file_records', 'reward_tx_hash', 'TEXT'] },
+        { name: 'add_file_records_content_hash', column: ['file_records', 'content_hash', 'TEXT'] },
+        { name: 'add_file_records_version', column: ['file_records', 'version', 'INTEGER NOT NULL DEFAULT 1'] },
+        { name: 'add_file_records_encryption_algorithm', column: ['file_records', 'encryption_algorithm', 'TEXT'] },
+        { name: 'add_file_records_encryption_mode', column: ['file_records', 'encryption_mode', "TEXT NOT NULL DEFAULT 'none'"] },
+        { name: 'add_file_records_wrapped_key', column: ['file_records', 'wrapped_key', 'TEXT'] },
+        { name: 'add_file_records_metadata_signature', column: ['file_records', 'metadata_signature', 'TEXT'] },
+        { name: 'add_file_records_metadata_signer', column: ['file_records', 'metadata_signer', 'TEXT'] },
+        { name: 'add_file_records_metadata_signed_at', column: ['file_records', 'metadata_signed_at', 'TEXT'] },
+        { name: 'add_file_records_metadata_cid', column: ['file_records', 'metadata_cid', 'TEXT'] },
+        { name: 'add_file_records_is_directory', column: ['file_records', 'is_directory', 'BOOLEAN NOT NULL DEFAULT 0'] },
+        { name: 'add_file_records_availability_failures', column: ['file_records', 'availability_failures', 'INTEGER NOT NULL DEFAULT 0'] },
+        { name: 'add_file_records_last_availability_check', column: ['file_records', 'last_availability_check', 'DATETIME'] },
+        // Wallet mode: each file's random data key, wrapped under a key derived from the
+        // owner's wallet key and file_key_salt. Grants carry a key-store-wrapped copy.
+        { name: 'add_file_records_file_key_salt', column: ['file_records', 'file_key_salt', 'TEXT'] },
+        { name: 'add_file_records_owner_wrapped_file_key', column: ['file_records', 'owner_wrapped_file_key', 'TEXT'] },
+        { name: 'add_access_grants_wrapped_file_key', column: ['access_grants', 'wrapped_file_key', 'TEXT'] },
+        { name: 'add_access_grants_file_key_wrapping', column: ['access_grants', 'file_key_wrapping', 'TEXT'] },
+        // Owner retries of a failed or unavailable upload (POST /files/:cid/retry)
+        { name: 'add_file_records_retry_count', column: ['file_records', 'retry_count', 'INTEGER NOT NULL DEFAULT 0'] },
+        // Provider the content was uploaded to (see STORAGE_PROVIDER_RULES); NULL means the default
+        { name: 'add_file_records_storage_provider', column: ['file_records', 'storage_provider', 'TEXT'] },
+        // Soft-deleted files keep their row (the CID stays reserved) but are hidden everywhere
+        { name: 'add_file_records_deleted_at', column: ['file_records', 'deleted_at', 'DATETIME'] },
+        // Set to the file's deleted_at when a soft delete deactivates the grant, so a
+        // restore reactivates exactly those and leaves revoked grants alone
+        { name: 'add_access_grants_deactivated_at', column: ['access_grants', 'deactivated_at', 'DATETIME'] },
+        { name: 'add_share_links_failed_attempts', column: ['share_links', 'failed_attempts', 'INTEGER NOT NULL DEFAULT 0'] },
+        { name: 'add_share_links_locked_until', column: ['share_links', 'locked_until', 'TEXT'] },
+        { name: 'add_access_grants_permissions', column: ['access_grants', 'permissions', "TEXT NOT NULL DEFAULT 'read'"] },
+        { name: 'add_access_grants_max_downloads', column: ['access_grants', 'max_downloads', 'INTEGER'] },
+        { name: 'add_access_grants_downloads_used', column: ['access_grants', 'downloads_used', 'INTEGER NOT NULL DEFAULT 0'] },
+        // Group grants carry group_id and an empty grantee_addr
+        { name: 'add_access_grants_group_id', column: ['access_grants', 'group_id', 'INTEGER'] },
+        { name: 'add_access_grants_expiry_notified_at', column: ['access_grants', 'expiry_notified_at', 'DATETIME'] },
+        // Public files are downloadable without authentication
+        { name: 'add_file_records_visibility', column: ['file_records', 'visibility', "TEXT NOT NULL DEFAULT 'private'"] },
+        { name: 'create_idx_access_grants_group', sql: 'CREATE INDEX IF NOT EXISTS idx_access_grants_group ON access_grants(group_id)' },
+        // Tenant (Privy app) scoping; rows from before multi-tenancy belong to the default app
+        { name: 'add_file_records_app_id', column: ['file_records', 'app_id', `TEXT NOT NULL DEFAULT '${DEFAULT_APP_ID}'`] },
+        { name: 'add_access_grants_app_id', column: ['access_grants', 'app_id', `TEXT NOT NULL DEFAULT '${DEFAULT_APP_ID}'`] },
+        { name: 'migrate_encryption_keys_to_tenants', run: migrateEncryptionKeysToTenants },
+        // The symmetric key used to live in a column misleadingly named public_key
+        { name: 'rename_encryption_keys_public_key', run: renameLegacyKeyColumn },
+        { name: 'add_encryption_keys_key_wrapping', column: ['encryption_keys', 'key_wrapping', "TEXT NOT NULL DEFAULT 'plain'"] },
+        { name: 'create_idx_file_records_app_uploader', sql: 'CREATE INDEX IF NOT EXISTS idx_file_records_app_uploader ON file_records(app_id, uploader_addr)' },
+        { name: 'create_idx_access_grants_app_cid', sql: 'CREATE INDEX IF NOT EXISTS idx_access_grants_app_cid ON access_grants(app_id, cid)' },
+        { name: 'create_idx_file_records_cid_hash', sql: 'CREATE INDEX IF NOT EXISTS idx_file_records_cid_hash ON file_records(cid_hash)' },
+        { name: 'create_idx_file_records_content_hash', sql: 'CREATE INDEX IF NOT EXISTS idx_file_records_content_hash ON file_records(uploader_addr, content_hash)' },
+        // Metadata is queried with json_extract, so legacy rows become objects: values stored
+        // as a JSON-encoded string are unwrapped, and anything else that is not an object is
+        // kept under "value" rather than discarded
+        { name: 'normalize_file_records_metadata', sql: `
+            UPDATE file_records SET metadata = json_extract(metadata, '$')
+            WHERE CASE WHEN NOT json_valid(metadata) THEN 0
+                WHEN json_type(metadata) = 'text' THEN json_valid(json_extract(metadata, '$'))
+                ELSE 0 END;
+            UPDATE file_records SET metadata = '{}' WHERE metadata IS NULL;
+            UPDATE file_records SET metadata = CASE
+                WHEN json_valid(metadata) THEN json_object('value', json(metadata))
+                ELSE json_object('value', metadata)
+            END
+            WHERE CASE WHEN json_valid(metadata) THEN json_type(metadata) != 'object' ELSE 1 END;
+        ` }
+    ]);
+
+    // Everything encrypted before algorithm selection existed used AES-GCM
+    await db.run(`
+        UPDATE file_records SET encryption_algorithm = 'aes-256-gcm'
+        WHERE is_encrypted = 1 AND encryption_algorithm IS NULL
+    `);
+    await db.run(`
+        UPDATE file_records SET encryption_mode = 'server'
+        WHERE is_encrypted = 1 AND encryption_mode = 'none'
+    `);
+
+    // Backfill the on-chain CID key used to match contract events
+    const unhashed = await db.all('SELECT id, cid FROM file_records WHERE cid_hash IS NULL');
+    for (const row of unhashed) {
+        await db.run('UPDATE file_records SET cid_hash = ? WHERE id = ?', [contractService.cidToBytes32(row.cid), row.id]);
+    }
+
+    // Bootstrap admins so roles can be managed through the API
+    const adminAddresses = (process.env.ADMIN_ADDRESSES || '')
+        .split(',').map(a => a.trim().toLowerCase()).filter(Boolean);
+    for (const address of adminAddresses) {
+        await db.run(`
+            INSERT INTO user_roles (user_address, role, assigned_by) VALUES (?, 'admin', 'config')
+            ON CONFLICT(user_address) DO NOTHING
+        `, [address]);
+    }
+
+    // Keys written before a key store was configured are still plain hex
+    if (keyStore.name !== 'plain') {
+        const plainKeys = await db.all("SELECT app_id, user_address, key_material FROM encryption_keys WHERE key_wrapping = 'plain'");
+        for (const row of plainKeys) {
+            await db.run(
+                "UPDATE encryption_keys SET key_material = ?, key_wrapping = ? WHERE app_id = ? AND user_address = ? AND key_wrapping = 'plain'",
+                [await keyStore.wrap(Buffer.from(row.key_material, 'hex')), keyStore.name, row.app_id, row.user_address]
+            );
+        }
+        if (plainKeys.length > 0) {
+            console.log(`🔐 Wrapped ${plainKeys.length} plaintext encryption keys with the ${keyStore.name} key store`);
+        }
+    }
+
+    // Jobs left in "processing" were interrupted by a restart - hand them back to the worker
+    await db.run(`UPDATE blockchain_jobs SET status = 'pending' WHERE status = 'processing'`);
+
+    console.log('✅ Database initialized');
+}
+
+// encryption_keys used to be keyed by user_address alone. A user now has one key per
+// app, which needs a composite primary key, so legacy tables are rebuilt and their
+// keys moved to the default app.
+async function migrateEncryptionKeysToTenants() {
+    const columns = await db.all('PRAGMA table_info(encryption_keys)');
+    if (columns.some(c => c.name === 'app_id')) {
+        return;
+    }
+
+    await withTransaction(async () => {
+        await db.exec('ALTER TABLE encryption_keys RENAME TO encryption_keys_legacy');
+        await db.exec(`
+            CREATE TABLE encryption_keys (
+                app_id TEXT NOT NULL DEFAULT 'default',
+                user_address TEXT NOT NULL,
+                key_material TEXT NOT NULL,
+                key_id TEXT NOT NULL,
+                created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+                PRIMARY KEY (app_id, user_address)
+            )
+        `);
+        await db.run(`
+            INSERT INTO encryption_keys (app_id, user_address, key_material, key_id, created_at)
+            SELECT ?, user_address, public_key, key_id, created_at FROM encryption_keys_legacy
+        `, [DEFAULT_APP_ID]);
+        await db.exec('DROP TABLE encryption_keys_legacy');
+    });
+    console.log('🛠️ Migrated encryption_keys to per-app keys');
+}
+
+async function renameLegacyKeyColumn() {
+    const columns = await db.all('PRAGMA table_info(encryption_keys)');
+    if (columns.some(c => c.name === 'public_key')) {
+        await db.exec('ALTER TABLE encryption_keys RENAME COLUMN public_key TO key_material');
+        console.log('🛠️ Renamed encryption_keys.public_key to key_material');
+    }
+}
+
+// Query counters for /health and /metrics. Every get/all/run/exec on the shared
+// connection is timed; anything over DB_SLOW_QUERY_MS is counted and logged.
+const DB_SLOW_QUERY_MS = parseInt(process.env.DB_SLOW_QUERY_MS) || 200;
+const dbMetrics = {
+    totalQueries: 0,
+    failedQueries: 0,
+    slowQueries: 0,
+    totalDurationMs: 0,
+    maxDurationMs: 0,
+    pendingTransactions: 0,
+    maxPendingTransactions: 0,
+    maxTransactionWaitMs: 0,
+    saturationEvents: 0
+};
+
+function instrumentDatabase(database) {
+    for (const method of ['get', 'all', 'run', 'exec']) {
+        const original = database[method].bind(database);
+        database[method] = async (sql, ...params) => {
+            const started = process.hrtime.bigint();
+            try {
+                return await original(sql, ...params);
+            } catch (error) {
+                dbMetrics.failedQueries++;
+                throw error;
+            } finally {
+                const durationMs = Number(process.hrtime.bigint() - started) / 1e6;
+                dbMetrics.totalQueries++;
+                dbMetrics.totalDurationMs += durationMs;
+                dbMetrics.maxDurationMs = Math.max(dbMetrics.maxDurationMs, durationMs);
+                if (durationMs > DB_SLOW_QUERY_MS) {
+                    dbMetrics.slowQueries++;
+                    console.log(`🐢 Slow query (${durationMs.toFixed(1)}ms): ${String(sql).replace(/\s+/g, ' ').trim().substring(0, 200)}`);
+                }
+            }
+        };
+    }
+}
+
+// Connection for read-only handlers: the replica when one is configured, unless the
+// request needs to see its own writes (forcePrimary, or X-Read-Consistency: primary)
+function readDb(req) {
+    if (!replicaDb || req?.forcePrimary || req?.headers['x-read-consistency'] === 'primary') {
+        return db;
+    }
+    return replicaDb;
+}
+
+// Route-level read-after-write guard for handlers that would otherwise use readDb
+function forcePrimary(req, res, next) {
+    req.forcePrimary = true;
+    next();
+}
+
+function getDatabaseMetrics() {
+    return {
+        total_queries: dbMetrics.totalQueries,
+        failed_queries: dbMetrics.failedQueries,
+        slow_queries: dbMetrics.slowQueries,
+        slow_query_threshold_ms: DB_SLOW_QUERY_MS,
+        average_query_ms: dbMetrics.totalQueries > 0
+            ? Number((dbMetrics.totalDurationMs / dbMetrics.totalQueries).toFixed(3))
+            : 0,
+        max_query_ms: Number(dbMetrics.maxDurationMs.toFixed(3)),
+        pending_transactions: dbMetrics.pendingTransactions,
+        max_pending_transactions: dbMetrics.maxPendingTransactions,
+        max_transaction_wait_ms: dbMetrics.maxTransactionWaitMs,
+        saturation_events: dbMetrics.saturationEvents,
+        saturation_thresholds: {
+            pending_transactions: DB_TX_QUEUE_WARN_DEPTH,
+            transaction_wait_ms: DB_TX_WAIT_WARN_MS
+        }
+    };
+}
+
+// SQLite has no "ADD COLUMN IF NOT EXISTS", so check the table definition first
+async function addColumnIfMissing(table, column, definition) {
+    const columns = await db.all(`PRAGMA table_info(${table})`);
+    if (!columns.some(c => c.name === column)) {
+        await db.exec(`ALTER TABLE ${table} ADD COLUMN ${column} ${definition}`);
+        console.log(`🛠️ Added column ${table}.${column}`);
+    }
+}
+
+// A step is { name } plus one of sql, column ([table, column, definition]) or run (a
+// function; its source is what gets checksummed). Whitespace doesn't affect the checksum.
+function migrationChecksum(migration) {
+    const body = migration.sql ?? (migration.column ? migration.column.join(' ') : migration.run.toString());
+    return crypto.createHash('sha256').update(body.replace(/\s+/g, ' ').trim()).digest('hex');
+}
+
+// Apply the steps not yet in schema_migrations, in order, and verify the ones that are
+async function runMigrations(migrations) {
+    await db.exec(`
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            name TEXT PRIMARY KEY,
+            checksum TEXT NOT NULL,
+            applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+        )
+    `);
+    const applied = new Map(
+        (await db.all('SELECT name, checksum FROM schema_migrations')).map(row => [row.name, row.checksum])
+    );
+
+    for (const migration of migrations) {
+        const checksum = migrationChecksum(migration);
+        if (applied.has(migration.name)) {
+            if (applied.get(migration.name) !== checksum) {
+                throw new Error(`Migration ${migration.name} changed after it was applied ` +
+                    `(checksum ${applied.get(migration.name)}, now ${checksum}); add a new migration instead of editing it`);
+            }
+            continue;
+        }
+
+        if (migration.sql) {
+            await db.exec(migration.sql);
+        } else if (migration.column) {
+            await addColumnIfMissing(...migration.column);
+        } else {
+            await migration.run();
+        }
+        await db.run('INSERT INTO schema_migrations (name, checksum) VALUES (?, ?)', [migration.name, checksum]);
+    }
+}
+
+// Development fixtures, run with `node server.js seed [--demo]`. Every insert is an
+// upsert, so seeding twice leaves the same rows. Demo data is never written when
+// NODE_ENV=production.
+const DEMO_OWNER_ADDRESS = '0x00000000000000000000000000000000000d3e00';
+const DEMO_MEMBER_ADDRESS = '0x00000000000000000000000000000000000d3e01';
+const DEMO_FILES = [
+    { name: 'welcome.txt', type: 'text/plain', content: 'Welcome to PrivyChain', metadata: { project: 'demo' } },
+    { name: 'report.json', type: 'application/json', content: '{"quarter":"Q1","files":3}', metadata: { project: 'demo', tags: { kind: 'report' } } },
+    { name: 'notes.md', type: 'text/markdown', content: '# Demo notes', metadata: { project: 'demo' } }
+];
+
+async function seedData({ demo = false } = {}) {
+    const admin = process.env.SEED_ADMIN_ADDRESS;
+    if (admin) {
+        if (!ethers.isAddress(admin)) {
+            throw new Error('SEED_ADMIN_ADDRESS must be a valid address');
+        }
+        await db.run(`
+            INSERT INTO user_roles (user_address, role, assigned_by) VALUES (?, 'admin', 'seed')
+            ON CONFLICT(user_address) DO UPDATE SET role = 'admin', updated_at = CURRENT_TIMESTAMP
+        `, [admin.toLowerCase()]);
+        console.log(`🌱 Seeded admin role for ${admin.toLowerCase()}`);
+    }
+
+    if (!demo) return;
+    if (isProduction()) {
+        throw new Error('Refusing to seed demo data with NODE_ENV=production');
+    }
+
+    await withTransaction(async () => {
+        for (const file of DEMO_FILES) {
+            const content = Buffer.from(file.content);
+            const cid = rawContentCid(content);
+            await db.run(`
+                INSERT INTO file_records
+                (app_id, cid, cid_hash, content_hash, uploader_addr, file_size, is_encrypted, file_name, content_type, metadata, status)
+                VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?, 'confirmed')
+                ON CONFLICT(cid) DO UPDATE SET
+                    file_name = excluded.file_name,
+                    content_type = excluded.content_type,
+                    metadata = excluded.metadata,
+                    updated_at = CURRENT_TIMESTAMP
+            `, [
+                DEFAULT_APP_ID,
+                cid,
+                contractService.cidToBytes32(cid),
+                crypto.createHash('sha256').update(content).digest('hex'),
+                DEMO_OWNER_ADDRESS,
+                content.length,
+                file.name,
+                file.type,
+                JSON.stringify(file.metadata)
+            ]);
+        }
+
+        await db.run(`
+            INSERT INTO access_groups (name, owner_addr) VALUES ('demo-team', ?)
+            ON CONFLICT(owner_addr, name) DO NOTHING
+        `, [DEMO_OWNER_ADDRESS]);
+        const group = await db.get(
+            "SELECT id FROM access_groups WHERE owner_addr = ? AND name = 'demo-team'",
+            [DEMO_OWNER_ADDRESS]
+        );
+        await db.run(`
+            INSERT INTO access_group_members (group_id, member_addr) VALUES (?, ?)
+            ON CONFLICT(group_id, member_addr) DO NOTHING
+        `, [group.id, DEMO_MEMBER_ADDRESS]);
+
+        const sharedCid = rawContentCid(Buffer.from(DEMO_FILES[0].content));
+        const grant = await db.get(
+            'SELECT id FROM access_grants WHERE cid = ? AND grantee_addr = ? AND app_id = ?',
+            [sharedCid, DEMO_MEMBER_ADDRESS, DEFAULT_APP_ID]
+        );
+        if (!grant) {
+            await db.run(`
+                INSERT INTO access_grants (app_id, cid, granter_addr, grantee_addr, expires_at)
+                VALUES (?, ?, ?, ?, '2099-12-31T00:00:00.000Z')
+            `, [DEFAULT_APP_ID, sharedCid, DEMO_OWNER_ADDRESS, DEMO_MEMBER_ADDRESS]);
+        }
+    });
+
+    console.log(`🌱 Seeded demo data owned by ${DEMO_OWNER_ADDRESS}`);
+}
+
+// CIDv1 (raw codec, sha2-256) for content, base32-encoded the way IPFS prints it
+function rawContentCid(content) {
+    const bytes = Buffer.concat([
+        Buffer.from([0x01, 0x55, 0x12, 0x20]),
+        crypto.createHash('sha256').update(content).digest()
+    ]);
+    const alphabet = 'abcdefghijklmnopqrstuvwxyz234567';
+    let bits = 0;
+    let value = 0;
+    let encoded = 'b';
+    for (const byte of bytes) {
+        value = (value << 8) | byte;
+        bits += 8;
+        while (bits >= 5) {
+            encoded += alphabet[(value >>> (bits - 5)) & 31];
+            bits -= 5;
+        }
+        value &= (1 << bits) - 1;
+    }
+    if (bits > 0) {
+        encoded += alphabet[(value << (5 - bits)) & 31];
+    }
+    return encoded;
+}
+
+async function getSyncState(key) {
+    const row = await db.get('SELECT value FROM sync_state WHERE key = ?', [key]);
+    return row ? row.value : null;
+}
+
+async function setSyncState(key, value) {
+    await db.run(`
+        INSERT INTO sync_state (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+        ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = CURRENT_TIMESTAMP
+    `, [key, String(value)]);
+}
+
+// A lock held by another connection or process (a backup, the CLI, a replica sync)
+// surfaces as SQLITE_BUSY/SQLITE_LOCKED and clears on its own, so those are retried
+// with exponential backoff. Constraint violations and other errors are not.
+const DB_RETRY_ATTEMPTS = parseInt(process.env.DB_RETRY_ATTEMPTS) || 3;
+const DB_RETRY_BASE_DELAY_MS = parseInt(process.env.DB_RETRY_BASE_DELAY_MS) || 50;
+const TRANSIENT_DB_ERRORS = ['SQLITE_BUSY', 'SQLITE_LOCKED'];
+
+async function withDbRetry(work, maxAttempts = DB_RETRY_ATTEMPTS) {
+    for (let attempt = 1; ; attempt++) {
+        try {
+            return await work();
+        } catch (error) {
+            if (attempt >= maxAttempts || !TRANSIENT_DB_ERRORS.includes(error.code)) {
+                throw error;
+            }
+            const delay = DB_RETRY_BASE_DELAY_MS * Math.pow(2, attempt - 1);
+            console.log(`⚠️ Database busy (${error.code}), retrying in ${delay}ms (attempt ${attempt}/${maxAttempts})`);
+            await new Promise(resolve => setTimeout(resolve, delay));
+        }
+    }
+}
+
+// Serialize transactions - every request shares the single SQLite connection.
+// A transaction that hits a transient lock is rolled back and run again whole,
+// so work must only touch the database.
+let transactionQueue = Promise.resolve();
+const transactionContext = new AsyncLocalStorage();
+
+// On a shared connection a write from another request issued between BEGIN and
+// COMMIT becomes part of that transaction (and is lost if it rolls back), so while
+// transactions are pending, writes from outside one wait their turn in the queue.
+function serializeWrites(database) {
+    for (const method of ['run', 'exec']) {
+        const original = database[method].bind(database);
+        database[method] = (...args) => {
+            if (dbMetrics.pendingTransactions === 0 || transactionContext.getStore()) {
+                return original(...args);
+            }
+            const write = transactionQueue.then(() => original(...args));
+            transactionQueue = write.catch(() => {});
+            return write;
+        };
+    }
+}
+
+// Early warning before the queue backs up far enough to stall requests: too many
+// transactions pending, or one waiting too long to start. Each breach is counted; the
+// warning log and onDatabaseSaturation listeners fire at most once per interval.
+const DB_TX_QUEUE_WARN_DEPTH = parseInt(process.env.DB_TX_QUEUE_WARN_DEPTH) || 20;
+const DB_TX_WAIT_WARN_MS = parseInt(process.env.DB_TX_WAIT_WARN_MS) || 1000;
+const DB_SATURATION_WARN_INTERVAL_MS = parseInt(process.env.DB_SATURATION_WARN_INTERVAL_MS) || 60 * 1000;
+const databaseSaturationListeners = [];
+let lastSaturationWarningAt = 0;
+
+function onDatabaseSaturation(listener) {
+    databaseSaturationListeners.push(listener);
+}
+
+function reportDatabaseSaturation(reason, waitMs) {
+    dbMetrics.saturationEvents++;
+
+    const now = Date.now();
+    if (now - lastSaturationWarningAt < DB_SATURATION_WARN_INTERVAL_MS) return;
+    lastSaturationWarningAt = now;
+
+    const event = {
+        level: 'warn',
+        event: 'db_saturation',
+        reason,
+        pending_transactions: dbMetrics.pendingTransactions,
+        pending_threshold: DB_TX_QUEUE_WARN_DEPTH,
+        wait_ms: waitMs,
+        wait_threshold_ms: DB_TX_WAIT_WARN_MS
+    };
+    console.log(`⚠️ ${JSON.stringify(event)}`);
+
+    for (const listener of databaseSaturationListeners) {
+        try {
+            listener(event);
+        } catch (error) {
+            console.error('Database saturation listener error:', error);
+        }
+    }
+}
+
+function withTransaction(work) {
+    const queuedAt = Date.now();
+    dbMetrics.pendingTransactions++;
+    dbMetrics.maxPendingTransactions = Math.max(dbMetrics.maxPendingTransactions, dbMetrics.pendingTransactions);
+    if (dbMetrics.pendingTransactions >= DB_TX_QUEUE_WARN_DEPTH) {
+        reportDatabaseSaturation('pending_transactions');
+    }
+
+    const run = transactionQueue.then(() => {
+        const waitMs = Date.now() - queuedAt;
+        dbMetrics.maxTransactionWaitMs = Math.max(dbMetrics.maxTransactionWaitMs, waitMs);
+        if (waitMs >= DB_TX_WAIT_WARN_MS) {
+            reportDatabaseSaturation('transaction_wait', waitMs);
+        }
+
+        return transactionContext.run({ queuedAt }, () => withDbRetry(async () => {
+            await db.run('BEGIN');
+            try {
+                const result = await work();
+                await db.run('COMMIT');
+                return result;
+            } catch (error) {
+                // Report what failed, not a rollback error on top of it
+                await db.run('ROLLBACK').catch(() => {});
+                throw error;
+            }
+        }));
+    }).finally(() => {
+        dbMetrics.pendingTransactions--;
+    });
+    transactionQueue = run.catch(() => {});
+    return run;
+}
+
+// Initialize Web3.Storage w3up client
+async function initializeW3up() {
+    console.log('🔧 Initializing Web3.Storage w3up client...');
+    
+    try {
+        w3upClient = await create();
+        
+        // Check if already logged in
+        const accounts = w3upClient.accounts();
+        if (Object.keys(accounts).length === 0) {
+            console.log('⚠️  No w3up account found.');
+            
+            if (process.env.WEB3_STORAGE_TOKEN) {
+                console.log('💡 Found WEB3_STORAGE_TOKEN in your config.');
+                console.log('💡 This JS backend uses w3up client instead of the legacy token.');
+                console.log('💡 Your existing w3up configuration should work automatically.');
+            }
+            console.log('💡 If needed, run: npm run setup');
+            w3upClient = null;
+            return false;
+        }
+        
+        // Check current space
+        const currentSpace = w3upClient.currentSpace();
+        if (!currentSpace) {
+            const spaces = Object.values(w3upClient.spaces());
+            if (spaces.length > 0) {
+                await w3upClient.setCurrentSpace(spaces[0].did());
+                console.log(`✅ Using existing space: ${spaces[0].did()}`);
+            } else {
+                console.log('⚠️  No current space set. Run: npm run setup');
+                w3upClient = null;
+                return false;
+            }
+        } else {
+            console.log(`✅ Using space: ${currentSpace.did()}`);
+        }
+        
+        console.log('✅ w3up client ready!');
+        return true;
+    } catch (error) {
+        console.error('❌ Failed to initialize w3up:', error.message);
+        console.log('💡 Run: npm run setup if you need to reconfigure');
+        w3upClient = null;
+        return false;
+    }
+}
+
+// STORAGE_PROVIDER selects where files go: w3up (Web3.Storage, the default) or
+// memory, which keeps them in process for local development and tests.
+const STORAGE_PROVIDERS = ['w3up', 'memory'];
+
+// STORAGE_PROVIDER_RULES sends some users' uploads elsewhere, by address or by role:
+// {"users": {"0xabc...": "memory"}, "roles": {"admin": "w3up"}}. A user rule beats a
+// role rule and anyone unmatched gets STORAGE_PROVIDER. Each file records the
+// provider it was uploaded to, and is read back from it.
+function parseStorageProviderRules(raw) {
+    const rules = { users: {}, roles: {} };
+    if (!raw) {
+        return { value: rules };
+    }
+
+    let parsed;
+    try {
+        parsed = JSON.parse(raw);
+    } catch (error) {
+        return { error: 'STORAGE_PROVIDER_RULES must be valid JSON' };
+    }
+    if (typeof parsed !== 'object' || parsed === null || Array.isArray(parsed) ||
+        Object.keys(parsed).some(key => !(key in rules))) {
+        return { error: 'STORAGE_PROVIDER_RULES must be an object with "users" and/or "roles"' };
+    }
+
+    for (const kind of Object.keys(rules)) {
+        const entries = parsed[kind] ?? {};
+        if (typeof entries !== 'object' || entries === null || Array.isArray(entries)) {
+            return { error: `STORAGE_PROVIDER_RULES.${kind} must be an object` };
+        }
+        for (const [key, provider] of Object.entries(entries)) {
+            if (!STORAGE_PROVIDERS.includes(provider)) {
+                return { error: `STORAGE_PROVIDER_RULES.${kind}.${key} must be one of ${STORAGE_PROVIDERS.join(', ')}` };
+            }
+            if (kind === 'users' && !ethers.isAddress(key)) {
+                return { error: `STORAGE_PROVIDER_RULES.users has an invalid address: ${key}` };
+            }
+            rules[kind][kind === 'users' ? key.toLowerCase() : key] = provider;
+        }
+    }
+    return { value: rules };
+}
+
+const storageProviderRules = parseStorageProviderRules(process.env.STORAGE_PROVIDER_RULES);
+
+function routedStorageProviders() {
+    const rules = storageProviderRules.value;
+    return rules ? [...new Set([...Object.values(rules.users), ...Object.values(rules.roles)])] : [];
+}
+
+async function initializeStorage() {
+    const memoryOptions = { latencyMs: parseInt(process.env.STORAGE_MEMORY_LATENCY_MS) || 0 };
+    let ready;
+    if (process.env.STORAGE_PROVIDER === 'memory') {
+        StorageService.useProvider(new MemoryStorageProvider(memoryOptions));
+        console.log('🧪 Using in-memory storage - uploads are lost on restart');
+        ready = true;
+    } else {
+        ready = await initializeW3up();
+    }
+
+    // Providers that only some users are routed to
+    for (const name of routedStorageProviders()) {
+        if (name === StorageService.defaultName() || StorageService.isConfigured(name)) continue;
+        if (name === 'memory') {
+            StorageService.registerProvider(new MemoryStorageProvider(memoryOptions));
+            console.log('🧪 In-memory storage enabled for routed uploads - they are lost on restart');
+        } else if (name === 'w3up') {
+            await initializeW3up();
+        }
+    }
+    return ready;
+}
+
+// Storage access (uploads go through the w3up client, reads through the gateway)
+// Metadata sidecars: a small JSON manifest stored next to each public upload so the
+// file name, content type and tags survive on the storage side, not only in our database
+const STORAGE_METADATA_SIDECAR = process.env.STORAGE_METADATA_SIDECAR !== 'false';
+
+// Per-operation storage budgets. Uploads get minutes (large files), retrievals a
+// minute, health probes seconds. Callers may also pass options.signal (e.g. the
+// request's) so a disconnected client cancels the storage call.
+const STORAGE_TIMEOUTS_MS = {
+    upload: parseInt(process.env.STORAGE_UPLOAD_TIMEOUT_MS) || 10 * 60 * 1000,
+    retrieve: parseInt(process.env.STORAGE_RETRIEVE_TIMEOUT_MS) || 60 * 1000,
+    health: parseInt(process.env.STORAGE_HEALTH_TIMEOUT_MS) || 5 * 1000
+};
+
+// IPFS gateways for reads, in order of preference (STORAGE_GATEWAYS, comma-separated
+// base URLs). Reads go to the first; if it has not answered within
+// STORAGE_GATEWAY_TIMEOUT_MS, or fails, the rest are tried concurrently.
+const DEFAULT_STORAGE_GATEWAY = 'https://w3s.link';
+const STORAGE_GATEWAY_TIMEOUT_MS = parseInt(process.env.STORAGE_GATEWAY_TIMEOUT_MS) || 10 * 1000;
+
+function parseGatewayList(raw) {
+    if (!raw) {
+        return { value: [DEFAULT_STORAGE_GATEWAY] };
+    }
+
+    const gateways = [];
+    for (const entry of raw.split(',').map(e => e.trim()).filter(Boolean)) {
+        let url;
+        try {
+            url = new URL(entry);
+        } catch (error) {
+            return { error: `STORAGE_GATEWAYS has an invalid URL: ${entry}` };
+        }
+        if (url.protocol !== 'https:' && url.protocol !== 'http:') {
+            return { error: `STORAGE_GATEWAYS entries must be http(s) URLs: ${entry}` };
+        }
+        gateways.push(url.origin + url.pathname.replace(/\/+$/, ''));
+    }
+    if (gateways.length === 0) {
+        return { error: 'STORAGE_GATEWAYS must list at least one gateway' };
+    }
+    return { value: [...new Set(gateways)] };
+}
+
+const storageGateways = parseGatewayList(process.env.STORAGE_GATEWAYS);
+
+// Outbound HTTP for gateway reads and identity lookups. Node's fetch already keeps a
+// keep-alive connection pool per origin; this adds retries for idempotent requests
+// (GET/HEAD) on network errors and 502/503/504, with exponential backoff. An aborted
+// signal (timeout or client disconnect) stops retrying immediately.
+const HTTP_RETRY_ATTEMPTS = parseInt(process.env.HTTP_RETRY_ATTEMPTS) || 3;
+const HTTP_RETRY_BASE_DELAY_MS = parseInt(process.env.HTTP_RETRY_BASE_DELAY_MS) || 200;
+const RETRYABLE_HTTP_STATUSES = [502, 503, 504];
+
+async function httpFetch(url, init = {}) {
+    const method = (init.method || 'GET').toUpperCase();
+    const attempts = method === 'GET' || method === 'HEAD' ? HTTP_RETRY_ATTEMPTS : 1;
+
+    for (let attempt = 1; ; attempt++) {
+        try {
+            const response = await fetch(url, init);
+            if (attempt >= attempts || !RETRYABLE_HTTP_STATUSES.includes(response.status)) {
+                return response;
+            }
+            await response.body?.cancel();
+        } catch (error) {
+            if (attempt >= attempts || init.signal?.aborted) throw error;
+        }
+
+        await new Promise(resolve => setTimeout(resolve, HTTP_RETRY_BASE_DELAY_MS * Math.pow(2, attempt - 1)));
+        if (init.signal?.aborted) {
+            throw init.signal.reason;
+        }
+    }
+}
+
+// w3upClient stays null unless it has an account and a space, so this is the one
+// place "no storage" is reported from
+const STORAGE_NOT_CONFIGURED = 'Storage is not configured: no w3up account or space is set up. Run npm run setup.';
+
+// Outages count against the storage breaker; client cancellations, missing
+// configuration and gateway 4xx answers do not
+function isStorageFailure(error) {
+    if (error.code === 'CANCELLED' || error.code === 'STORAGE_NOT_CONFIGURED') return false;
+    return !(error.status >= 400 && error.status < 500);
+}
+
+// In-process stand-in for the w3up client, for local development and tests that
+// must not touch the network. Content is addressed by raw CIDs (CAR uploads by their
+// root) and is lost on restart. latencyMs delays every call; failWith, when set,
+// is thrown by every call to simulate an outage.
+class MemoryStorageProvider {
+    constructor({ latencyMs = 0, failWith = null } = {}) {
+        this.name = 'memory';
+        this.latencyMs = latencyMs;
+        this.failWith = failWith;
+        this.blobs = new Map();
+    }
+
+    async simulate(signal) {
+        if (this.latencyMs > 0) {
+            await new Promise(resolve => setTimeout(resolve, this.latencyMs));
+        }
+        if (signal?.aborted) throw signal.reason;
+        if (this.failWith) throw this.failWith;
+    }
+
+    async uploadFile(file, { signal } = {}) {
+        await this.simulate(signal);
+        const data = Buffer.from(await file.arrayBuffer());
+        const cid = rawContentCid(data);
+        this.blobs.set(cid, data);
+        return cid;
+    }
+
+    // The directory's CID addresses its listing of path -> file CID
+    async uploadDirectory(files, { signal } = {}) {
+        await this.simulate(signal);
+        const listing = {};
+        for (const file of files) {
+            const data = Buffer.from(await file.arrayBuffer());
+            listing[file.name] = rawContentCid(data);
+            this.blobs.set(listing[file.name], data);
+        }
+        const data = Buffer.from(canonicalJson(listing));
+        const cid = rawContentCid(data);
+        this.blobs.set(cid, data);
+        return cid;
+    }
+
+    async uploadCAR(blob, { signal } = {}) {
+        await this.simulate(signal);
+        const data = Buffer.from(await blob.arrayBuffer());
+        const [root] = await StorageService.getCarRoots(data);
+        this.blobs.set(root, data);
+        return root;
+    }
+
+    async retrieve(cid, { signal } = {}) {
+        await this.simulate(signal);
+        return this.blobs.get(String(cid)) || null;
+    }
+
+    async remove(cid) {
+        this.blobs.delete(String(cid));
+    }
+}
+
+class StorageService {
+    // Injected provider (see MemoryStorageProvider); replaces the w3up client for
+    // uploads and, through its retrieve(), the gateway for reads
+    static provider = null;
+    // Non-default providers STORAGE_PROVIDER_RULES routes uploads to, by name
+    static providers = new Map();
+
+    static useProvider(provider) {
+        this.provider = provider;
+    }
+
+    static registerProvider(provider) {
+        this.providers.set(provider.name, provider);
+    }
+
+    static defaultName() {
+        return this.provider?.name || 'w3up';
+    }
+
+    // The named provider; no name (e.g. a file record from before routing) means the default
+    static current(name = null) {
+        if (!name || name === this.defaultName()) {
+            return this.provider || w3upClient;
+        }
+        return name === 'w3up' ? w3upClient : this.providers.get(name) || null;
+    }
+
+    static isConfigured(name = null) {
+        return !!this.current(name);
+    }
+
+    // The provider userAddress's uploads go to: their user rule, else their role's
+    // rule, else the default
+    static async resolveProvider(userAddress) {
+        const rules = storageProviderRules.value;
+        const userRule = rules?.users[userAddress.toLowerCase()];
+        if (userRule) {
+            return userRule;
+        }
+        if (rules && Object.keys(rules.roles).length > 0) {
+            const roleRule = rules.roles[await getUserRole(userAddress)];
+            if (roleRule) {
+                return roleRule;
+            }
+        }
+        return this.defaultName();
+    }
+
+    // Provider that serves reads itself, or null when reads go through the gateway
+    static readProvider(name = null) {
+        const provider = this.current(name);
+        return provider && provider !== w3upClient ? provider : null;
+    }
+
+    static getGatewayUrl(cid, gateway = storageGateways.value?.[0] || DEFAULT_STORAGE_GATEWAY) {
+        return `${gateway}/ipfs/${cid}`;
+    }
+
+    // GET cid from the preferred gateway, falling back to the others concurrently once
+    // it is slow or fails. Resolves { response, gateway } with the first ok response
+    // and aborts the rest; if every gateway fails, rejects with the preferred one's
+    // error (e.g. its 404). label names the read in log lines and errors.
+    static fetchFromGateways(cid, init, signal, label) {
+        const gateways = storageGateways.value || [DEFAULT_STORAGE_GATEWAY];
+        const controllers = new Map();
+        let pending = 0;
+        let settled = false;
+        let fallbackStarted = gateways.length === 1;
+        let preferredError = null;
+        let timer = null;
+
+        return new Promise((resolve, reject) => {
+            const fail = (error) => {
+                settled = true;
+                clearTimeout(timer);
+                reject(error);
+            };
+
+            const startFallbacks = () => {
+                if (fallbackStarted || settled) return;
+                fallbackStarted = true;
+                clearTimeout(timer);
+                console.log(`🐌 Gateway ${gateways[0]} is slow or failing for ${cid}, trying ${gateways.length - 1} fallback(s)`);
+                gateways.slice(1).forEach(launch);
+            };
+
+            const launch = (gateway) => {
+                const controller = new AbortController();
+                controllers.set(gateway, controller);
+                signal?.addEventListener('abort', () => controller.abort(signal.reason), { once: true });
+                pending++;
+
+                httpFetch(this.getGatewayUrl(cid, gateway), { ...init, signal: controller.signal }).then(async (response) => {
+                    if (!response.ok) {
+                        await response.body?.cancel();
+                        console.log(`❌ IPFS ${label} failed at ${gateway}: ${response.status}`);
+                        const error = new Error(`Failed to retrieve ${label}: ${response.status}`);
+                        error.status = response.status;
+                        throw error;
+                    }
+                    if (settled) {
+                        await response.body?.cancel();
+                        return;
+                    }
+                    settled = true;
+                    clearTimeout(timer);
+                    for (const [other, otherController] of controllers) {
+                        if (other !== gateway) otherController.abort(new Error('Superseded by a faster gateway'));
+                    }
+                    resolve({ response, gateway });
+                }).catch((error) => {
+                    pending--;
+                    if (gateway === gateways[0] || !preferredError) preferredError = error;
+                    if (settled) return;
+                    if (!fallbackStarted) {
+                        startFallbacks();
+                    } else if (pending === 0) {
+                        fail(preferredError);
+                    }
+                });
+            };
+
+            launch(gateways[0]);
+            if (!fallbackStarted) {
+                timer = setTimeout(startFallbacks, STORAGE_GATEWAY_TIMEOUT_MS);
+            }
+        });
+    }
+
+    static client(name = null) {
+        if (!this.current(name)) {
+            const error = new Error(STORAGE_NOT_CONFIGURED);
+            error.code = 'STORAGE_NOT_CONFIGURED';
+            throw error;
+        }
+        return this.current(name);
+    }
+
+    // Read cid from an injected provider; a missing object is a 404 like the gateway's
+    static async retrieveFromProvider(provider, cid, signal) {
+        const data = await provider.retrieve(cid, { signal });
+        if (!data) {
+            const error = new Error('Failed to retrieve file: 404');
+            error.status = 404;
+            throw error;
+        }
+        return data;
+    }
+
+    // Run operation(signal) within the budget for kind, behind storageBreaker. Health
+    // probes bypass the breaker so they keep reporting the real state.
+    static async withTimeout(kind, operation, options = {}) {
+        if (kind === 'health') {
+            return this.raceTimeout(kind, operation, options);
+        }
+        return storageBreaker.execute(() => this.raceTimeout(kind, operation, options), isStorageFailure);
+    }
+
+    // Timeouts reject with code 'TIMEOUT'; the signal handed to the operation is
+    // aborted either way.
+    static async raceTimeout(kind, operation, options = {}) {
+        const timeoutMs = options.timeoutMs || STORAGE_TIMEOUTS_MS[kind];
+        const controller = new AbortController();
+        let timer = null;
+        let onAbort = null;
+
+        const deadline = new Promise((_, reject) => {
+            timer = setTimeout(() => {
+                const error = new Error(`Storage ${kind} timed out after ${timeoutMs}ms`);
+                error.code = 'TIMEOUT';
+                controller.abort(error);
+                reject(error);
+            }, timeoutMs);
+            onAbort = () => {
+                const error = new Error(`Storage ${kind} cancelled`);
+                error.code = 'CANCELLED';
+                controller.abort(error);
+                reject(error);
+            };
+            if (options.signal?.aborted) {
+                onAbort();
+            } else {
+                options.signal?.addEventListener('abort', onAbort, { once: true });
+            }
+        });
+
+        try {
+            return await Promise.race([operation(controller.signal), deadline]);
+        } finally {
+            clearTimeout(timer);
+            options.signal?.removeEventListener('abort', onAbort);
+        }
+    }
+
+    static async upload(data, fileName, contentType, options = {}) {
+        const file = new File([data], fileName, {
+            type: contentType || 'application/octet-stream'
+        });
+        return this.withTimeout('upload', async (signal) =>
+            (await this.client(options.provider).uploadFile(file, { signal })).toString(), options);
+    }
+
+    // true if the gateway can serve cid, false if it reports the content missing,
+    // null if the check itself failed (timeout, gateway error)
+    static async isAvailable(cid, options = {}) {
+        const provider = this.readProvider(options.provider);
+        if (provider) {
+            return !!(await provider.retrieve(cid).catch(() => null));
+        }
+        try {
+            const response = await this.withTimeout('retrieve', (signal) =>
+                httpFetch(this.getGatewayUrl(cid), { method: 'HEAD', signal }), options);
+            if (response.ok) return true;
+            return response.status === 404 || response.status === 410 ? false : null;
+        } catch (error) {
+            return null;
+        }
+    }
+
+    // Gateway reachability for health checks
+    static async ping(options = {}) {
+        if (this.provider) {
+            return true;
+        }
+        try {
+            const response = await this.withTimeout('health', (signal) =>
+                fetch(this.getGatewayUrl(''), { method: 'HEAD', signal }), options);
+            return response.status < 500;
+        } catch (error) {
+            return false;
+        }
+    }
+
+    // Upload the file, then its metadata sidecar. Returns { cid, metadataCid }; the
+    // sidecar is best-effort and metadataCid is null when it is skipped or fails.
+    // meta: { content_type, metadata, private } - private uploads get no sidecar,
+    // since it would publish their metadata in the clear.
+    static async uploadWithMeta(data, fileName, meta = {}, options = {}) {
+        const cid = await this.upload(data, fileName, meta.content_type, options);
+        if (!STORAGE_METADATA_SIDECAR || meta.private) {
+            return { cid, metadataCid: null };
+        }
+        return { cid, metadataCid: await this.uploadMetadata(cid, fileName, meta, options) };
+    }
+
+    // Pack files ({ path, data, contentType }) into one UnixFS directory; returns its root CID
+    static async uploadDirectory(files, options = {}) {
+        const entries = files.map(f => new File([f.data], f.path, {
+            type: f.contentType || 'application/octet-stream'
+        }));
+        return this.withTimeout('upload', async (signal) =>
+            (await this.client(options.provider).uploadDirectory(entries, { signal })).toString(), options);
+    }
+
+    // Upload a pre-built CAR as-is, so the stored DAG (and its root CID) is exactly
+    // what the client computed
+    static async uploadCAR(carBytes, options = {}) {
+        return this.withTimeout('upload', async (signal) =>
+            (await this.client(options.provider).uploadCAR(new Blob([carBytes]), { signal })).toString(), options);
+    }
+
+    // Root CIDs from a CAR header; throws if the bytes are not a valid CAR
+    static async getCarRoots(carBytes) {
+        const reader = await CarReader.fromBytes(carBytes);
+        return (await reader.getRoots()).map(root => root.toString());
+    }
+
+    static async uploadMetadata(cid, fileName, meta, options = {}) {
+        const manifest = {
+            cid,
+            file_name: fileName,
+            content_type: meta.content_type || 'application/octet-stream',
+            metadata: meta.metadata || {},
+            created_at: new Date().toISOString()
+        };
+
+        try {
+            return await this.upload(JSON.stringify(manifest), `${fileName}.metadata.json`, 'application/json', options);
+        } catch (error) {
+            console.log(`⚠️ Metadata sidecar upload failed for ${cid}:`, error.message);
+            return null;
+        }
+    }
+
+    // options.onSource, if given, is called with the gateway (or provider name) that
+    // served the content, for diagnostics
+    static async retrieveFile(cid, options = {}) {
+        console.log(`📥 Retrieving from IPFS: ${cid}`);
+        const provider = this.readProvider(options.provider);
+        const fileData = await this.withTimeout('retrieve', async (signal) => {
+            if (provider) {
+                options.onSource?.(provider.name);
+                return this.retrieveFromProvider(provider, cid, signal);
+            }
+            const { response, gateway } = await this.fetchFromGateways(cid, {}, signal, 'file');
+            options.onSource?.(gateway);
+            return Buffer.from(await response.arrayBuffer());
+        }, options);
+
+        console.log(`✅ Retrieved ${fileData.length} bytes from IPFS`);
+        return fileData;
+    }
+
+    // Fetch bytes start..end (inclusive). Gateways that ignore Range and answer
+    // 200 with the whole object are handled by slicing locally.
+    static async retrieveRange(cid, start, end, options = {}) {
+        console.log(`📥 Retrieving bytes ${start}-${end} from IPFS: ${cid}`);
+        const provider = this.readProvider(options.provider);
+        return this.withTimeout('retrieve', async (signal) => {
+            if (provider) {
+                options.onSource?.(provider.name);
+                return (await this.retrieveFromProvider(provider, cid, signal)).subarray(start, end + 1);
+            }
+            const { response, gateway } = await this.fetchFromGateways(cid, {
+                headers: { Range: `bytes=${start}-${end}` }
+            }, signal, 'file range');
+            options.onSource?.(gateway);
+
+            const data = Buffer.from(await response.arrayBuffer());
+            return response.status === 206 ? data : data.subarray(start, end + 1);
+        }, options);
+    }
+}
+
+// Role lookup - addresses without an assigned role are regular users
+async function getUserRole(userAddress) {
+    const row = await db.get(
+        'SELECT role FROM user_roles WHERE user_address = ?',
+        [userAddress.toLowerCase()]
+    );
+    return row ? row.role : 'user';
+}
+
+// Per-role daily upload limits, overridable with UPLOAD_QUOTAS (JSON keyed by role)
+const DEFAULT_UPLOAD_QUOTAS = {
+    user: { daily_uploads: 100, daily_bytes: 1024 * 1024 * 1024 },
+    admin: { daily_uploads: Infinity, daily_bytes: Infinity }
+};
+
+class UploadQuotaService {
+    static getQuotas(role) {
+        let configured = {};
+        if (process.env.UPLOAD_QUOTAS) {
+            try {
+                configured = JSON.parse(process.env.UPLOAD_QUOTAS);
+            } catch (error) {
+                console.error('❌ Invalid UPLOAD_QUOTAS JSON, using defaults:', error.message);
+            }
+        }
+
+        return {
+            ...DEFAULT_UPLOAD_QUOTAS.user,
+            ...DEFAULT_UPLOAD_QUOTAS[role],
+            ...configured[role]
+        };
+    }
+
+    // Check whether an upload of fileSize bytes fits in the user's rolling 24h window
+    static async check(userAddress, fileSize) {
+        const role = await getUserRole(userAddress);
+        const limits = this.getQuotas(role);
+
+        const usage = await db.get(`
+            SELECT COUNT(*) as uploads, COALESCE(SUM(file_size), 0) as bytes
+            FROM file_records
+            WHERE LOWER(uploader_addr) = LOWER(?) AND created_at >= datetime('now', '-1 day')
+        `, [userAddress]);
+
+        let exceeded = null;
+        if (usage.uploads + 1 > limits.daily_uploads) {
+            exceeded = { quota: 'daily_uploads', limit: limits.daily_uploads, current: usage.uploads };
+        } else if (usage.bytes + fileSize > limits.daily_bytes) {
+            exceeded = { quota: 'daily_bytes', limit: limits.daily_bytes, current: usage.bytes };
+        }
+
+        return {
+            role,
+            exceeded,
+            remainingUploads: Math.max(limits.daily_uploads - usage.uploads - (exceeded ? 0 : 1), 0),
+            remainingBytes: Math.max(limits.daily_bytes - usage.bytes - (exceeded ? 0 : fileSize), 0)
+        };
+    }
+}
+
+// Encryption utilities
+// Buffered writer for access_log. Decisions are queued on the request path and
+// written in batches, so audit logging never adds a database round trip there.
+const ACCESS_LOG_BATCH_SIZE = parseInt(process.env.ACCESS_LOG_BATCH_SIZE) || 100;
+const ACCESS_LOG_FLUSH_INTERVAL_MS = parseInt(process.env.ACCESS_LOG_FLUSH_INTERVAL_MS) || 2000;
+
+class AccessAuditLog {
+    constructor() {
+        this.buffer = [];
+        this.timer = null;
+    }
+
+    // decision is 'allowed' or 'denied'; the timestamp is taken now, not at flush
+    record(cid, actor, action, decision, reason) {
+        this.buffer.push([
+            cid,
+            actor ? actor.toLowerCase() : null,
+            action,
+            decision,
+            reason || null,
+            new Date().toISOString()
+        ]);
+
+        if (this.buffer.length >= ACCESS_LOG_BATCH_SIZE) {
+            this.flush();
+        } else if (!this.timer) {
+            this.timer = setTimeout(() => this.flush(), ACCESS_LOG_FLUSH_INTERVAL_MS);
+        }
+    }
+
+    async flush() {
+        clearTimeout(this.timer);
+        this.timer = null;
+
+        if (this.buffer.length === 0) return;
+        const batch = this.buffer.splice(0, ACCESS_LOG_BATCH_SIZE);
+
+        try {
+            await withTransaction(() => db.run(`
+                INSERT INTO access_log (cid, actor, action, decision, reason, created_at)
+                VALUES ${batch.map(() => '(?, ?, ?, ?, ?, ?)').join(', ')}
+            `, batch.flat()));
+        } catch (error) {
+            console.error(`❌ Failed to write ${batch.length} access log entries:`, error.message);
+        }
+
+        if (this.buffer.length > 0 && !this.timer) {
+            this.timer = setTimeout(() => this.flush(), ACCESS_LOG_FLUSH_INTERVAL_MS);
+        }
+    }
+}
+
+const accessAuditLog = new AccessAuditLog();
+
+// Supported file encryption algorithms; AES-GCM stays the default. Both use a
+// 256-bit key, so a user's existing key works with either.
+const ENCRYPTION_ALGORITHMS = ['aes-256-gcm', 'chacha20-poly1305'];
+const DEFAULT_ENCRYPTION_ALGORITHM = process.env.ENCRYPTION_ALGORITHM || 'aes-256-gcm';
+const ENCRYPTION_AAD = Buffer.from('privychain', 'utf8');
+// First byte of AES-GCM ciphertexts in the current layout (see encryptAesGcm)
+const AES_GCM_FORMAT_VERSION = 0x02;
+
+// How a file's bytes are protected: 'none', 'server' (encrypted here with the
+// uploader's stored key), 'wallet' (encrypted here with a key derived from the
+// uploader's signature over WALLET_KEY_MESSAGE, never stored) or 'client'
+// (encrypted before upload; the server only ever holds ciphertext and an
+// optional wrapped key it cannot open)
+const ENCRYPTION_MODES = ['none', 'server', 'wallet', 'client'];
+const SERVER_ENCRYPTION_MODES = ['server', 'wallet'];
+const WALLET_KEY_MESSAGE = 'PrivyChain file encryption key v1';
+const MAX_WRAPPED_KEY_LENGTH = 4096;
+
+class EncryptionService {
+    static generateKey() {
+        return crypto.randomBytes(32); // 256-bit key
+    }
+
+    static isSupportedAlgorithm(algorithm) {
+        return ENCRYPTION_ALGORITHMS.includes(algorithm);
+    }
+
+    static encrypt(data, key, algorithm = 'aes-256-gcm') {
+        if (algorithm === 'chacha20-poly1305') {
+            return this.encryptChaCha20(data, key);
+        }
+        return this.encryptAesGcm(data, key);
+    }
+
+    static decrypt(encryptedData, key, algorithm = 'aes-256-gcm') {
+        if (algorithm === 'chacha20-poly1305') {
+            return this.decryptChaCha20(encryptedData, key);
+        }
+
+        if (encryptedData[0] === AES_GCM_FORMAT_VERSION) {
+            try {
+                return this.decryptAesGcm(encryptedData, key);
+            } catch (error) {
+                // A legacy ciphertext whose random first byte happens to match the
+                // version byte fails authentication here; fall through and try it as one
+            }
+        }
+        return this.decryptLegacyAesGcm(encryptedData, key);
+    }
+
+    // Layout: version byte | 12-byte random IV | 16-byte auth tag | ciphertext
+    static encryptAesGcm(data, key) {
+        const iv = crypto.randomBytes(12);
+        const cipher = crypto.createCipheriv('aes-256-gcm', key, iv);
+        cipher.setAAD(ENCRYPTION_AAD);
+
+        const encrypted = Buffer.concat([cipher.update(data), cipher.final()]);
+        return Buffer.concat([Buffer.from([AES_GCM_FORMAT_VERSION]), iv, cipher.getAuthTag(), encrypted]);
+    }
+
+    static decryptAesGcm(encryptedData, key) {
+        const iv = encryptedData.subarray(1, 13);
+        const authTag = encryptedData.subarray(13, 29);
+        const encrypted = encryptedData.subarray(29);
+
+        const decipher = crypto.createDecipheriv('aes-256-gcm', key, iv);
+        decipher.setAAD(ENCRYPTION_AAD);
+        decipher.setAuthTag(authTag);
+
+        return Buffer.concat([decipher.update(encrypted), decipher.final()]);
+    }
+
+    // Files written before the versioned layout: 16 unused bytes | auth tag | ciphertext,
+    // encrypted with the removed crypto.createCipher, which derived the key and the
+    // (fixed) IV from the key alone via OpenSSL's EVP_BytesToKey (MD5, one round, no
+    // salt). Read-only; nothing is encrypted this way any more.
+    static decryptLegacyAesGcm(encryptedData, key) {
+        const derived = [];
+        let block = Buffer.alloc(0);
+        while (Buffer.concat(derived).length < 32 + 12) {
+            block = crypto.createHash('md5').update(Buffer.concat([block, key])).digest();
+            derived.push(block);
+        }
+        const material = Buffer.concat(derived);
+
+        const decipher = crypto.createDecipheriv('aes-256-gcm', material.subarray(0, 32), material.subarray(32, 44));
+        decipher.setAAD(ENCRYPTION_AAD);
+        decipher.setAuthTag(encryptedData.subarray(16, 32));
+
+        return Buffer.concat([decipher.update(encryptedData.subarray(32)), decipher.final()]);
+    }
+
+    // Layout: 12-byte nonce | 16-byte auth tag | ciphertext
+    static encryptChaCha20(data, key) {
+        const nonce = crypto.randomBytes(12);
+        const cipher = crypto.createCipheriv('chacha20-poly1305', key, nonce, { authTagLength: 16 });
+        cipher.setAAD(ENCRYPTION_AAD, { plaintextLength: data.length });
+
+        const encrypted = Buffer.concat([cipher.update(data), cipher.final()]);
+        return Buffer.concat([nonce, cipher.getAuthTag(), encrypted]);
+    }
+
+    static decryptChaCha20(encryptedData, key) {
+        const nonce = encryptedData.subarray(0, 12);
+        const authTag = encryptedData.subarray(12, 28);
+        const encrypted = encryptedData.subarray(28);
+
+        const decipher = crypto.createDecipheriv('chacha20-poly1305', key, nonce, { authTagLength: 16 });
+        decipher.setAAD(ENCRYPTION_AAD, { plaintextLength: encrypted.length });
+        decipher.setAuthTag(authTag);
+
+        return Buffer.concat([decipher.update(encrypted), decipher.final()]);
+    }
+
+    // HKDF over the signature bytes. Wallets sign deterministically, so the same
+    // wallet always reproduces the same key and nobody else can.
+    static deriveKeyFromSignature(signature) {
+        const signatureBytes = ethers.getBytes(signature);
+        return Buffer.from(crypto.hkdfSync(
+            'sha256',
+            signatureBytes,
+            Buffer.from('privychain-wallet-key', 'utf8'),
+            Buffer.from(WALLET_KEY_MESSAGE, 'utf8'),
+            32
+        ));
+    }
+
+    // Wallet-mode files are encrypted with a random per-file data key. The owner's copy
+    // is wrapped under HKDF(wallet key, the file's random salt), so no two files share
+    // a key and the signature alone (without the record) opens nothing.
+    static fileKeyEncryptionKey(walletKey, salt) {
+        return Buffer.from(crypto.hkdfSync(
+            'sha256',
+            walletKey,
+            salt,
+            Buffer.from('privychain-file-key', 'utf8'),
+            32
+        ));
+    }
+
+    static wrapFileKey(dataKey, walletKey, salt) {
+        return this.encryptAesGcm(dataKey, this.fileKeyEncryptionKey(walletKey, salt)).toString('base64');
+    }
+
+    static unwrapFileKey(wrapped, walletKey, salt) {
+        return this.decryptAesGcm(Buffer.from(wrapped, 'base64'), this.fileKeyEncryptionKey(walletKey, salt));
+    }
+
+    static keyCheckValue(key) {
+        return crypto.createHmac('sha256', key).update('privychain-key-check').digest('hex');
+    }
+
+    // Derive a user's wallet key and check it against the stored check value,
+    // recording the check value the first time. Returns null when the signature
+    // is not the user's or does not reproduce their key.
+    static async getWalletKey(userAddress, signature) {
+        if (!signature || !AuthService.verifySignature(userAddress, signature, WALLET_KEY_MESSAGE)) {
+            return null;
+        }
+
+        let key;
+        try {
+            key = this.deriveKeyFromSignature(signature);
+        } catch (error) {
+            return null;
+        }
+
+        const keyCheck = this.keyCheckValue(key);
+        const existing = await db.get(
+            'SELECT key_check FROM wallet_key_checks WHERE user_address = ?',
+            [userAddress.toLowerCase()]
+        );
+
+        if (!existing) {
+            await db.run(
+                'INSERT OR IGNORE INTO wallet_key_checks (user_address, key_check) VALUES (?, ?)',
+                [userAddress.toLowerCase(), keyCheck]
+            );
+            return key;
+        }
+
+        const matches = crypto.timingSafeEqual(
+            Buffer.from(existing.key_check, 'hex'),
+            Buffer.from(keyCheck, 'hex')
+        );
+        return matches ? key : null;
+    }
+
+    // Keys are per app, so the same wallet has unrelated keys in different tenants
+    // Only the key store's wrapped form is persisted; unwrapped keys live in a
+    // short-lived in-memory cache so an external KMS isn't called on every file
+    static keyCache = new Map();
+
+    static async getUserKey(userAddress, appId = DEFAULT_APP_ID) {
+        const cacheKey = `${appId}:${userAddress.toLowerCase()}`;
+        const cached = this.keyCache.get(cacheKey);
+        if (cached && Date.now() - cached.cachedAt < KEY_CACHE_TTL_MS) {
+            return cached.key;
+        }
+
+        let keyRecord = await db.get(
+            'SELECT key_material, key_wrapping FROM encryption_keys WHERE app_id = ? AND user_address = ?',
+            [appId, userAddress]
+        );
+        
+        let key;
+        if (!keyRecord) {
+            key = this.generateKey();
+            await db.run(
+                'INSERT INTO encryption_keys (app_id, user_address, key_material, key_id, key_wrapping) VALUES (?, ?, ?, ?, ?)',
+                [appId, userAddress, await keyStore.wrap(key), `key_${Date.now()}`, keyStore.name]
+            );
+        } else {
+            key = await getKeyStore(keyRecord.key_wrapping).unwrap(keyRecord.key_material);
+        }
+
+        this.keyCache.set(cacheKey, { key, cachedAt: Date.now() });
+        return key;
+    }
+}
+
+// Where per-user file keys are protected. KEY_STORE selects the store for new keys:
+//   local - wrapped with KEY_ENCRYPTION_KEY (32-byte hex) before being written to the database
+//   vault - wrapped by HashiCorp Vault's transit engine (VAULT_ADDR, VAULT_TOKEN,
+//           VAULT_TRANSIT_KEY, VAULT_TRANSIT_MOUNT); the master key never leaves Vault
+//   plain - legacy unwrapped hex, only used when nothing else is configured
+// Each row records its wrapping, so keys written by another store stay readable and
+// plain keys are re-wrapped at startup.
+const KEY_CACHE_TTL_MS = parseInt(process.env.KEY_CACHE_TTL_MS) || 5 * 60 * 1000;
+const KEY_STORES = ['plain', 'local', 'vault'];
+
+class LocalKeyStore {
+    constructor(masterKey) {
+        this.masterKey = masterKey;
+        this.name = masterKey ? 'local' : 'plain';
+    }
+
+    async wrap(key) {
+        if (!this.masterKey) {
+            return key.toString('hex');
+        }
+        const iv = crypto.randomBytes(12);
+        const cipher = crypto.createCipheriv('aes-256-gcm', this.masterKey, iv);
+        const wrapped = Buffer.concat([cipher.update(key), cipher.final()]);
+        return Buffer.concat([iv, cipher.getAuthTag(), wrapped]).toString('base64');
+    }
+
+    async unwrap(wrapped) {
+        if (!this.masterKey) {
+            return Buffer.from(wrapped, 'hex');
+        }
+        const data = Buffer.from(wrapped, 'base64');
+        const decipher = crypto.createDecipheriv('aes-256-gcm', this.masterKey, data.subarray(0, 12));
+        decipher.setAuthTag(data.subarray(12, 28));
+        return Buffer.concat([decipher.update(data.subarray(28)), decipher.final()]);
+    }
+}
+
+class VaultKeyStore {
+    constructor({ addr, token, keyName, mount = 'transit' }) {
+        this.name = 'vault';
+        this.url = `${addr.replace(/\/$/, '')}/v1/${mount}`;
+        this.token = token;
+        this.keyName = keyName;
+    }
+
+    async request(operation, body) {
+        const response = await fetch(`${this.url}/${operation}/${encodeURIComponent(this.keyName)}`, {
+            method: 'POST',
+            headers: { 'X-Vault-Token': this.token, 'Content-Type': 'application/json' },
+            body: JSON.stringify(body),
+            signal: AbortSignal.timeout(10000)
+        });
+        if (!response.ok) {
+            throw new Error(`Vault ${operation} failed with HTTP ${response.status}`);
+        }
+        return (await response.json()).data;
+    }
+
+    async wrap(key) {
+        return (await this.request('encrypt', { plaintext: key.toString('base64') })).ciphertext;
+    }
+
+    async unwrap(wrapped) {
+        return Buffer.from((await this.request('decrypt', { ciphertext: wrapped })).plaintext, 'base64');
+    }
+}
+
+const keyStores = new Map();
+
+// Key store by wrapping name, built from the environment; throws if it isn't configured
+function getKeyStore(name = 'plain') {
+    if (!keyStores.has(name)) {
+        let store;
+        if (name === 'plain') {
+            store = new LocalKeyStore(null);
+        } else if (name === 'local') {
+            if (!/^[0-9a-fA-F]{64}$/.test(process.env.KEY_ENCRYPTION_KEY || '')) {
+                throw new Error('KEY_ENCRYPTION_KEY must be 32 bytes of hex for the local key store');
+            }
+            store = new LocalKeyStore(Buffer.from(process.env.KEY_ENCRYPTION_KEY, 'hex'));
+        } else if (name === 'vault') {
+            if (!process.env.VAULT_ADDR || !process.env.VAULT_TOKEN || !process.env.VAULT_TRANSIT_KEY) {
+                throw new Error('VAULT_ADDR, VAULT_TOKEN and VAULT_TRANSIT_KEY are required for the vault key store');
+            }
+            store = new VaultKeyStore({
+                addr: process.env.VAULT_ADDR,
+                token: process.env.VAULT_TOKEN,
+                keyName: process.env.VAULT_TRANSIT_KEY,
+                mount: process.env.VAULT_TRANSIT_MOUNT
+            });
+        } else {
+            throw new Error(`Unknown key store "${name}". Allowed: ${KEY_STORES.join(', ')}`);
+        }
+        keyStores.set(name, store);
+    }
+    return keyStores.get(name);
+}
+
+// Content scanning before uploads are stored. CONTENT_SCANNER=http posts the bytes to
+// CONTENT_SCANNER_URL, which answers { clean: boolean, reason? }. Scanner errors and
+// timeouts reject the upload unless CONTENT_SCANNER_FAIL_OPEN=true.
+const CONTENT_SCANNERS = ['none', 'http'];
+
+class NoopContentScanner {
+    constructor() {
+        this.name = 'none';
+    }
+
+    async scan() {
+        return { clean: true };
+    }
+}
+
+class HttpContentScanner {
+    constructor({ url, token, timeoutMs }) {
+        this.name = 'http';
+        this.url = url;
+        this.token = token;
+        this.timeoutMs = timeoutMs;
+    }
+
+    // meta: { fileName, contentType, uploader }
+    async scan(data, meta = {}) {
+        const headers = {
+            'Content-Type': 'application/octet-stream',
+            'X-File-Name': encodeURIComponent(meta.fileName || ''),
+            'X-File-Content-Type': meta.contentType || 'application/octet-stream',
+            'X-Uploader': meta.uploader || ''
+        };
+        if (this.token) {
+            headers.Authorization = `Bearer ${this.token}`;
+        }
+
+        const response = await fetch(this.url, {
+            method: 'POST',
+            headers,
+            body: data,
+            signal: AbortSignal.timeout(this.timeoutMs)
+        });
+        if (!response.ok) {
+            throw new Error(`Content scanner responded ${response.status}`);
+        }
+
+        const result = await response.json();
+        if (typeof result.clean !== 'boolean') {
+            throw new Error('Content scanner response is missing "clean"');
+        }
+        return { clean: result.clean, reason: result.reason || null };
+    }
+}
+
+// Scanner by name, built from the environment; throws if it isn't configured
+function createContentScanner(name = 'none') {
+    if (name === 'none') {
+        return new NoopContentScanner();
+    }
+    if (name === 'http') {
+        if (!process.env.CONTENT_SCANNER_URL) {
+            throw new Error('CONTENT_SCANNER_URL is required for the http content scanner');
+        }
+        return new HttpContentScanner({
+            url: process.env.CONTENT_SCANNER_URL,
+            token: process.env.CONTENT_SCANNER_TOKEN,
+            timeoutMs: parseInt(process.env.CONTENT_SCANNER_TIMEOUT_MS) || 30000
+        });
+    }
+    throw new Error(`Unknown content scanner "${name}". Allowed: ${CONTENT_SCANNERS.join(', ')}`);
+}
+
+// Scan an upload. Returns null when it may be stored, else { status, code, error, reason }.
+async function scanUpload(data, meta) {
+    if (!contentScanner || contentScanner.name === 'none') {
+        return null;
+    }
+
+    try {
+        const result = await contentScanner.scan(data, meta);
+        if (result.clean) return null;
+
+        console.log(`🚫 Upload of ${meta.fileName} by ${meta.uploader} rejected by content scanner: ${result.reason || 'no reason given'}`);
+        return { status: 422, code: 'CONTENT_REJECTED', error: 'File rejected by content policy', reason: result.reason };
+    } catch (error) {
+        if (process.env.CONTENT_SCANNER_FAIL_OPEN === 'true') {
+            console.log(`⚠️ Content scan failed, accepting upload (fail-open): ${error.message}`);
+            return null;
+        }
+        console.error('❌ Content scan failed:', error.message);
+        return { status: 503, code: 'SCANNER_UNAVAILABLE', error: 'Content scanning is unavailable, try again later', reason: null };
+    }
+}
+
+class AuthService {
+    static isValidAddress(address) {
+        try {
+            return ethers.isAddress(address);
+        } catch (error) {
+            console.error('Address validation error:', error);
+            return false;
+        }
+    }
+
+    static validateRequest(req) {
+        const errors = [];
+        
+        if (!req.user_address) {
+            errors.push({ field: 'user_address', message: 'User address is required' });
+        } else if (!this.isValidAddress(req.user_address)) {
+            errors.push({ field: 'user_address', message: 'Invalid Ethereum address' });
+        }
+        
+        return errors;
+    }
+    
+    static verifySignature(address, signature, message) {
+        // Skip verification in development
+        if (process.env.SKIP_SIGNATURE_VERIFICATION === 'true') {
+            console.log('⚠️  Signature verification bypassed');
+            return this.isValidSignatureFormat(signature);
+        }
+
+        try {
+            const recoveredAddress = ethers.verifyMessage(message, signature);
+            return recoveredAddress.toLowerCase() === address.toLowerCase();
+        } catch (error) {
+            console.error('Signature verification failed:', error.message);
+            return false;
+        }
+    }
+    
+    static isValidSignatureFormat(signature) {
+        return signature && 
+               signature.startsWith('0x') && 
+               signature.length === 132;
+    }
+
+    // Message signed for header-authenticated requests (x-timestamp, x-signature)
+    static createAuthMessage(timestamp) {
+        return `PrivyChain Authentication\nTimestamp: ${timestamp}`;
+    }
+}
+
+// Signs CID + metadata with the server key so later edits made directly in the
+// database can be detected. Uses METADATA_SIGNING_KEY, falling back to PRIVATE_KEY;
+// disabled when neither is set or METADATA_SIGNING_ENABLED=false.
+class MetadataSigner {
+    static signer = undefined;
+
+    static getSigner() {
+        if (this.signer === undefined) {
+            const key = process.env.METADATA_SIGNING_KEY || process.env.PRIVATE_KEY;
+            this.signer = key && process.env.METADATA_SIGNING_ENABLED !== 'false' ? new ethers.Wallet(key) : null;
+        }
+        return this.signer;
+    }
+
+    static createMessage(cid, metadata) {
+        return `PrivyChain metadata\nCID: ${cid}\nMetadata: ${canonicalJson(metadata)}`;
+    }
+
+    // Returns { signature, signer, signedAt }, or null when signing is disabled
+    static async sign(cid, metadata) {
+        const signer = this.getSigner();
+        if (!signer) return null;
+
+        return {
+            signature: await signer.signMessage(this.createMessage(cid, metadata)),
+            signer: signer.address,
+            signedAt: new Date().toISOString()
+        };
+    }
+
+    // Checked against the configured key, not the stored signer, so replacing both
+    // the signature and the signer column cannot pass
+    static verify(cid, metadata, signature) {
+        const signer = this.getSigner();
+        try {
+            return ethers.verifyMessage(this.createMessage(cid, metadata), signature) === signer.address;
+        } catch (error) {
+            return false;
+        }
+    }
+}
+
+// Upload receipts are signed with the metadata signing key as an EIP-191 personal
+// message over "PrivyChain upload receipt\n" + canonical JSON of the receipt, so
+// they can be checked offline with ethers.verifyMessage against the signer address
+class UploadReceiptService {
+    static getSigner() {
+        return MetadataSigner.getSigner();
+    }
+
+    static createMessage(receipt) {
+        return `PrivyChain upload receipt\n${canonicalJson(receipt)}`;
+    }
+
+    // Build, sign and store the receipt for a confirmed file; returns the stored row
+    static async issue(fileRecord, blockNumber) {
+        const signer = this.getSigner();
+        const receipt = {
+            version: 1,
+            cid: fileRecord.cid,
+            file_size: fileRecord.file_size,
+            uploader: fileRecord.uploader_addr.toLowerCase(),
+            uploaded_at: fileRecord.created_at,
+            tx_hash: fileRecord.tx_hash,
+            block_number: blockNumber,
+            contract: process.env.CONTRACT_ADDRESS || null
+        };
+        const signature = await signer.signMessage(this.createMessage(receipt));
+
+        await db.run(`
+            INSERT INTO upload_receipts (cid, receipt, signature, signer) VALUES (?, ?, ?, ?)
+            ON CONFLICT(cid) DO NOTHING
+        `, [receipt.cid, canonicalJson(receipt), signature, signer.address]);
+        return db.get('SELECT * FROM upload_receipts WHERE cid = ?', [receipt.cid]);
+    }
+
+    // Address that signed receipt, or null if the signature is malformed
+    static recover(receipt, signature) {
+        try {
+            return ethers.verifyMessage(this.createMessage(receipt), signature);
+        } catch (error) {
+            return null;
+        }
+    }
+}
+
+// Verifies Privy-issued access/identity tokens (ES256 JWTs) against the app's JWKS
+// and resolves the user's embedded wallet, so apps that log in with Privy can call
+// this backend without a second wallet signature.
+const PRIVY_API_URL = process.env.PRIVY_API_URL || 'https://auth.privy.io';
+const PRIVY_JWKS_CACHE_MS = parseInt(process.env.PRIVY_JWKS_CACHE_MS) || 60 * 60 * 1000;
+const PRIVY_USER_CACHE_MS = parseInt(process.env.PRIVY_USER_CACHE_MS) || 5 * 60 * 1000;
+// Leeway for exp/nbf/iat, so small clock differences with Privy don't reject fresh tokens
+const PRIVY_CLOCK_SKEW_MS = parseInt(process.env.PRIVY_CLOCK_SKEW_MS) || 30 * 1000;
+const PRIVY_TOKEN_ISSUER = 'privy.io';
+
+class PrivyService {
+    static jwks = new Map();   // privy app id -> { keys, fetchedAt }
+    static users = new Map();  // privy app id + did -> { address, fetchedAt }
+
+    // Tenants are Privy apps; the default tenant is PRIVY_APP_ID
+    static privyAppId(appId) {
+        return appId === DEFAULT_APP_ID ? process.env.PRIVY_APP_ID : appId;
+    }
+
+    static isConfigured(appId) {
+        return !!this.privyAppId(appId);
+    }
+
+    static async getSigningKey(privyAppId, kid) {
+        const cached = this.jwks.get(privyAppId);
+        const fresh = cached && Date.now() - cached.fetchedAt < PRIVY_JWKS_CACHE_MS;
+        let jwk = cached && cached.keys.find(k => k.kid === kid);
+
+        // Unknown kid on a cache older than a minute usually means Privy rotated keys
+        if (!fresh || (!jwk && Date.now() - cached.fetchedAt > 60 * 1000)) {
+            const response = await httpFetch(`${PRIVY_API_URL}/api/v1/apps/${encodeURIComponent(privyAppId)}/jwks.json`, {
+                signal: AbortSignal.timeout(10000)
+            });
+            if (!response.ok) {
+                throw new Error(`JWKS request failed with HTTP ${response.status}`);
+            }
+            const { keys = [] } = await response.json();
+            this.jwks.set(privyAppId, { keys, fetchedAt: Date.now() });
+            jwk = keys.find(k => k.kid === kid);
+        }
+
+        return jwk ? crypto.createPublicKey({ key: jwk, format: 'jwk' }) : null;
+    }
+
+    // Returns the verified claims. A rejected token throws EXPIRED_TOKEN (the client
+    // should refresh it) or INVALID_TOKEN (it will never be valid); other errors
+    // mean the token could not be checked.
+    static async verifyToken(token, appId) {
+        const privyAppId = this.privyAppId(appId);
+        const parts = token.split('.');
+        if (parts.length !== 3) {
+            throw appError('INVALID_TOKEN', 'Malformed token');
+        }
+
+        const decode = (part) => JSON.parse(Buffer.from(part, 'base64url').toString('utf8'));
+        let header, claims;
+        try {
+            header = decode(parts[0]);
+            claims = decode(parts[1]);
+        } catch (error) {
+            throw appError('INVALID_TOKEN', 'Malformed token');
+        }
+
+        if (header.alg !== 'ES256') {
+            throw appError('INVALID_TOKEN', `Unsupported token algorithm ${header.alg}`);
+        }
+
+        const key = await this.getSigningKey(privyAppId, header.kid);
+        if (!key) {
+            throw appError('INVALID_TOKEN', 'Unknown signing key');
+        }
+
+        const valid = crypto.verify(
+            'sha256',
+            Buffer.from(`${parts[0]}.${parts[1]}`),
+            { key, dsaEncoding: 'ieee-p1363' },
+            Buffer.from(parts[2], 'base64url')
+        );
+        if (!valid) {
+            throw appError('INVALID_TOKEN', 'Invalid token signature');
+        }
+
+        const now = Date.now();
+        const audience = Array.isArray(claims.aud) ? claims.aud : [claims.aud];
+        if (claims.iss !== PRIVY_TOKEN_ISSUER) {
+            throw appError('INVALID_TOKEN', `Unexpected token issuer ${claims.iss}`);
+        }
+        if (!audience.includes(privyAppId)) {
+            throw appError('INVALID_TOKEN', 'Token was not issued for this app');
+        }
+        if (!claims.exp) {
+            throw appError('INVALID_TOKEN', 'Token has no expiry');
+        }
+        if (claims.exp * 1000 < now - PRIVY_CLOCK_SKEW_MS) {
+            throw appError('EXPIRED_TOKEN', 'Token expired');
+        }
+        if (claims.nbf && claims.nbf * 1000 > now + PRIVY_CLOCK_SKEW_MS) {
+            throw appError('INVALID_TOKEN', 'Token not yet valid');
+        }
+        if (claims.iat && claims.iat * 1000 > now + PRIVY_CLOCK_SKEW_MS) {
+            throw appError('INVALID_TOKEN', 'Token issued in the future');
+        }
+
+        return claims;
+    }
+
+    // Embedded (Privy-managed) wallet first, then any linked Ethereum wallet
+    static pickWallet(linkedAccounts) {
+        const wallets = (linkedAccounts || []).filter(a => a.type === 'wallet' && a.chain_type !== 'solana' && a.address);
+        const wallet = wallets.find(a => a.wallet_client_type === 'privy') || wallets[0];
+        return wallet ? wallet.address : null;
+    }
+
+    // Identity tokens carry linked accounts; access tokens only carry the DID, so the
+    // user is looked up through the Privy API with the app secret
+    static async resolveWalletAddress(claims, appId) {
+        if (claims.linked_accounts) {
+            const accounts = typeof claims.linked_accounts === 'string'
+                ? JSON.parse(claims.linked_accounts)
+                : claims.linked_accounts;
+            return this.pickWallet(accounts);
+        }
+
+        const privyAppId = this.privyAppId(appId);
+        const cacheKey = `${privyAppId}:${claims.sub}`;
+        const cached = this.users.get(cacheKey);
+        if (cached && Date.now() - cached.fetchedAt < PRIVY_USER_CACHE_MS) {
+            return cached.address;
+        }
+
+        const apiKey = APP_CREDENTIALS.get(privyAppId);
+        if (!apiKey) {
+            throw new Error('Privy API key is not configured for this app');
+        }
+
+        const response = await httpFetch(`${PRIVY_API_URL}/api/v1/users/${encodeURIComponent(claims.sub)}`, {
+            headers: {
+                'privy-app-id': privyAppId,
+                Authorization: `Basic ${Buffer.from(`${privyAppId}:${apiKey}`).toString('base64')}`
+            },
+            signal: AbortSignal.timeout(10000)
+        });
+        if (!response.ok) {
+            throw new Error(`Privy user lookup failed with HTTP ${response.status}`);
+        }
+
+        const user = await response.json();
+        const address = this.pickWallet(user.linked_accounts);
+        this.users.set(cacheKey, { address, fetchedAt: Date.now() });
+        return address;
+    }
+}
+
+// Share links: tokens are "<id>.<expiry seconds>.<hmac>", signed with SHARE_LINK_SECRET.
+// The share_links row holds the password hash and download count, so limits hold
+// across requests and a link can't be replayed past them.
+const SHARE_LINK_DEFAULT_TTL_SECONDS = parseInt(process.env.SHARE_LINK_DEFAULT_TTL_SECONDS) || 24 * 60 * 60;
+const SHARE_LINK_MAX_TTL_SECONDS = parseInt(process.env.SHARE_LINK_MAX_TTL_SECONDS) || 7 * 24 * 60 * 60;
+// Wrong passwords lock a link for a while, so passwords can't be guessed through it
+const SHARE_LINK_MAX_PASSWORD_ATTEMPTS = parseInt(process.env.SHARE_LINK_MAX_PASSWORD_ATTEMPTS) || 5;
+const SHARE_LINK_LOCKOUT_MINUTES = parseInt(process.env.SHARE_LINK_LOCKOUT_MINUTES) || 15;
+
+class ShareLinkService {
+    static isEnabled() {
+        return !!process.env.SHARE_LINK_SECRET;
+    }
+
+    static sign(id, cid, expiresAtSeconds, passwordHash) {
+        return crypto.createHmac('sha256', process.env.SHARE_LINK_SECRET)
+            .update(`${id}\n${cid}\n${expiresAtSeconds}\n${passwordHash || ''}`)
+            .digest('base64url');
+    }
+
+    static hashPassword(password, salt = crypto.randomBytes(16).toString('hex')) {
+        return `${salt}:${crypto.scryptSync(password, salt, 32).toString('hex')}`;
+    }
+
+    static async create(fileRecord, createdBy, { expiresIn, password, maxDownloads }) {
+        const link = {
+            id: crypto.randomBytes(16).toString('hex'),
+            app_id: fileRecord.app_id,
+            cid: fileRecord.cid,
+            expires_at: new Date(Math.floor(Date.now() / 1000 + expiresIn) * 1000).toISOString(),
+            password_hash: password ? this.hashPassword(password) : null
+        };
+
+        await db.run(`
+            INSERT INTO share_links (id, app_id, cid, created_by, expires_at, password_hash, max_downloads)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+        `, [link.id, link.app_id, link.cid, createdBy.toLowerCase(), link.expires_at, link.password_hash, maxDownloads]);
+        return link;
+    }
+
+    static createToken(link) {
+        const expiresAtSeconds = Math.floor(new Date(link.expires_at).getTime() / 1000);
+        return `${link.id}.${expiresAtSeconds}.${this.sign(link.id, link.cid, expiresAtSeconds, link.password_hash)}`;
+    }
+
+    // { link } if the token is valid for cid right now, else { status, error }
+    static async authorize(token, cid, password) {
+        if (!this.isEnabled()) {
+            return { status: 503, error: 'Share links are not configured' };
+        }
+
+        const [id, expiresAtSeconds, signature] = String(token).split('.');
+        if (!id || !expiresAtSeconds || !signature) {
+            return { status: 401, error: 'Malformed share link' };
+        }
+
+        const link = await db.get('SELECT * FROM share_links WHERE id = ? AND cid = ?', [id, cid]);
+        const expected = link ? this.sign(link.id, link.cid, expiresAtSeconds, link.password_hash) : '';
+        if (!link || signature.length !== expected.length ||
+            !crypto.timingSafeEqual(Buffer.from(signature), Buffer.from(expected))) {
+            return { status: 401, error: 'Invalid share link' };
+        }
+
+        if (Number(expiresAtSeconds) * 1000 < Date.now()) {
+            return { status: 410, error: 'Share link expired' };
+        }
+
+        if (link.password_hash) {
+            if (!password) {
+                return { status: 401, error: 'Share link password required' };
+            }
+            if (link.locked_until && link.locked_until > new Date().toISOString()) {
+                return { status: 429, error: 'Too many incorrect passwords - try again later' };
+            }
+            const [salt] = link.password_hash.split(':');
+            const candidate = this.hashPassword(password, salt);
+            if (!crypto.timingSafeEqual(Buffer.from(candidate), Buffer.from(link.password_hash))) {
+                await this.recordFailedAttempt(link);
+                return { status: 401, error: 'Incorrect share link password' };
+            }
+            if (link.failed_attempts > 0) {
+                await db.run('UPDATE share_links SET failed_attempts = 0, locked_until = NULL WHERE id = ?', [link.id]);
+            }
+        }
+
+        if (link.max_downloads !== null && link.downloads_used >= link.max_downloads) {
+            return { status: 403, error: 'Share link download limit reached' };
+        }
+
+        return { link };
+    }
+
+    // The attempt that reaches the limit locks the link and starts a fresh count
+    static async recordFailedAttempt(link) {
+        const lockedUntil = new Date(Date.now() + SHARE_LINK_LOCKOUT_MINUTES * 60 * 1000).toISOString();
+        await db.run(`
+            UPDATE share_links SET
+                locked_until = CASE WHEN failed_attempts + 1 >= ? THEN ? ELSE locked_until END,
+                failed_attempts = CASE WHEN failed_attempts + 1 >= ? THEN 0 ELSE failed_attempts + 1 END
+            WHERE id = ?
+        `, [SHARE_LINK_MAX_PASSWORD_ATTEMPTS, lockedUntil, SHARE_LINK_MAX_PASSWORD_ATTEMPTS, link.id]);
+    }
+
+    // Count one download; false if the limit was reached meanwhile
+    static async consume(link) {
+        const result = await db.run(`
+            UPDATE share_links SET downloads_used = downloads_used + 1
+            WHERE id = ? AND (max_downloads IS NULL OR downloads_used < max_downloads)
+        `, [link.id]);
+        return result.changes > 0;
+    }
+}
+
+const VALID_ROLES = ['user', 'verified', 'admin'];
+
+// What each role may do, reported to clients by /auth/me so UIs can match the
+// server's checks. Roles differ otherwise only by upload quota.
+const USER_PERMISSIONS = ['files:upload', 'files:read', 'files:update', 'access:grant', 'groups:manage', 'rewards:claim'];
+const ROLE_PERMISSIONS = {
+    user: USER_PERMISSIONS,
+    verified: USER_PERMISSIONS,
+    admin: [...USER_PERMISSIONS, 'admin:roles', 'admin:events', 'admin:access_log']
+};
+// How long a signed request stays valid, e.g. AUTH_MAX_AGE=2m. Signed requests are
+// the server's only credential, so this is the effective session lifetime.
+const AUTH_MAX_AGE_MS = process.env.AUTH_MAX_AGE ? parseDuration(process.env.AUTH_MAX_AGE) : 5 * 60 * 1000;
+const AUTH_MAX_AGE_LIMIT_MS = 24 * 60 * 60 * 1000;
+
+// Authenticate from x-user-address / x-signature / x-timestamp headers. The
+// signature covers createAuthMessage(timestamp), which must be recent.
+function requireSignedRequest(req, res, next) {
+    const { userAddress, signature } = getRequestAuth(req);
+    // EventSource cannot set headers, so the timestamp may also come as ?timestamp=
+    const timestamp = req.headers['x-timestamp'] || req.query.timestamp;
+
+    if (!userAddress || !signature || !timestamp) {
+        return res.status(401).json({
+            success: false,
+            error: 'Authentication required: x-user-address, x-signature and x-timestamp headers'
+        });
+    }
+
+    if (!AuthService.isValidAddress(userAddress)) {
+        return res.status(400).json({
+            success: false,
+            error: 'Invalid Ethereum address format'
+        });
+    }
+
+    if (Math.abs(Date.now() - Number(timestamp)) > AUTH_MAX_AGE_MS) {
+        return res.status(401).json({
+            success: false,
+            error: 'Authentication timestamp expired'
+        });
+    }
+
+    if (!AuthService.verifySignature(userAddress, signature, AuthService.createAuthMessage(timestamp))) {
+        return res.status(401).json({
+            success: false,
+            error: 'Invalid signature'
+        });
+    }
+
+    req.user = {
+        address: userAddress,
+        authMethod: 'signature',
+        expiresAt: Number(timestamp) + AUTH_MAX_AGE_MS
+    };
+    next();
+}
+
+// Authenticate from "Authorization: Bearer <Privy token>" for the request's app.
+// The user is the token holder's embedded wallet.
+async function requirePrivyToken(req, res, next) {
+    const token = (req.headers.authorization || '').replace(/^Bearer\s+/i, '');
+
+    if (!PrivyService.isConfigured(req.appId)) {
+        return res.status(401).json({
+            success: false,
+            error: 'Privy authentication is not configured'
+        });
+    }
+
+    try {
+        const claims = await PrivyService.verifyToken(token, req.appId);
+        const address = await PrivyService.resolveWalletAddress(claims, req.appId);
+
+        if (!address) {
+            return res.status(403).json({
+                success: false,
+                error: 'Privy user has no linked wallet'
+            });
+        }
+
+        req.user = {
+            address,
+            authMethod: 'privy',
+            privyDid: claims.sub,
+            expiresAt: claims.exp * 1000
+        };
+        next();
+    } catch (error) {
+        // Expired: refresh and retry. Invalid: log in again. Anything else means the
+        // token could not be checked (e.g. Privy unreachable), which is not the client's fault.
+        if (error.code === 'EXPIRED_TOKEN' || error.code === 'INVALID_TOKEN') {
+            const expired = error.code === 'EXPIRED_TOKEN';
+            console.log(`🔑 Privy token rejected: ${error.message}`);
+            res.set('WWW-Authenticate', expired
+                ? 'Bearer error="invalid_token", error_description="The access token expired"'
+                : 'Bearer error="invalid_token"');
+            return res.status(401).json({
+                success: false,
+                error: expired ? 'Privy token expired' : 'Invalid Privy token',
+                code: error.code,
+                details: exposeErrorDetails() ? error.message : undefined
+            });
+        }
+
+        console.error('❌ Privy token verification failed:', error.message);
+        res.status(503).json({
+            success: false,
+            error: 'Privy token could not be verified, try again later',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+}
+
+// Either credential works: a Privy bearer token or the signed request headers
+function requireAuth(req, res, next) {
+    if (/^Bearer\s+/i.test(req.headers.authorization || '')) {
+        return requirePrivyToken(req, res, next);
+    }
+    return requireSignedRequest(req, res, next);
+}
+
+// Role is always resolved from user_roles, never taken from the request
+function requireRole(...roles) {
+    return async (req, res, next) => {
+        try {
+            const role = await getUserRole(req.user.address);
+            if (!roles.includes(role)) {
+                return res.status(403).json({
+                    success: false,
+                    error: 'Insufficient permissions'
+                });
+            }
+            req.user.role = role;
+            next();
+        } catch (error) {
+            next(error);
+        }
+    };
+}
+
+// Source-IP restriction for admin routes, checked before authentication.
+// ADMIN_IP_ALLOWLIST and ADMIN_IP_DENYLIST are comma-separated IPv4/IPv6 addresses
+// or CIDR ranges. The denylist wins; an empty allowlist allows every address.
+function parseIpList(name, raw) {
+    const list = new net.BlockList();
+    const entries = (raw || '').split(',').map(entry => entry.trim()).filter(Boolean);
+
+    for (const entry of entries) {
+        const [address, prefix] = entry.split('/');
+        const family = net.isIP(address);
+        const maxPrefix = family === 4 ? 32 : 128;
+        if (!family || (prefix !== undefined && (!/^\d+$/.test(prefix) || parseInt(prefix) > maxPrefix))) {
+            return { error: `${name} entry "${entry}" is not an IP address or CIDR range` };
+        }
+
+        const type = family === 4 ? 'ipv4' : 'ipv6';
+        if (prefix === undefined) {
+            list.addAddress(address, type);
+        } else {
+            list.addSubnet(address, parseInt(prefix), type);
+        }
+    }
+    return { value: entries.length > 0 ? list : null };
+}
+
+const adminIpAllowlist = parseIpList('ADMIN_IP_ALLOWLIST', process.env.ADMIN_IP_ALLOWLIST);
+const adminIpDenylist = parseIpList('ADMIN_IP_DENYLIST', process.env.ADMIN_IP_DENYLIST);
+
+function adminIpFilter(req, res, next) {
+    if (!adminIpAllowlist.value && !adminIpDenylist.value) {
+        return next();
+    }
+
+    // Dual-stack sockets report IPv4 peers as ::ffff:a.b.c.d
+    const ip = (req.ip || '').replace(/^::ffff:(?=\d+\.\d+\.\d+\.\d+$)/, '');
+    const type = net.isIP(ip) === 6 ? 'ipv6' : 'ipv4';
+    const allowed = net.isIP(ip) &&
+        !(adminIpDenylist.value && adminIpDenylist.value.check(ip, type)) &&
+        (!adminIpAllowlist.value || adminIpAllowlist.value.check(ip, type));
+
+    if (!allowed) {
+        console.log(`🚫 Admin request from ${req.ip} blocked by IP filter: ${req.method} ${req.path}`);
+        return res.status(403).json({
+            success: false,
+            error: 'Access from this address is not allowed'
+        });
+    }
+    next();
+}
+
+const requireAdmin = [adminIpFilter, requireAuth, requireRole('admin')];
+
+// Tenancy: each Privy app gets its own namespace of files, grants and keys.
+// Apps are configured as PRIVY_APP_ID/PRIVY_API_KEY plus APP_KEYS=app1:key1,app2:key2.
+// Requests without x-app-id use the default app, which holds all pre-tenancy data.
+const DEFAULT_APP_ID = 'default';
+const APP_CREDENTIALS = new Map(
+    [
+        ...(process.env.PRIVY_APP_ID && process.env.PRIVY_API_KEY
+            ? [[process.env.PRIVY_APP_ID, process.env.PRIVY_API_KEY]]
+            : []),
+        ...(process.env.APP_KEYS || '').split(',').map(entry => entry.trim()).filter(Boolean)
+            .map(entry => [entry.slice(0, entry.indexOf(':')).trim(), entry.slice(entry.indexOf(':') + 1).trim()])
+    ].filter(([appId, apiKey]) => appId && apiKey)
+);
+
+// Sets req.appId from x-app-id, which must come with that app's x-api-key
+function resolveTenant(req, res, next) {
+    const appId = req.headers['x-app-id'];
+    if (!appId) {
+        req.appId = DEFAULT_APP_ID;
+        return next();
+    }
+
+    const expected = APP_CREDENTIALS.get(appId);
+    const apiKey = req.headers['x-api-key'] || '';
+    const valid = expected && apiKey.length === expected.length &&
+        crypto.timingSafeEqual(Buffer.from(apiKey), Buffer.from(expected));
+
+    if (!valid) {
+        return res.status(401).json({
+            success: false,
+            error: 'Unknown app or invalid x-api-key'
+        });
+    }
+
+    req.appId = appId;
+    next();
+}
+
+app.use(resolveTenant);
+const IDEMPOTENCY_TTL_HOURS = parseInt(process.env.IDEMPOTENCY_TTL_HOURS) || 24;
+// A request still 'processing' after this long was abandoned (e.g. the server
+// restarted mid-request), so a retry may take the key over instead of getting 409
+const IDEMPOTENCY_PROCESSING_LEASE_SECONDS = parseInt(process.env.IDEMPOTENCY_PROCESSING_LEASE_SECONDS) || 300;
+
+// Replay the stored response when a request is retried with the same
+// Idempotency-Key, so network retries can't double-upload or double-claim.
+// Keys are scoped to the app and the caller, so clients can't collide with
+// (or replay) each other's responses. Mount after requireAuth.
+function idempotent(endpoint) {
+    return async (req, res, next) => {
+        const suppliedKey = req.headers['idempotency-key'];
+        if (!suppliedKey) {
+            return next();
+        }
+
+        if (suppliedKey.length > 255) {
+            return res.status(400).json({
+                success: false,
+                error: 'Idempotency-Key must be at most 255 characters'
+            });
+        }
+
+        const key = `${req.appId}:${(req.user?.address || '').toLowerCase()}:${suppliedKey}`;
+
+        try {
+            const requestHash = crypto.createHash('sha256').update(JSON.stringify(req.body || {})).digest('hex');
+
+            await db.run(`DELETE FROM idempotency_keys WHERE expires_at < datetime('now')`);
+
+            const existing = await db.get(
+                'SELECT * FROM idempotency_keys WHERE idempotency_key = ? AND endpoint = ?',
+                [key, endpoint]
+            );
+
+            if (existing) {
+                if (existing.request_hash !== requestHash) {
+                    return res.status(422).json({
+                        success: false,
+                        error: 'Idempotency-Key was already used with a different request'
+                    });
+                }
+
+                if (existing.status === 'processing') {
+                    // Only one retry can claim an abandoned key
+                    const takenOver = await db.run(`
+                        UPDATE idempotency_keys SET created_at = CURRENT_TIMESTAMP
+                        WHERE idempotency_key = ? AND endpoint = ? AND status = 'processing'
+                        AND created_at < datetime('now', '-' || ? || ' seconds')
+                    `, [key, endpoint, IDEMPOTENCY_PROCESSING_LEASE_SECONDS]);
+
+                    if (takenOver.changes === 0) {
+                        return res.status(409).json({
+                            success: false,
+                            error: 'A request with this Idempotency-Key is still in progress'
+                        });
+                    }
+                } else {
+                    res.set('Idempotent-Replayed', 'true');
+                    return res.status(existing.status_code).json(JSON.parse(existing.response_body));
+                }
+            } else {
+                await db.run(`
+                    INSERT INTO idempotency_keys (idempotency_key, endpoint, request_hash, status, expires_at)
+                    VALUES (?, ?, ?, 'processing', datetime('now', '+' || ? || ' hours'))
+                `, [key, endpoint, requestHash, IDEMPOTENCY_TTL_HOURS]);
+            }
+
+            const json = res.json;
+            res.json = function (body) {
+                res.json = json;
+
+                // Server errors are not cached so the client can retry them
+                const store = res.statusCode >= 500 ?
+                    db.run('DELETE FROM idempotency_keys WHERE idempotency_key = ? AND endpoint = ?', [key, endpoint]) :
+                    db.run(`
+                        UPDATE idempotency_keys SET status = 'completed', status_code = ?, response_body = ?
+                        WHERE idempotency_key = ? AND endpoint = ?
+                    `, [res.statusCode, JSON.stringify(body), key, endpoint]);
+
+                store.catch(error => console.error('❌ Failed to store idempotent response:', error.message));
+                return json.call(res, body);
+            };
+
+            next();
+        } catch (error) {
+            console.error('Idempotency error:', error);
+            res.status(500).json({
+                success: false,
+                error: 'Failed to process Idempotency-Key'
+            });
+        }
+    };
+}
+
+// API Routes
+
+// Health check
+// ?deep=true also probes the storage gateway (bounded by STORAGE_HEALTH_TIMEOUT_MS)
+app.get('/health', async (req, res) => {
+    const storageReachable = req.query.deep === 'true' ? await StorageService.ping() : undefined;
+
+    res.json({
+        success: true,
+        data: {
+            status: 'healthy',
+            service: 'privychain-backend',
+            version: '1.0.0',
+            timestamp: new Date().toISOString(),
+            w3up_ready: w3upClient !== null,
+            storage_provider: StorageService.provider?.name || (w3upClient ? 'w3up' : null),
+            storage_reachable: storageReachable,
+            database_ready: db !== null,
+            database_metrics: getDatabaseMetrics(),
+            contract_ready: contractService.isReady,
+            rpc_endpoint: contractService.activeRpcEndpoint(),
+            rpc_endpoints: contractService.endpointHealth().map(endpoint => ({
+                endpoint: endpoint.endpoint,
+                active: endpoint.active,
+                healthy: endpoint.healthy,
+                consecutive_failures: endpoint.consecutiveFailures,
+                last_failure_at: endpoint.lastFailureAt,
+                last_error: endpoint.lastError
+            })),
+            circuit_breakers: {
+                storage: storageBreaker.getState(),
+                rpc: rpcBreaker.getState()
+            },
+            environment: {
+                node_env: ENVIRONMENT,
+                has_web3_token: !!process.env.WEB3_STORAGE_TOKEN,
+                has_contract: !!process.env.CONTRACT_ADDRESS,
+                has_private_key: !!process.env.PRIVATE_KEY,
+                skip_signature_verification: process.env.SKIP_SIGNATURE_VERIFICATION === 'true'
+            }
+        }
+    });
+});
+
+// Prometheus text exposition of the database query counters
+app.get('/metrics', (req, res) => {
+    const lines = [
+        '# HELP privychain_db_queries_total Database queries executed.',
+        '# TYPE privychain_db_queries_total counter',
+        `privychain_db_queries_total ${dbMetrics.totalQueries}`,
+        '# HELP privychain_db_query_errors_total Database queries that failed.',
+        '# TYPE privychain_db_query_errors_total counter',
+        `privychain_db_query_errors_total ${dbMetrics.failedQueries}`,
+        `# HELP privychain_db_slow_queries_total Database queries slower than ${DB_SLOW_QUERY_MS}ms.`,
+        '# TYPE privychain_db_slow_queries_total counter',
+        `privychain_db_slow_queries_total ${dbMetrics.slowQueries}`,
+        '# HELP privychain_db_query_duration_seconds_sum Total time spent in database queries.',
+        '# TYPE privychain_db_query_duration_seconds_sum counter',
+        `privychain_db_query_duration_seconds_sum ${dbMetrics.totalDurationMs / 1000}`,
+        '# HELP privychain_db_pending_transactions Transactions queued or running on the database connection.',
+        '# TYPE privychain_db_pending_transactions gauge',
+        `privychain_db_pending_transactions ${dbMetrics.pendingTransactions}`,
+        '# HELP privychain_db_saturation_events_total Times a transaction queue threshold was crossed.',
+        '# TYPE privychain_db_saturation_events_total counter',
+        `privychain_db_saturation_events_total ${dbMetrics.saturationEvents}`
+    ];
+
+    res.type('text/plain; version=0.0.4').send(lines.join('\n') + '\n');
+});
+
+// Who the signed request authenticates as, its role, when the signature stops
+// being accepted and what the role allows
+app.get('/auth/me', requireAuth, async (req, res) => {
+    try {
+        const role = await getUserRole(req.user.address);
+        const quotas = UploadQuotaService.getQuotas(role);
+        const quotaValue = (value) => Number.isFinite(value) ? value : 'unlimited';
+
+        res.json({
+            success: true,
+            data: {
+                address: req.user.address.toLowerCase(),
+                role,
+                auth_method: req.user.authMethod,
+                privy_did: req.user.privyDid,
+                expires_at: new Date(req.user.expiresAt).toISOString(),
+                permissions: ROLE_PERMISSIONS[role] || ROLE_PERMISSIONS.user,
+                upload_quota: {
+                    daily_uploads: quotaValue(quotas.daily_uploads),
+                    daily_bytes: quotaValue(quotas.daily_bytes)
+                }
+            }
+        });
+
+    } catch (error) {
+        console.error('Auth introspection error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to resolve identity'
+        });
+    }
+});
+
+// File upload with automatic reward distribution
+app.post('/upload', requireAuth, idempotent('upload'), async (req, res) => {
+    try {
+        const { file, file_name } = req.body;
+        // Quotas, dedup and ownership all key on the uploader, so it is never taken from the body
+        const user_address = req.user.address;
+        
+        // Basic validation only
+        if (!file || !file_name) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required fields: file, file_name'
+            });
+        }
+
+        const options = parseUploadOptions({ ...req.body, user_address });
+        if (options.error) {
+            return res.status(400).json({
+                success: false,
+                error: options.error
+            });
+        }
+        
+        // Check if storage is ready
+        if (!StorageService.isConfigured()) {
+            return res.status(503).json({
+                success: false,
+                error: STORAGE_NOT_CONFIGURED,
+                code: 'STORAGE_NOT_CONFIGURED'
+            });
+        }
+        
+        console.log(`🔄 Processing upload: ${file_name} for ${user_address}`);
+        
+        // Convert base64 to buffer
+        let fileBuffer;
+        try {
+            fileBuffer = Buffer.from(file, 'base64');
+        } catch (error) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid base64 file data'
+            });
+        }
+        
+        return await storeUpload(req, res, fileBuffer, { ...options.value, keySignature: req.body.key_signature });
+
+    } catch (error) {
+        console.error('Upload error:', error);
+        sendError(res, 'Storage upload failed', error);
+    }
+});
+
+// Resumable uploads for large files over flaky connections:
+//   POST  /upload/session               same fields as /upload minus `file`, plus file_size
+//   PATCH /upload/session/:id           raw bytes (application/offset+octet-stream) with an
+//                                       Upload-Offset header equal to the bytes received so far
+//   GET   /upload/session/:id           current offset, to resume after a reconnect
+//   POST  /upload/session/:id/complete  stores the assembled file exactly like /upload
+// The session id is the capability for appending, so it is random and unguessable.
+const UPLOAD_SESSION_DIR = process.env.UPLOAD_SESSION_DIR || './upload-sessions';
+const UPLOAD_SESSION_TTL_HOURS = parseInt(process.env.UPLOAD_SESSION_TTL_HOURS) || 24;
+const UPLOAD_CHUNK_MAX_BYTES = parseInt(process.env.UPLOAD_CHUNK_MAX_BYTES) || 8 * 1024 * 1024;
+const UPLOAD_SESSION_MAX_BYTES = MAX_FILE_SIZE_BYTES;
+
+app.post('/upload/session', requireAuth, async (req, res) => {
+    try {
+        const { file_name, file_size } = req.body;
+        const user_address = req.user.address;
+
+        if (!file_name || file_size === undefined) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required fields: file_name, file_size'
+            });
+        }
+
+        if (!Number.isInteger(file_size) || file_size < 1 || file_size > UPLOAD_SESSION_MAX_BYTES) {
+            return res.status(400).json({
+                success: false,
+                error: `file_size must be between 1 and ${UPLOAD_SESSION_MAX_BYTES} bytes`
+            });
+        }
+
+        const options = parseUploadOptions({ ...req.body, user_address });
+        if (options.error) {
+            return res.status(400).json({
+                success: false,
+                error: options.error
+            });
+        }
+
+        await expireUploadSessions();
+        await fs.mkdir(UPLOAD_SESSION_DIR, { recursive: true });
+
+        const id = crypto.randomBytes(16).toString('hex');
+        const expiresAt = new Date(Date.now() + UPLOAD_SESSION_TTL_HOURS * 60 * 60 * 1000).toISOString();
+
+        await fs.writeFile(uploadSessionPath(id), Buffer.alloc(0));
+        await db.run(`
+            INSERT INTO upload_sessions (id, app_id, user_address, options, total_size, expires_at)
+            VALUES (?, ?, ?, ?, ?, ?)
+        `, [id, req.appId, user_address.toLowerCase(), JSON.stringify(options.value), file_size, expiresAt]);
+
+        console.log(`📦 Upload session ${id} opened for ${file_name} (${file_size} bytes)`);
+
+        res.status(201).json({
+            success: true,
+            data: {
+                id,
+                offset: 0,
+                file_size,
+                chunk_max_bytes: UPLOAD_CHUNK_MAX_BYTES,
+                expires_at: expiresAt
+            }
+        });
+
+    } catch (error) {
+        console.error('Create upload session error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to create upload session'
+        });
+    }
+});
+
+app.get('/upload/session/:id', async (req, res) => {
+    try {
+        const session = await getUploadSession(req.params.id, req.appId);
+
+        if (!session) {
+            return res.status(404).json({
+                success: false,
+                error: 'Upload session not found or expired'
+            });
+        }
+
+        res.set('Upload-Offset', String(session.received_bytes));
+        res.json({
+            success: true,
+            data: {
+                id: session.id,
+                status: session.status,
+                offset: session.received_bytes,
+                file_size: session.total_size,
+                expires_at: session.expires_at
+            }
+        });
+
+    } catch (error) {
+        console.error('Get upload session error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to load upload session'
+        });
+    }
+});
+
+app.patch('/upload/session/:id',
+    express.raw({ type: 'application/offset+octet-stream', limit: UPLOAD_CHUNK_MAX_BYTES }),
+    async (req, res) => {
+        try {
+            const session = await getUploadSession(req.params.id, req.appId);
+
+            if (!session || session.status !== 'open') {
+                return res.status(404).json({
+                    success: false,
+                    error: 'Upload session not found, expired or already completed'
+                });
+            }
+
+            if (!Buffer.isBuffer(req.body) || req.body.length === 0) {
+                return res.status(400).json({
+                    success: false,
+                    error: 'Send a non-empty chunk as application/offset+octet-stream'
+                });
+            }
+
+            const offset = Number(req.headers['upload-offset']);
+            if (!Number.isInteger(offset) || offset !== session.received_bytes) {
+                res.set('Upload-Offset', String(session.received_bytes));
+                return res.status(409).json({
+                    success: false,
+                    error: 'Upload-Offset does not match the bytes received so far',
+                    offset: session.received_bytes
+                });
+            }
+
+            if (offset + req.body.length > session.total_size) {
+                return res.status(400).json({
+                    success: false,
+                    error: 'Chunk extends past the declared file_size'
+                });
+            }
+
+            // Written at its offset, so a chunk retried after a lost response just
+            // overwrites itself; the conditional update stops two writers racing
+            const handle = await fs.open(uploadSessionPath(session.id), 'r+');
+            try {
+                await handle.write(req.body, 0, req.body.length, offset);
+            } finally {
+                await handle.close();
+            }
+
+            const newOffset = offset + req.body.length;
+            const result = await db.run(`
+                UPDATE upload_sessions SET received_bytes = ?, updated_at = CURRENT_TIMESTAMP
+                WHERE id = ? AND received_bytes = ? AND status = 'open'
+            `, [newOffset, session.id, offset]);
+
+            if (result.changes === 0) {
+                return res.status(409).json({
+                    success: false,
+                    error: 'Upload session changed concurrently - fetch the current offset and retry'
+                });
+            }
+
+            res.set('Upload-Offset', String(newOffset));
+            res.json({
+                success: true,
+                data: {
+                    id: session.id,
+                    offset: newOffset,
+                    file_size: session.total_size,
+                    complete: newOffset === session.total_size
+                }
+            });
+
+        } catch (error) {
+            console.error('Upload chunk error:', error);
+            res.status(500).json({
+                success: false,
+                error: 'Failed to store chunk'
+            });
+        }
+    }
+);
+
+app.post('/upload/session/:id/complete', requireAuth, async (req, res) => {
+    let session = null;
+    try {
+        session = await getUploadSession(req.params.id, req.appId);
+
+        if (!session || session.status !== 'open' || session.user_address !== req.user.address.toLowerCase()) {
+            return res.status(404).json({
+                success: false,
+                error: 'Upload session not found, expired or already completed'
+            });
+        }
+
+        if (session.received_bytes !== session.total_size) {
+            return res.status(409).json({
+                success: false,
+                error: `Upload incomplete: ${session.received_bytes} of ${session.total_size} bytes received`,
+                offset: session.received_bytes
+            });
+        }
+
+        if (!StorageService.isConfigured()) {
+            return res.status(503).json({
+                success: false,
+                error: STORAGE_NOT_CONFIGURED,
+                code: 'STORAGE_NOT_CONFIGURED'
+            });
+        }
+
+        // Claim the session so a duplicate complete can't store the file twice
+        const claimed = await db.run(
+            "UPDATE upload_sessions SET status = 'completing', updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'open'",
+            [session.id]
+        );
+        if (claimed.changes === 0) {
+            session = null;
+            return res.status(409).json({
+                success: false,
+                error: 'Upload session is already being completed'
+            });
+        }
+
+        const options = JSON.parse(session.options);
+        const fileBuffer = await fs.readFile(uploadSessionPath(session.id));
+        console.log(`📦 Completing upload session ${session.id}: ${options.file_name} for ${options.user_address}`);
+
+        await storeUpload(req, res, fileBuffer, { ...options, keySignature: req.body.key_signature });
+
+        // Failed validation (quota, key signature...) leaves the session open for another try
+        const completed = res.statusCode < 400;
+        await db.run(
+            'UPDATE upload_sessions SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?',
+            [completed ? 'completed' : 'open', session.id]
+        );
+        if (completed) {
+            await fs.rm(uploadSessionPath(session.id), { force: true });
+        }
+
+    } catch (error) {
+        console.error('Complete upload session error:', error);
+        if (session) {
+            await db.run("UPDATE upload_sessions SET status = 'open' WHERE id = ? AND status = 'completing'", [session.id])
+                .catch(() => {});
+        }
+        if (res.headersSent) return;
+        sendError(res, 'Storage upload failed', error);
+    }
+});
+
+// Upload several files as one UnixFS directory, e.g. a static site. Files come as
+// `files: [{ path, file (base64), content_type }]`; each is reachable at <root>/<path>.
+// The directory is recorded as one (unencrypted) file record with an entry per file,
+// and access grants apply to the directory as a whole.
+const DIRECTORY_MAX_FILES = parseInt(process.env.DIRECTORY_MAX_FILES) || 1000;
+
+app.post('/upload/directory', requireAuth, idempotent('upload_directory'), async (req, res) => {
+    try {
+        const { files, name } = req.body;
+        const user_address = req.user.address;
+
+        if (!Array.isArray(files) || files.length === 0) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required field: files (non-empty array)'
+            });
+        }
+
+        if (files.length > DIRECTORY_MAX_FILES) {
+            return res.status(400).json({
+                success: false,
+                error: `A directory may contain at most ${DIRECTORY_MAX_FILES} files`
+            });
+        }
+
+        const parsedMetadata = parseMetadata(req.body.metadata);
+        if (parsedMetadata.error) {
+            return res.status(400).json({
+                success: false,
+                error: parsedMetadata.error
+            });
+        }
+        const metadata = parsedMetadata.value;
+
+        if (!StorageService.isConfigured()) {
+            return res.status(503).json({
+                success: false,
+                error: STORAGE_NOT_CONFIGURED,
+                code: 'STORAGE_NOT_CONFIGURED'
+            });
+        }
+
+        const entries = [];
+        const seen = new Set();
+        for (const [index, entry] of files.entries()) {
+            const entryPath = normalizeDirectoryPath(entry && entry.path);
+            if (!entryPath || !entry.file) {
+                return res.status(400).json({
+                    success: false,
+                    error: `files[${index}] needs a relative path and base64 file data`
+                });
+            }
+            if (seen.has(entryPath)) {
+                return res.status(400).json({
+                    success: false,
+                    error: `Duplicate path: ${entryPath}`
+                });
+            }
+            seen.add(entryPath);
+            entries.push({ path: entryPath, data: Buffer.from(entry.file, 'base64'), contentType: entry.content_type || null });
+        }
+
+        const totalSize = entries.reduce((sum, entry) => sum + entry.data.length, 0);
+        if (totalSize > MAX_FILE_SIZE_BYTES) {
+            return res.status(413).json({
+                success: false,
+                error: `Directory size exceeds ${MAX_FILE_SIZE_LABEL} limit`,
+                code: 'FILE_TOO_LARGE'
+            });
+        }
+
+        for (const entry of entries) {
+            const rejected = await scanUpload(entry.data, { fileName: entry.path, contentType: entry.contentType, uploader: user_address });
+            if (rejected) {
+                return res.status(rejected.status).json({
+                    success: false,
+                    error: rejected.error,
+                    code: rejected.code,
+                    path: entry.path,
+                    reason: rejected.reason
+                });
+            }
+        }
+
+        const quota = await UploadQuotaService.check(user_address, totalSize);
+        if (quota.exceeded) {
+            return res.status(429).json({
+                success: false,
+                error: `Daily upload quota exceeded (${quota.exceeded.quota})`,
+                code: 'QUOTA_EXCEEDED',
+                details: quota.exceeded
+            });
+        }
+
+        const storageProvider = await StorageService.resolveProvider(user_address);
+        console.log(`📤 Uploading directory of ${entries.length} files (${totalSize} bytes) for ${user_address} to ${storageProvider}...`);
+        const cid = await StorageService.uploadDirectory(entries, {
+            provider: storageProvider,
+            signal: requestSignal(req, res)
+        });
+        console.log(`✅ Directory upload successful! CID: ${cid}`);
+
+        const existing = await db.get('SELECT * FROM file_records WHERE cid = ?', [cid]);
+        if (existing) {
+            return respondToExistingCid(req, res, existing, user_address);
+        }
+
+        const recordOnChain = BlockchainJobWorker.isEnabled();
+        const metadataSignature = await MetadataSigner.sign(cid, metadata);
+
+        const { inserted, jobId } = await withTransaction(async () => {
+            const result = await db.run(`
+                INSERT INTO file_records
+                (app_id, cid, cid_hash, uploader_addr, file_size, is_encrypted, is_directory, encryption_mode, file_name, content_type, metadata, status, storage_provider, metadata_signature, metadata_signer, metadata_signed_at)
+                VALUES (?, ?, ?, ?, ?, 0, 1, 'none', ?, NULL, ?, ?, ?, ?, ?, ?)
+                ON CONFLICT(cid) DO NOTHING
+            `, [
+                req.appId,
+                cid,
+                contractService.cidToBytes32(cid),
+                user_address,
+                totalSize,
+                sanitizeFileName(name || cid) || cid,
+                JSON.stringify(metadata),
+                recordOnChain ? 'pending' : 'confirmed',
+                storageProvider,
+                metadataSignature?.signature || null,
+                metadataSignature?.signer || null,
+                metadataSignature?.signedAt || null
+            ]);
+
+            // A concurrent upload of the same directory registered it first
+            if (result.changes === 0) {
+                return { inserted: false, jobId: null };
+            }
+
+            for (const entry of entries) {
+                await db.run(
+                    'INSERT INTO file_entries (parent_cid, path, file_size, content_type) VALUES (?, ?, ?, ?)',
+                    [cid, entry.path, entry.data.length, entry.contentType]
+                );
+            }
+
+            if (!recordOnChain) {
+                return { inserted: true, jobId: null };
+            }
+
+            return {
+                inserted: true,
+                jobId: await BlockchainJobWorker.enqueue(cid, 'record_upload', {
+                    file_size: totalSize,
+                    is_encrypted: false,
+                    metadata,
+                    uploader: user_address
+                })
+            };
+        });
+
+        if (!inserted) {
+            return respondToExistingCid(req, res, await db.get('SELECT * FROM file_records WHERE cid = ?', [cid]), user_address);
+        }
+
+        const jobResult = jobId ? await blockchainJobWorker.runUploadJob(jobId) : null;
+
+        res.json({
+            success: true,
+            data: {
+                cid,
+                file_size: totalSize,
+                is_directory: true,
+                files: entries.map(entry => ({
+                    path: entry.path,
+                    file_size: entry.data.length,
+                    gateway_url: `${StorageService.getGatewayUrl(cid)}/${entry.path.split('/').map(encodeURIComponent).join('/')}`
+                })),
+                status: !jobId || jobResult ? 'confirmed' : 'pending',
+                gateway_url: StorageService.getGatewayUrl(cid),
+                tx_hash: jobResult ? jobResult.txHash : null,
+                blockchain_stored: !!jobResult,
+                blockchain_job_id: jobId
+            }
+        });
+
+    } catch (error) {
+        console.error('Directory upload error:', error);
+        sendError(res, 'Directory upload failed', error);
+    }
+});
+
+// Upload a client-built CAR (base64 in `car`). The CAR must have a single root equal
+// to root_cid, which is what gets recorded - so clients can compute CIDs up front
+// and upload directories or other multi-block DAGs. Content is stored unencrypted.
+app.post('/upload/car', requireAuth, idempotent('upload_car'), async (req, res) => {
+    try {
+        const { car, root_cid, file_name, content_type } = req.body;
+        const user_address = req.user.address;
+
+        if (!car || !root_cid) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required fields: car, root_cid'
+            });
+        }
+
+        const parsedMetadata = parseMetadata(req.body.metadata);
+        if (parsedMetadata.error) {
+            return res.status(400).json({
+                success: false,
+                error: parsedMetadata.error
+            });
+        }
+        const metadata = parsedMetadata.value;
+
+        if (!StorageService.isConfigured()) {
+            return res.status(503).json({
+                success: false,
+                error: STORAGE_NOT_CONFIGURED,
+                code: 'STORAGE_NOT_CONFIGURED'
+            });
+        }
+
+        const carBuffer = Buffer.from(car, 'base64');
+        if (carBuffer.length > MAX_FILE_SIZE_BYTES) {
+            return res.status(413).json({
+                success: false,
+                error: `CAR size exceeds ${MAX_FILE_SIZE_LABEL} limit`,
+                code: 'FILE_TOO_LARGE'
+            });
+        }
+
+        let roots;
+        try {
+            roots = await StorageService.getCarRoots(carBuffer);
+        } catch (error) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid CAR file',
+                details: exposeErrorDetails() ? error.message : undefined
+            });
+        }
+
+        if (roots.length !== 1 || roots[0] !== root_cid) {
+            return res.status(400).json({
+                success: false,
+                error: 'CAR must have exactly one root matching root_cid',
+                roots
+            });
+        }
+
+        const rejected = await scanUpload(carBuffer, { fileName: file_name || `${root_cid}.car`, contentType: 'application/vnd.ipld.car', uploader: user_address });
+        if (rejected) {
+            return res.status(rejected.status).json({
+                success: false,
+                error: rejected.error,
+                code: rejected.code,
+                reason: rejected.reason
+            });
+        }
+
+        const existing = await db.get('SELECT * FROM file_records WHERE cid = ?', [root_cid]);
+        if (existing) {
+            return respondToExistingCid(req, res, existing, user_address);
+        }
+
+        const quota = await UploadQuotaService.check(user_address, carBuffer.length);
+        if (quota.exceeded) {
+            return res.status(429).json({
+                success: false,
+                error: `Daily upload quota exceeded (${quota.exceeded.quota})`,
+                code: 'QUOTA_EXCEEDED',
+                details: quota.exceeded
+            });
+        }
+
+        const storageProvider = await StorageService.resolveProvider(user_address);
+        console.log(`📤 Uploading CAR ${root_cid} (${carBuffer.length} bytes) for ${user_address} to ${storageProvider}...`);
+        const cid = await StorageService.uploadCAR(carBuffer, {
+            provider: storageProvider,
+            signal: requestSignal(req, res)
+        });
+        if (cid !== root_cid) {
+            console.error(`❌ Storage returned root ${cid} for CAR ${root_cid}`);
+            return res.status(502).json({
+                success: false,
+                error: 'Storage returned a different root CID'
+            });
+        }
+        console.log(`✅ CAR upload successful! CID: ${cid}`);
+
+        const recordOnChain = BlockchainJobWorker.isEnabled();
+        const metadataSignature = await MetadataSigner.sign(cid, metadata);
+
+        const { inserted, jobId } = await withTransaction(async () => {
+            const result = await db.run(`
+                INSERT INTO file_records
+                (app_id, cid, cid_hash, content_hash, uploader_addr, file_size, is_encrypted, encryption_mode, file_name, content_type, metadata, status, storage_provider, metadata_signature, metadata_signer, metadata_signed_at)
+                VALUES (?, ?, ?, ?, ?, ?, 0, 'none', ?, ?, ?, ?, ?, ?, ?, ?)
+                ON CONFLICT(cid) DO NOTHING
+            `, [
+                req.appId,
+                cid,
+                contractService.cidToBytes32(cid),
+                crypto.createHash('sha256').update(carBuffer).digest('hex'),
+                user_address,
+                carBuffer.length,
+                file_name || cid,
+                content_type || null,
+                JSON.stringify(metadata),
+                recordOnChain ? 'pending' : 'confirmed',
+                storageProvider,
+                metadataSignature?.signature || null,
+                metadataSignature?.signer || null,
+                metadataSignature?.signedAt || null
+            ]);
+
+            if (result.changes === 0 || !recordOnChain) {
+                return { inserted: result.changes > 0, jobId: null };
+            }
+
+            return {
+                inserted: true,
+                jobId: await BlockchainJobWorker.enqueue(cid, 'record_upload', {
+                    file_size: carBuffer.length,
+                    is_encrypted: false,
+                    metadata,
+                    uploader: user_address
+                })
+            };
+        });
+
+        if (!inserted) {
+            return respondToExistingCid(req, res, await db.get('SELECT * FROM file_records WHERE cid = ?', [cid]), user_address);
+        }
+
+        const jobResult = jobId ? await blockchainJobWorker.runUploadJob(jobId) : null;
+
+        res.json({
+            success: true,
+            data: {
+                cid,
+                file_size: carBuffer.length,
+                is_encrypted: false,
+                status: !jobId || jobResult ? 'confirmed' : 'pending',
+                gateway_url: StorageService.getGatewayUrl(cid),
+                tx_hash: jobResult ? jobResult.txHash : null,
+                blockchain_stored: !!jobResult,
+                blockchain_job_id: jobId,
+                reward_tx_hash: jobResult?.reward ? jobResult.reward.txHash : null
+            }
+        });
+
+    } catch (error) {
+        console.error('CAR upload error:', error);
+        sendError(res, 'CAR upload failed', error);
+    }
+});
+// File retrieval
+// Public files may be retrieved without credentials; everything else goes through
+// requireAuth, and the caller is always the authenticated address - never the body
+app.post('/retrieve', async (req, res, next) => {
+    try {
+        const { cid } = req.body;
+        req.publicFile = false;
+
+        if (cid && !getRequestAuth(req).userAddress && !req.headers.authorization) {
+            req.publicFile = !!(await db.get(
+                "SELECT 1 FROM file_records WHERE cid = ? AND app_id = ? AND visibility = 'public' AND deleted_at IS NULL",
+                [cid, req.appId]
+            ));
+        }
+
+        if (req.publicFile) {
+            return next();
+        }
+        requireAuth(req, res, next);
+    } catch (error) {
+        console.error('❌ Retrieve error:', error.message);
+        sendError(res, 'File retrieval failed', error);
+    }
+}, async (req, res) => {
+    try {
+        const { cid } = req.body;
+        const user_address = req.user ? req.user.address : null;
+        
+        console.log(`🔄 Retrieve request: ${cid} for ${user_address || 'anonymous'}`);
+        
+        if (!cid) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required field: cid'
+            });
+        }
+        
+        // Get file record
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL',
+            [cid, req.appId]
+        );
+        
+        if (!fileRecord) {
+            console.log(`❌ File not found in database: ${cid}`);
+            return res.status(404).json({
+                success: false,
+                error: 'File not found'
+            });
+        }
+        
+        console.log(`✅ File found in database: ${fileRecord.file_name}`);
+        
+        // Public files are open to anyone, but still logged
+        if (fileRecord.visibility === 'public') {
+            accessAuditLog.record(cid, user_address, 'retrieve', 'allowed', 'public');
+        } else {
+            // The file stopped being public between the precheck and here
+            if (!user_address) {
+                return res.status(401).json({
+                    success: false,
+                    error: 'Authentication required'
+                });
+            }
+
+            // Owner or a grantee with read permission; each grantee retrieval counts
+            // against the grant's download limit
+            const hasAccess = await checkFileAccess(cid, user_address, { appId: req.appId, action: 'retrieve', consume: true });
+            if (!hasAccess) {
+                console.log(`❌ Access denied for ${user_address}`);
+                return res.status(403).json({
+                    success: false,
+                    error: 'Access denied'
+                });
+            }
+
+            console.log(`✅ Access granted to ${user_address}`);
+        }
+        
+        const walletKey = await resolveWalletKey(fileRecord, req.body.key_signature, user_address);
+        if (walletKey.error) {
+            return res.status(walletKey.status).json({
+                success: false,
+                error: walletKey.error
+            });
+        }
+
+        // Retrieve from Web3.Storage
+        let fileData = await StorageService.retrieveFile(cid, {
+            provider: fileRecord.storage_provider,
+            signal: requestSignal(req, res),
+            onSource: (source) => res.set('X-Storage-Gateway', source)
+        });
+        
+        // Handle encryption (if file was encrypted)
+        if (fileRecord.is_encrypted) {
+            try {
+                fileData = await decryptFileContent(fileRecord, fileData, walletKey.key);
+            } catch (decryptError) {
+                console.error('❌ Decryption failed:', decryptError.message);
+                return res.status(500).json({
+                    success: false,
+                    error: 'Decryption failed'
+                });
+            }
+        }
+
+        // Same checks and decryption either way; only the response format differs.
+        // JSON stays the default for clients that send no (or a wildcard) Accept.
+        res.vary('Accept');
+        if (req.accepts(['application/json', 'application/octet-stream']) === 'application/octet-stream') {
+            console.log(`✅ File retrieval successful (binary): ${fileRecord.file_name}`);
+            return sendFileBody(req, res, Buffer.from(fileData), fileRecord);
+        }
+        
+        res.json({
+            success: true,
+            data: {
+                file: Buffer.from(fileData).toString('base64'),
+                file_name: fileRecord.file_name,
+                content_type: fileRecord.content_type,
+                metadata: fileRecord.metadata,
+                file_size: fileRecord.file_size,
+                is_encrypted: fileRecord.is_encrypted,
+                // Client-encrypted files come back as stored; the caller decrypts
+                encryption_mode: fileRecord.encryption_mode,
+                wrapped_key: fileRecord.wrapped_key
+            }
+        });
+        
+        console.log(`✅ File retrieval successful: ${fileRecord.file_name}`);
+        
+    } catch (error) {
+        console.error('❌ Retrieve error:', error.message);
+        sendError(res, 'File retrieval failed', error);
+    }
+});
+
+// Cheap precheck before a download: 200 with the file's metadata as headers when the
+// caller may read it, 401/403 when not, 404 for an unknown CID. Never has a body.
+// Public files need no credentials.
+function setFileMetadataHeaders(res, fileRecord, userAddress) {
+    res.set({
+        'X-File-Size': String(fileRecord.file_size),
+        'X-File-Content-Type': fileRecord.content_type || 'application/octet-stream',
+        'X-File-Encrypted': fileRecord.is_encrypted ? 'true' : 'false',
+        'X-File-Status': fileRecord.status,
+        'X-File-Visibility': fileRecord.visibility,
+        'X-File-Owner': String(!!userAddress && fileRecord.uploader_addr.toLowerCase() === userAddress.toLowerCase())
+    });
+}
+
+app.head('/files/:cid', async (req, res, next) => {
+    try {
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL',
+            [req.params.cid, req.appId]
+        );
+        if (!fileRecord) {
+            return res.status(404).end();
+        }
+
+        if (fileRecord.visibility === 'public' && !getRequestAuth(req).userAddress && !req.headers.authorization) {
+            setFileMetadataHeaders(res, fileRecord, null);
+            return res.status(200).end();
+        }
+
+        req.fileRecord = fileRecord;
+        next();
+    } catch (error) {
+        console.error('File HEAD error:', error.message);
+        res.status(500).end();
+    }
+}, requireAuth, async (req, res) => {
+    try {
+        const { fileRecord } = req;
+        const allowed = fileRecord.visibility === 'public' ||
+            await checkFileAccess(fileRecord.cid, req.user.address, { appId: req.appId, action: 'head' });
+        if (!allowed) {
+            return res.status(403).end();
+        }
+
+        setFileMetadataHeaders(res, fileRecord, req.user.address);
+        res.status(200).end();
+    } catch (error) {
+        console.error('File HEAD error:', error.message);
+        res.status(500).end();
+    }
+});
+
+// Preview before download: non-sensitive metadata for a CID received out of band.
+// Public files need no signature. For anything else the caller must be signed in and
+// have access; otherwise the answer is 404, the same as for a CID that isn't
+// recorded, so private files can't be probed for.
+function fileSummary(fileRecord) {
+    return {
+        cid: fileRecord.cid,
+        file_name: fileRecord.file_name,
+        file_size: fileRecord.file_size,
+        content_type: fileRecord.content_type || 'application/octet-stream',
+        is_encrypted: !!fileRecord.is_encrypted,
+        is_directory: !!fileRecord.is_directory,
+        owner: fileRecord.uploader_addr.toLowerCase(),
+        visibility: fileRecord.visibility,
+        created_at: fileRecord.created_at
+    };
+}
+
+app.get('/files/:cid/summary', async (req, res, next) => {
+    try {
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL',
+            [req.params.cid, req.appId]
+        );
+
+        const signed = !!(getRequestAuth(req).userAddress || req.headers.authorization);
+        if (!fileRecord || (fileRecord.visibility !== 'public' && !signed)) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found'
+            });
+        }
+
+        if (fileRecord.visibility === 'public' && !signed) {
+            return res.json({
+                success: true,
+                data: fileSummary(fileRecord)
+            });
+        }
+
+        req.fileRecord = fileRecord;
+        next();
+    } catch (error) {
+        console.error('File summary error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to load file summary'
+        });
+    }
+}, requireAuth, async (req, res) => {
+    try {
+        const { fileRecord } = req;
+        const allowed = fileRecord.visibility === 'public' ||
+            await checkFileAccess(fileRecord.cid, req.user.address, { appId: req.appId, action: 'summary' });
+        if (!allowed) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found'
+            });
+        }
+
+        res.json({
+            success: true,
+            data: fileSummary(fileRecord)
+        });
+    } catch (error) {
+        console.error('File summary error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to load file summary'
+        });
+    }
+});
+
+// Paths inside a directory upload; readable by anyone with access to the directory
+app.get('/files/:cid/entries', requireAuth, async (req, res) => {
+    try {
+        const { cid } = req.params;
+        const fileRecord = await db.get(
+            'SELECT cid, is_directory FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL',
+            [cid, req.appId]
+        );
+
+        if (!fileRecord || !fileRecord.is_directory) {
+            return res.status(404).json({
+                success: false,
+                error: 'Directory not found'
+            });
+        }
+
+        if (!(await checkFileAccess(cid, req.user.address, { appId: req.appId, action: 'list_entries' }))) {
+            return res.status(403).json({
+                success: false,
+                error: 'Access denied'
+            });
+        }
+
+        const entries = await db.all(
+            'SELECT path, file_size, content_type FROM file_entries WHERE parent_cid = ? ORDER BY path',
+            [cid]
+        );
+
+        res.json({
+            success: true,
+            data: {
+                cid,
+                entries: entries.map(entry => ({
+                    ...entry,
+                    gateway_url: `${StorageService.getGatewayUrl(cid)}/${entry.path.split('/').map(encodeURIComponent).join('/')}`
+                }))
+            }
+        });
+
+    } catch (error) {
+        console.error('List directory entries error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to list directory entries'
+        });
+    }
+});
+
+// Server-Sent Events stream of status transitions for one file. Sends the current
+// state on connect, then every change published for the CID. Owners and anyone with
+// access may subscribe; auth may be passed as query parameters for EventSource.
+const SSE_HEARTBEAT_MS = parseInt(process.env.SSE_HEARTBEAT_MS) || 25000;
+
+app.get('/files/:cid/events', requireAuth, async (req, res) => {
+    try {
+        const { cid } = req.params;
+        const fileRecord = await db.get(
+            'SELECT cid, status, tx_hash, reward_claimed, reward_tx_hash FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL',
+            [cid, req.appId]
+        );
+
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found'
+            });
+        }
+
+        if (!(await checkFileAccess(cid, req.user.address, { appId: req.appId, action: 'subscribe_events' }))) {
+            return res.status(403).json({
+                success: false,
+                error: 'Access denied'
+            });
+        }
+
+        res.set({
+            'Content-Type': 'text/event-stream',
+            'Cache-Control': 'no-cache',
+            'Connection': 'keep-alive',
+            'X-Accel-Buffering': 'no'
+        });
+        res.flushHeaders();
+
+        const send = (event) => {
+            res.write(`event: ${event.type}\ndata: ${JSON.stringify(event)}\n\n`);
+        };
+
+        // Current state first, so a late subscriber does not miss a transition
+        send({
+            type: 'status',
+            cid,
+            data: {
+                status: fileRecord.status,
+                tx_hash: fileRecord.tx_hash,
+                reward_claimed: !!fileRecord.reward_claimed,
+                reward_tx_hash: fileRecord.reward_tx_hash
+            },
+            at: new Date().toISOString()
+        });
+
+        const unsubscribe = fileEventBroker.subscribe(cid, send);
+        const heartbeat = setInterval(() => res.write(': keep-alive\n\n'), SSE_HEARTBEAT_MS);
+
+        req.on('close', () => {
+            clearInterval(heartbeat);
+            unsubscribe();
+        });
+
+    } catch (error) {
+        console.error('File events error:', error);
+        if (res.headersSent) return res.end();
+        res.status(500).json({
+            success: false,
+            error: 'Failed to open event stream'
+        });
+    }
+});
+
+const DOWNLOAD_CACHE_MAX_AGE_SECONDS = parseInt(process.env.DOWNLOAD_CACHE_MAX_AGE_SECONDS) || 365 * 24 * 60 * 60;
+
+// Binary file download - streams the (decrypted) bytes instead of base64 JSON.
+// Auth is requireAuth (signed request headers or a Privy token), or a share link:
+// ?share=<token>, plus x-share-password (or ?password=) if set. Public files need neither.
+app.get('/files/:cid/download', async (req, res, next) => {
+    try {
+        const { cid } = req.params;
+        req.shareLink = null;
+        req.publicFile = false;
+
+        if (!req.query.share && !getRequestAuth(req).userAddress && !req.headers.authorization) {
+            req.publicFile = !!(await db.get(
+                "SELECT 1 FROM file_records WHERE cid = ? AND app_id = ? AND visibility = 'public' AND deleted_at IS NULL",
+                [cid, req.appId]
+            ));
+        }
+
+        if (req.publicFile) {
+            // Anonymous download; access is logged below
+            return next();
+        }
+        if (req.query.share) {
+            const authorized = await ShareLinkService.authorize(
+                req.query.share, cid, req.headers['x-share-password'] || req.query.password
+            );
+            if (authorized.error) {
+                accessAuditLog.record(cid, 'share_link', 'download', 'denied', authorized.error);
+                return res.status(authorized.status).json({
+                    success: false,
+                    error: authorized.error
+                });
+            }
+            req.shareLink = authorized.link;
+            return next();
+        }
+        requireAuth(req, res, next);
+    } catch (error) {
+        console.error('❌ Download error:', error.message);
+        sendError(res, 'File download failed', error);
+    }
+}, async (req, res) => {
+    try {
+        const { cid } = req.params;
+        const { shareLink, publicFile } = req;
+        const userAddress = req.user ? req.user.address : null;
+
+        // Link recipients usually send no x-app-id; the link knows its app
+        const appId = shareLink ? shareLink.app_id : req.appId;
+        const fileRecord = await db.get('SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL', [cid, appId]);
+
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found'
+            });
+        }
+
+        // Only whole downloads (or ranged reads starting at byte 0) use up a limited grant
+        // or link; revalidating a cached copy doesn't
+        const notModified = isNotModified(req, fileRecord);
+        const consume = !notModified && (!req.headers.range || /^bytes=0-/.test(req.headers.range));
+        if (publicFile) {
+            accessAuditLog.record(cid, null, 'download', 'allowed', 'public');
+        } else if (shareLink) {
+            const allowed = !consume || await ShareLinkService.consume(shareLink);
+            accessAuditLog.record(cid, `share_link:${shareLink.id}`, 'download', allowed ? 'allowed' : 'denied',
+                allowed ? 'share_link' : 'download_limit_reached');
+            if (!allowed) {
+                return res.status(403).json({
+                    success: false,
+                    error: 'Share link download limit reached'
+                });
+            }
+        } else if (!(await checkFileAccess(cid, userAddress, { signal: requestSignal(req, res), appId, action: 'download', consume }))) {
+            return res.status(403).json({
+                success: false,
+                error: 'Access denied'
+            });
+        }
+
+        if (notModified) {
+            setFileHeaders(res, fileRecord);
+            return res.status(304).end();
+        }
+
+        const walletKey = await resolveWalletKey(fileRecord, req.headers['x-key-signature'], shareLink ? null : userAddress);
+        if (walletKey.error) {
+            return res.status(walletKey.status).json({
+                success: false,
+                error: walletKey.error
+            });
+        }
+
+        // file_size is the plaintext size, so ranges can be validated before fetching
+        const range = parseRangeHeader(req.headers.range, fileRecord.file_size);
+
+        if (range === false) {
+            setFileHeaders(res, fileRecord);
+            res.set('Content-Range', `bytes */${fileRecord.file_size}`);
+            return res.status(416).end();
+        }
+
+        // Plaintext files can be ranged at the storage layer; encrypted ones have to
+        // be fetched and decrypted whole since the GCM tag covers the full ciphertext
+        if (range && !fileRecord.is_encrypted) {
+            const chunk = await StorageService.retrieveRange(cid, range.start, range.end, {
+                provider: fileRecord.storage_provider,
+                signal: requestSignal(req, res),
+                onSource: (source) => res.set('X-Storage-Gateway', source)
+            });
+            return sendFileRange(res, chunk, range, fileRecord.file_size, fileRecord);
+        }
+
+        let fileData = await StorageService.retrieveFile(cid, {
+            provider: fileRecord.storage_provider,
+            signal: requestSignal(req, res),
+            onSource: (source) => res.set('X-Storage-Gateway', source)
+        });
+
+        if (fileRecord.is_encrypted) {
+            fileData = await decryptFileContent(fileRecord, fileData, walletKey.key);
+        }
+
+        sendFileBody(req, res, fileData, fileRecord);
+
+    } catch (error) {
+        console.error('❌ Download error:', error.message);
+        sendError(res, 'File download failed', error);
+    }
+});
+
+// Mint a time-limited download link for a file the caller owns. Recipients need no
+// wallet: the link alone (plus the password, if one was set) authorizes downloads.
+app.post('/files/:cid/share-link', requireAuth, async (req, res) => {
+    try {
+        const { cid } = req.params;
+        const { password } = req.body;
+
+        if (!ShareLinkService.isEnabled()) {
+            return res.status(503).json({
+                success: false,
+                error: 'Share links are not configured'
+            });
+        }
+
+        const expiresIn = req.body.expires_in ?? SHARE_LINK_DEFAULT_TTL_SECONDS;
+        if (!Number.isInteger(expiresIn) || expiresIn < 1 || expiresIn > SHARE_LINK_MAX_TTL_SECONDS) {
+            return res.status(400).json({
+                success: false,
+                error: `expires_in must be between 1 and ${SHARE_LINK_MAX_TTL_SECONDS} seconds`
+            });
+        }
+
+        const maxDownloads = req.body.max_downloads ?? null;
+        if (maxDownloads !== null && (!Number.isInteger(maxDownloads) || maxDownloads < 1)) {
+            return res.status(400).json({
+                success: false,
+                error: 'max_downloads must be a positive integer'
+            });
+        }
+
+        if (password !== undefined && (typeof password !== 'string' || password.length === 0)) {
+            return res.status(400).json({
+                success: false,
+                error: 'password must be a non-empty string'
+            });
+        }
+
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND LOWER(uploader_addr) = LOWER(?) AND deleted_at IS NULL',
+            [cid, req.appId, req.user.address]
+        );
+
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found or not owned by user'
+            });
+        }
+
+        // The server can't open wallet-encrypted files without the owner's signature
+        if (fileRecord.encryption_mode === 'wallet') {
+            return res.status(422).json({
+                success: false,
+                error: 'Wallet-encrypted files cannot be shared by link'
+            });
+        }
+
+        const link = await ShareLinkService.create(fileRecord, req.user.address, { expiresIn, password, maxDownloads });
+        const token = ShareLinkService.createToken(link);
+        const baseUrl = process.env.PUBLIC_BASE_URL || `${req.protocol}://${req.get('host')}`;
+
+        accessAuditLog.record(cid, req.user.address, 'share_link', 'allowed', `link=${link.id}; expires_at=${link.expires_at}`);
+
+        res.json({
+            success: true,
+            data: {
+                id: link.id,
+                url: `${baseUrl}/files/${encodeURIComponent(cid)}/download?share=${token}`,
+                token,
+                expires_at: link.expires_at,
+                max_downloads: maxDownloads,
+                password_protected: !!password
+            }
+        });
+
+    } catch (error) {
+        console.error('Create share link error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to create share link',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Grant access
+// Simplified access grant endpoint - replace the existing /access/grant route
+
+app.post('/access/grant', requireAuth, idempotent('access_grant'), async (req, res) => {
+    try {
+        const { cid, duration, group_id } = req.body;
+        const granter = req.user.address;
+        
+        // Basic validation only - a grant targets either one grantee or a group
+        if (!cid || (!req.body.grantee && !group_id)) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required fields: cid and one of grantee or group_id'
+            });
+        }
+        if (req.body.grantee && group_id) {
+            return res.status(400).json({
+                success: false,
+                error: 'Specify either grantee or group_id, not both'
+            });
+        }
+        
+        if (req.body.grantee && !AuthService.isValidAddress(req.body.grantee)) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid grantee address format'
+            });
+        }
+
+        // Only the group's owner can grant to it
+        const group = group_id ? await getOwnedGroup(group_id, granter) : null;
+        if (group_id && !group) {
+            return res.status(404).json({
+                success: false,
+                error: 'Group not found or not owned by granter'
+            });
+        }
+
+        // Audit/log label for whoever receives the grant
+        const grantee = group ? `group:${group.id}` : req.body.grantee;
+
+        const permissions = parseGrantPermissions(req.body.permissions);
+        if (permissions.error) {
+            return res.status(400).json({
+                success: false,
+                error: permissions.error
+            });
+        }
+
+        const maxDownloads = req.body.max_downloads ?? null;
+        if (maxDownloads !== null && (!Number.isInteger(maxDownloads) || maxDownloads < 1)) {
+            return res.status(400).json({
+                success: false,
+                error: 'max_downloads must be a positive integer'
+            });
+        }
+
+        const grantDuration = parseGrantDuration(duration, req.body.permanent);
+        if (grantDuration.error) {
+            return res.status(400).json({
+                success: false,
+                error: grantDuration.error
+            });
+        }
+        
+        // Check if granter owns the file
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND LOWER(uploader_addr) = LOWER(?) AND app_id = ? AND deleted_at IS NULL',
+            [cid, granter, req.appId]
+        );
+
+        // Grantees holding the reshare permission may pass on what they hold
+        const reshareGrant = fileRecord ? null : await findActiveGrant(cid, granter, 'reshare', req.appId);
+        
+        if (!fileRecord && !reshareGrant) {
+            accessAuditLog.record(cid, granter, 'grant', 'denied', `not_owner; grantee=${grantee.toLowerCase()}`);
+            return res.status(403).json({
+                success: false,
+                error: 'Not authorized to grant access - file not found or not owned by granter'
+            });
+        }
+
+        const escrow = await escrowFileKeyForGrant(
+            fileRecord || await db.get('SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL', [cid, req.appId]),
+            req.body.key_signature,
+            reshareGrant
+        );
+        if (escrow.error) {
+            return res.status(escrow.status).json({
+                success: false,
+                error: escrow.error
+            });
+        }
+
+        if (reshareGrant) {
+            const held = reshareGrant.permissions.split(',');
+            const missing = permissions.value.filter(permission => !held.includes(permission));
+            if (missing.length > 0) {
+                accessAuditLog.record(cid, granter, 'grant', 'denied', `permissions_not_held=${missing.join(',')}; grantee=${grantee.toLowerCase()}`);
+                return res.status(403).json({
+                    success: false,
+                    error: `Cannot grant permissions you do not hold: ${missing.join(', ')}`
+                });
+            }
+        }
+
+        // The contract only knows plain read access, so owner grants without a
+        // download limit are mirrored on-chain; anything narrower stays in the database
+        // where it can be enforced.
+        // Group grants stay off-chain too; avoiding a transaction per member is their point.
+        const mirrorOnChain = !group && !reshareGrant && maxDownloads === null && permissions.value.includes('read');
+        
+        // Grant access on blockchain (optional)
+        let blockchainTxHash = null;
+        try {
+            if (mirrorOnChain && contractService.isContractReady()) {
+                blockchainTxHash = await contractService.grantFileAccess(
+                    cid, grantee, grantDuration.value, { signal: requestSignal(req, res) }
+                );
+            }
+        } catch (error) {
+            console.log('⚠️ Blockchain access grant failed, continuing with database only:', error.message);
+        }
+        
+        // Create access grant in database
+        let expiresAt = grantExpiresAt(grantDuration.value);
+
+        // A re-shared grant cannot outlive the grant it came from
+        if (reshareGrant && reshareGrant.expires_at && reshareGrant.expires_at < expiresAt) {
+            expiresAt = reshareGrant.expires_at;
+        }
+        
+        await db.run(`
+            INSERT INTO access_grants (app_id, cid, granter_addr, grantee_addr, group_id, expires_at, is_active, permissions, max_downloads, wrapped_file_key, file_key_wrapping)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `, [
+            req.appId, cid, granter, group ? '' : grantee, group ? group.id : null, expiresAt, 1,
+            permissions.value.join(','), maxDownloads, escrow.value?.wrapped || null, escrow.value?.wrapping || null
+        ]);
+        fileEventBroker.publish(cid, 'access_granted', {
+            grantee: group ? null : grantee.toLowerCase(),
+            group_id: group ? group.id : null,
+            permissions: permissions.value,
+            expires_at: expiresAt
+        });
+        accessAuditLog.record(
+            cid, granter, 'grant', 'allowed',
+            `${reshareGrant ? 'reshare' : 'owner'}; grantee=${grantee.toLowerCase()}; permissions=${permissions.value.join(',')}; expires_at=${expiresAt}`
+        );
+        
+        res.json({
+            success: true,
+            data: {
+                cid,
+                grantee: group ? null : grantee,
+                group_id: group ? group.id : null,
+                permissions: permissions.value,
+                max_downloads: maxDownloads,
+                expires_at: expiresAt,
+                granted_at: new Date().toISOString(),
+                blockchain_tx: blockchainTxHash
+            }
+        });
+        
+    } catch (error) {
+        console.error('Grant access error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to grant access',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Share one file with many addresses. Each entry in grantees is an address or
+// { address, duration, permanent }; both fall back to the request's. Invalid entries are
+// reported per grantee and the rest are granted, unless atomic is true. Valid grants
+// are written in one transaction and mirrored on-chain in one batchGrantAccess call.
+const BULK_GRANT_MAX_GRANTEES = parseInt(process.env.BULK_GRANT_MAX_GRANTEES) || 100;
+
+app.post('/access/grant-bulk', requireAuth, idempotent('access_grant_bulk'), async (req, res) => {
+    try {
+        const { cid, grantees, duration, permanent, atomic } = req.body;
+        const granter = req.user.address;
+
+        if (!cid || !Array.isArray(grantees) || grantees.length === 0) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required fields: cid and a non-empty grantees array'
+            });
+        }
+        if (grantees.length > BULK_GRANT_MAX_GRANTEES) {
+            return res.status(400).json({
+                success: false,
+                error: `At most ${BULK_GRANT_MAX_GRANTEES} grantees per request`
+            });
+        }
+
+        const permissions = parseGrantPermissions(req.body.permissions);
+        if (permissions.error) {
+            return res.status(400).json({
+                success: false,
+                error: permissions.error
+            });
+        }
+
+        const maxDownloads = req.body.max_downloads ?? null;
+        if (maxDownloads !== null && (!Number.isInteger(maxDownloads) || maxDownloads < 1)) {
+            return res.status(400).json({
+                success: false,
+                error: 'max_downloads must be a positive integer'
+            });
+        }
+
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND LOWER(uploader_addr) = LOWER(?) AND deleted_at IS NULL',
+            [cid, req.appId, granter]
+        );
+        if (!fileRecord) {
+            accessAuditLog.record(cid, granter, 'grant', 'denied', `not_owner; bulk=${grantees.length}`);
+            return res.status(403).json({
+                success: false,
+                error: 'Not authorized to grant access - file not found or not owned by granter'
+            });
+        }
+
+        const escrow = await escrowFileKeyForGrant(fileRecord, req.body.key_signature);
+        if (escrow.error) {
+            return res.status(escrow.status).json({
+                success: false,
+                error: escrow.error
+            });
+        }
+
+        const seen = new Set();
+        const results = grantees.map(entry => {
+            const address = typeof entry === 'string' ? entry : entry?.address;
+            const own = typeof entry === 'object' && entry !== null &&
+                (entry.duration !== undefined || entry.permanent !== undefined);
+            const entryDuration = own ? parseGrantDuration(entry.duration, entry.permanent) : parseGrantDuration(duration, permanent);
+
+            if (!AuthService.isValidAddress(address)) {
+                return { grantee: address ?? null, success: false, error: 'Invalid grantee address format' };
+            }
+            if (address.toLowerCase() === granter.toLowerCase()) {
+                return { grantee: address, success: false, error: 'Cannot grant access to yourself' };
+            }
+            if (seen.has(address.toLowerCase())) {
+                return { grantee: address, success: false, error: 'Duplicate grantee' };
+            }
+            if (entryDuration.error) {
+                return { grantee: address, success: false, error: entryDuration.error };
+            }
+
+            seen.add(address.toLowerCase());
+            return { grantee: address, success: true, duration: entryDuration.value };
+        });
+
+        const valid = results.filter(result => result.success);
+        if (valid.length === 0 || (atomic === true && valid.length < results.length)) {
+            return res.status(400).json({
+                success: false,
+                error: valid.length === 0 ? 'No valid grantees' : 'Some grantees are invalid and atomic was requested',
+                data: { results }
+            });
+        }
+
+        for (const result of valid) {
+            result.expires_at = grantExpiresAt(result.duration);
+        }
+
+        await withTransaction(async () => {
+            for (const result of valid) {
+                await db.run(`
+                    INSERT INTO access_grants (app_id, cid, granter_addr, grantee_addr, group_id, expires_at, is_active, permissions, max_downloads, wrapped_file_key, file_key_wrapping)
+                    VALUES (?, ?, ?, ?, NULL, ?, 1, ?, ?, ?, ?)
+                `, [
+                    req.appId, cid, granter, result.grantee, result.expires_at, permissions.value.join(','), maxDownloads,
+                    escrow.value?.wrapped || null, escrow.value?.wrapping || null
+                ]);
+            }
+        });
+
+        for (const result of valid) {
+            fileEventBroker.publish(cid, 'access_granted', {
+                grantee: result.grantee.toLowerCase(),
+                group_id: null,
+                permissions: permissions.value,
+                expires_at: result.expires_at
+            });
+            accessAuditLog.record(
+                cid, granter, 'grant', 'allowed',
+                `owner; bulk; grantee=${result.grantee.toLowerCase()}; permissions=${permissions.value.join(',')}; expires_at=${result.expires_at}`
+            );
+        }
+
+        // Mirrored on-chain under the same rules as /access/grant, in one transaction
+        let blockchainTxHash = null;
+        if (maxDownloads === null && permissions.value.includes('read') && contractService.isContractReady()) {
+            try {
+                blockchainTxHash = await contractService.grantFileAccessBatch(
+                    cid,
+                    valid.map(result => result.grantee),
+                    valid.map(result => result.duration),
+                    { signal: requestSignal(req, res) }
+                );
+            } catch (error) {
+                console.log('⚠️ Blockchain bulk access grant failed, continuing with database only:', error.message);
+            }
+        }
+
+        res.json({
+            success: true,
+            data: {
+                cid,
+                granted: valid.length,
+                failed: results.length - valid.length,
+                permissions: permissions.value,
+                max_downloads: maxDownloads,
+                results: results.map(({ duration: _duration, ...result }) => result),
+                blockchain_tx: blockchainTxHash
+            }
+        });
+
+    } catch (error) {
+        console.error('Bulk grant access error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to grant access',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Extending a grant can push its expiry at most this far past now
+const MAX_GRANT_DURATION_SECONDS = parseInt(process.env.MAX_GRANT_DURATION_SECONDS) || 365 * 24 * 60 * 60;
+
+// Push an active grant's expiry out by duration seconds instead of revoking and
+// re-granting, so the grant keeps its id, permissions and download count. Only the
+// file owner may extend. A lapsed grant is extended from now.
+app.post('/access/extend', requireAuth, async (req, res) => {
+    try {
+        const { cid, grantee, group_id, duration } = req.body;
+
+        if (!cid || (!grantee && !group_id) || (grantee && group_id)) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required fields: cid and one of grantee or group_id'
+            });
+        }
+        if (grantee && !AuthService.isValidAddress(grantee)) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid grantee address format'
+            });
+        }
+        if (!Number.isInteger(duration) || duration < 1) {
+            return res.status(400).json({
+                success: false,
+                error: 'duration must be a positive number of seconds'
+            });
+        }
+
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND LOWER(uploader_addr) = LOWER(?) AND deleted_at IS NULL',
+            [cid, req.appId, req.user.address]
+        );
+
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found or not owned by user'
+            });
+        }
+
+        const grant = await db.get(`
+            SELECT * FROM access_grants
+            WHERE cid = ? AND app_id = ? AND is_active = 1
+            AND ${group_id ? 'group_id = ?' : 'LOWER(grantee_addr) = LOWER(?)'}
+            ORDER BY id DESC LIMIT 1
+        `, [cid, req.appId, group_id ? parseInt(group_id) : grantee]);
+
+        if (!grant) {
+            return res.status(404).json({
+                success: false,
+                error: 'No active grant found for this grantee'
+            });
+        }
+        if (grant.expires_at >= PERMANENT_GRANT_EXPIRY) {
+            return res.status(409).json({
+                success: false,
+                error: 'Grant does not expire'
+            });
+        }
+
+        const now = Date.now();
+        const base = Math.max(new Date(grant.expires_at).getTime(), now);
+        const expiresAt = new Date(base + duration * 1000).toISOString();
+
+        if (new Date(expiresAt).getTime() > now + MAX_GRANT_DURATION_SECONDS * 1000) {
+            return res.status(400).json({
+                success: false,
+                error: `Grants cannot be extended more than ${MAX_GRANT_DURATION_SECONDS} seconds past now`
+            });
+        }
+
+        // Grants that /access/grant mirrors on-chain are renewed there too; the contract
+        // takes a duration from now
+        const onChain = !grant.group_id && grant.max_downloads === null &&
+            grant.permissions.split(',').includes('read');
+        let blockchainTxHash = null;
+        try {
+            if (onChain && contractService.isContractReady()) {
+                blockchainTxHash = await contractService.grantFileAccess(
+                    cid, grant.grantee_addr, Math.ceil((new Date(expiresAt).getTime() - now) / 1000),
+                    { signal: requestSignal(req, res) }
+                );
+            }
+        } catch (error) {
+            console.log('⚠️ Blockchain access extension failed, continuing with database only:', error.message);
+        }
+
+        await db.run(
+            'UPDATE access_grants SET expires_at = ?, expiry_notified_at = NULL WHERE id = ?',
+            [expiresAt, grant.id]
+        );
+
+        const label = grant.group_id ? `group:${grant.group_id}` : grant.grantee_addr.toLowerCase();
+        fileEventBroker.publish(cid, 'access_extended', {
+            grantee: grant.group_id ? null : grant.grantee_addr.toLowerCase(),
+            group_id: grant.group_id,
+            previous_expires_at: grant.expires_at,
+            expires_at: expiresAt
+        });
+        accessAuditLog.record(
+            cid, req.user.address, 'extend', 'allowed',
+            `grantee=${label}; expires_at=${expiresAt}; previous=${grant.expires_at}`
+        );
+
+        res.json({
+            success: true,
+            data: {
+                cid,
+                grant_id: grant.id,
+                grantee: grant.group_id ? null : grant.grantee_addr,
+                group_id: grant.group_id,
+                previous_expires_at: grant.expires_at,
+                expires_at: expiresAt,
+                blockchain_tx: blockchainTxHash
+            }
+        });
+
+    } catch (error) {
+        console.error('Extend access error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to extend access',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Access groups - named sets of addresses that can be granted access in one call.
+// Groups belong to the signed-in address that created them.
+app.post('/groups', requireAuth, async (req, res) => {
+    try {
+        const { name } = req.body;
+        const members = parseMemberList(req.body.members || []);
+
+        if (!name || typeof name !== 'string' || name.length > 100) {
+            return res.status(400).json({
+                success: false,
+                error: 'name is required (max 100 characters)'
+            });
+        }
+        if (members.error) {
+            return res.status(400).json({
+                success: false,
+                error: members.error
+            });
+        }
+
+        const owner = req.user.address.toLowerCase();
+        const existing = await db.get(
+            'SELECT id FROM access_groups WHERE owner_addr = ? AND name = ?',
+            [owner, name]
+        );
+        if (existing) {
+            return res.status(409).json({
+                success: false,
+                error: 'A group with this name already exists',
+                group_id: existing.id
+            });
+        }
+
+        const groupId = await withTransaction(async () => {
+            const result = await db.run(
+                'INSERT INTO access_groups (name, owner_addr) VALUES (?, ?)',
+                [name, owner]
+            );
+            for (const member of members.value) {
+                await db.run(
+                    'INSERT OR IGNORE INTO access_group_members (group_id, member_addr) VALUES (?, ?)',
+                    [result.lastID, member]
+                );
+            }
+            return result.lastID;
+        });
+
+        res.status(201).json({
+            success: true,
+            data: {
+                group_id: groupId,
+                name,
+                owner,
+                members: members.value
+            }
+        });
+
+    } catch (error) {
+        console.error('Create group error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to create group',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+app.get('/groups', requireAuth, async (req, res) => {
+    try {
+        const groups = await db.all(`
+            SELECT g.id, g.name, g.created_at, COUNT(m.member_addr) AS member_count
+            FROM access_groups g
+            LEFT JOIN access_group_members m ON m.group_id = g.id
+            WHERE g.owner_addr = ?
+            GROUP BY g.id
+            ORDER BY g.created_at DESC, g.id DESC
+        `, [req.user.address.toLowerCase()]);
+
+        res.json({
+            success: true,
+            data: { groups }
+        });
+
+    } catch (error) {
+        console.error('List groups error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to list groups'
+        });
+    }
+});
+
+app.get('/groups/:groupId', requireAuth, async (req, res) => {
+    try {
+        const group = await getOwnedGroup(req.params.groupId, req.user.address);
+        if (!group) {
+            return res.status(404).json({
+                success: false,
+                error: 'Group not found'
+            });
+        }
+
+        const members = await db.all(
+            'SELECT member_addr, added_at FROM access_group_members WHERE group_id = ? ORDER BY added_at, member_addr',
+            [group.id]
+        );
+
+        res.json({
+            success: true,
+            data: { ...group, members }
+        });
+
+    } catch (error) {
+        console.error('Get group error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to get group'
+        });
+    }
+});
+
+app.post('/groups/:groupId/members', requireAuth, async (req, res) => {
+    try {
+        const group = await getOwnedGroup(req.params.groupId, req.user.address);
+        if (!group) {
+            return res.status(404).json({
+                success: false,
+                error: 'Group not found'
+            });
+        }
+
+        const members = parseMemberList(req.body.members);
+        if (members.error) {
+            return res.status(400).json({
+                success: false,
+                error: members.error
+            });
+        }
+
+        const { count } = await db.get(
+            'SELECT COUNT(*) AS count FROM access_group_members WHERE group_id = ?',
+            [group.id]
+        );
+        if (count + members.value.length > ACCESS_GROUP_MAX_MEMBERS) {
+            return res.status(400).json({
+                success: false,
+                error: `Groups are limited to ${ACCESS_GROUP_MAX_MEMBERS} members`
+            });
+        }
+
+        let added = 0;
+        await withTransaction(async () => {
+            for (const member of members.value) {
+                const result = await db.run(
+                    'INSERT OR IGNORE INTO access_group_members (group_id, member_addr) VALUES (?, ?)',
+                    [group.id, member]
+                );
+                added += result.changes;
+            }
+        });
+
+        res.json({
+            success: true,
+            data: { group_id: group.id, added }
+        });
+
+    } catch (error) {
+        console.error('Add group members error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to add group members'
+        });
+    }
+});
+
+app.delete('/groups/:groupId/members/:address', requireAuth, async (req, res) => {
+    try {
+        const group = await getOwnedGroup(req.params.groupId, req.user.address);
+        if (!group) {
+            return res.status(404).json({
+                success: false,
+                error: 'Group not found'
+            });
+        }
+
+        const result = await db.run(
+            'DELETE FROM access_group_members WHERE group_id = ? AND member_addr = ?',
+            [group.id, req.params.address.toLowerCase()]
+        );
+
+        if (result.changes === 0) {
+            return res.status(404).json({
+                success: false,
+                error: 'Address is not a member of this group'
+            });
+        }
+
+        res.json({
+            success: true,
+            data: { group_id: group.id, removed: req.params.address.toLowerCase() }
+        });
+
+    } catch (error) {
+        console.error('Remove group member error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to remove group member'
+        });
+    }
+});
+
+// Update mutable file fields (metadata, file_name, content_type). CID and content stay immutable.
+app.patch('/files/:cid', requireAuth, async (req, res) => {
+    try {
+        const { cid } = req.params;
+        const { file_name, content_type } = req.body;
+
+        // Ownership first - nothing is validated or signed for someone else's file
+        const fileRecord = await db.get('SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL', [cid, req.appId]);
+
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found'
+            });
+        }
+
+        if (fileRecord.uploader_addr.toLowerCase() !== req.user.address.toLowerCase()) {
+            return res.status(403).json({
+                success: false,
+                error: 'Only the file owner can update it'
+            });
+        }
+
+        const updates = [];
+        const params = [];
+
+        if (req.body.metadata !== undefined) {
+            const parsedMetadata = parseMetadata(req.body.metadata);
+            if (parsedMetadata.error) {
+                return res.status(400).json({
+                    success: false,
+                    error: parsedMetadata.error
+                });
+            }
+            updates.push('metadata = ?');
+            params.push(JSON.stringify(parsedMetadata.value));
+
+            // Legitimate edits are re-signed so verification keeps passing
+            const metadataSignature = await MetadataSigner.sign(cid, parsedMetadata.value);
+            if (metadataSignature) {
+                updates.push('metadata_signature = ?', 'metadata_signer = ?', 'metadata_signed_at = ?');
+                params.push(metadataSignature.signature, metadataSignature.signer, metadataSignature.signedAt);
+            }
+        }
+
+        if (file_name !== undefined) {
+            const sanitized = sanitizeFileName(file_name);
+            if (!sanitized) {
+                return res.status(400).json({
+                    success: false,
+                    error: 'file_name cannot be empty'
+                });
+            }
+            updates.push('file_name = ?');
+            params.push(sanitized);
+        }
+
+        if (content_type !== undefined) {
+            updates.push('content_type = ?');
+            params.push(content_type || null);
+        }
+
+        if (updates.length === 0) {
+            return res.status(400).json({
+                success: false,
+                error: 'Nothing to update: provide metadata, file_name or content_type'
+            });
+        }
+
+        // Optimistic lock: the write only applies if nobody changed the row since the
+        // client (or this request) read it. Clients may pass the version they saw.
+        const expectedVersion = req.body.version !== undefined ? parseInt(req.body.version) : fileRecord.version;
+
+        const result = await db.run(`
+            UPDATE file_records SET ${updates.join(', ')}, version = version + 1, updated_at = CURRENT_TIMESTAMP
+            WHERE cid = ? AND version = ?
+        `, [...params, cid, expectedVersion]);
+
+        if (result.changes === 0) {
+            const current = await db.get('SELECT version FROM file_records WHERE cid = ?', [cid]);
+            return res.status(409).json({
+                success: false,
+                error: 'File was modified concurrently - reload and retry',
+                current_version: current ? current.version : null
+            });
+        }
+
+        let updated = await db.get('SELECT * FROM file_records WHERE cid = ?', [cid]);
+
+        // Publish a fresh sidecar so the stored metadata follows the edit
+        if (STORAGE_METADATA_SIDECAR && !updated.is_encrypted) {
+            const metadataCid = await StorageService.uploadMetadata(cid, updated.file_name, {
+                content_type: updated.content_type,
+                metadata: JSON.parse(updated.metadata)
+            });
+            if (metadataCid) {
+                await db.run('UPDATE file_records SET metadata_cid = ? WHERE cid = ?', [metadataCid, cid]);
+                updated = { ...updated, metadata_cid: metadataCid };
+            }
+        }
+
+        res.json({
+            success: true,
+            data: updated
+        });
+
+    } catch (error) {
+        console.error('Update file error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to update file',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Check that a file's metadata still matches the server signature taken at upload
+// (or at the last authorized update)
+app.get('/files/:cid/verify-metadata', async (req, res) => {
+    try {
+        const { cid } = req.params;
+
+        if (!MetadataSigner.getSigner()) {
+            return res.status(503).json({
+                success: false,
+                error: 'Metadata signing is not configured'
+            });
+        }
+
+        const fileRecord = await db.get(
+            'SELECT cid, metadata, metadata_signature, metadata_signer, metadata_signed_at FROM file_records WHERE cid = ? AND app_id = ? AND deleted_at IS NULL',
+            [cid, req.appId]
+        );
+
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found'
+            });
+        }
+
+        if (!fileRecord.metadata_signature) {
+            return res.json({
+                success: true,
+                data: {
+                    cid,
+                    signed: false,
+                    valid: false,
+                    message: 'Metadata was stored without a signature'
+                }
+            });
+        }
+
+        let metadata;
+        try {
+            metadata = JSON.parse(fileRecord.metadata);
+        } catch (error) {
+            metadata = fileRecord.metadata;
+        }
+
+        const valid = MetadataSigner.verify(cid, metadata, fileRecord.metadata_signature);
+
+        res.json({
+            success: true,
+            data: {
+                cid,
+                signed: true,
+                valid,
+                signer: MetadataSigner.getSigner().address,
+                signed_at: fileRecord.metadata_signed_at,
+                message: valid ?
+                    'Metadata matches its signature' :
+                    'Metadata or signature has been modified since signing'
+            }
+        });
+
+    } catch (error) {
+        console.error('Verify metadata error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to verify metadata'
+        });
+    }
+});
+
+// Signed proof-of-upload for a confirmed file, issued on first request and then
+// served as stored
+app.get('/files/:cid/receipt', requireAuth, async (req, res) => {
+    try {
+        const { cid } = req.params;
+
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND LOWER(uploader_addr) = LOWER(?) AND deleted_at IS NULL',
+            [cid, req.appId, req.user.address]
+        );
+
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found or not owned by user'
+            });
+        }
+
+        let stored = await db.get('SELECT * FROM upload_receipts WHERE cid = ?', [cid]);
+
+        if (!stored) {
+            if (!UploadReceiptService.getSigner()) {
+                return res.status(503).json({
+                    success: false,
+                    error: 'Receipt signing is not configured'
+                });
+            }
+
+            if (fileRecord.status !== 'confirmed' || !fileRecord.tx_hash) {
+                return res.status(409).json({
+                    success: false,
+                    error: 'Receipts are issued once the upload is confirmed on-chain',
+                    status: fileRecord.status
+                });
+            }
+
+            const txStatus = await contractService.getTransactionStatus(fileRecord.tx_hash, { signal: requestSignal(req, res) });
+            if (!txStatus || txStatus.status !== 'confirmed') {
+                return res.status(409).json({
+                    success: false,
+                    error: 'Upload transaction is not confirmed yet'
+                });
+            }
+
+            stored = await UploadReceiptService.issue(fileRecord, txStatus.blockNumber);
+        }
+
+        res.json({
+            success: true,
+            data: {
+                receipt: JSON.parse(stored.receipt),
+                signature: stored.signature,
+                signer: stored.signer
+            }
+        });
+
+    } catch (error) {
+        console.error('Receipt error:', error);
+        res.status(error.message.includes('timed out') ? 504 : 500).json({
+            success: false,
+            error: 'Failed to get upload receipt',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Owner retry for a half-failed upload, at most FILE_RETRY_MAX_ATTEMPTS times per file.
+// failed (blockchain recording gave up): settled if the CID is on-chain after all,
+// otherwise a fresh record_upload job is queued and tried inline. unavailable
+// (storage lost the content): `file`, the exact stored bytes in base64, is uploaded
+// again and must reproduce the CID; either way the storage is then checked again.
+const FILE_RETRY_MAX_ATTEMPTS = parseInt(process.env.FILE_RETRY_MAX_ATTEMPTS) || 3;
+
+app.post('/files/:cid/retry', requireAuth, async (req, res) => {
+    try {
+        const { cid } = req.params;
+        const { file } = req.body;
+
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND app_id = ? AND LOWER(uploader_addr) = LOWER(?) AND deleted_at IS NULL',
+            [cid, req.appId, req.user.address]
+        );
+
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found or not owned by user'
+            });
+        }
+
+        if (fileRecord.status !== 'failed' && fileRecord.status !== 'unavailable') {
+            return res.status(409).json({
+                success: false,
+                error: 'Only failed or unavailable files can be retried',
+                status: fileRecord.status
+            });
+        }
+
+        if (fileRecord.status === 'failed' && !BlockchainJobWorker.isEnabled()) {
+            return res.status(503).json({
+                success: false,
+                error: 'Blockchain recording is not configured'
+            });
+        }
+
+        if (file !== undefined && (fileRecord.status !== 'unavailable' || fileRecord.is_directory || typeof file !== 'string')) {
+            return res.status(400).json({
+                success: false,
+                error: 'file (base64) can only be sent to re-upload an unavailable file'
+            });
+        }
+
+        // Counted before any work, so concurrent retries can't exceed the limit
+        const claimed = await db.run(`
+            UPDATE file_records SET retry_count = retry_count + 1, updated_at = CURRENT_TIMESTAMP
+            WHERE id = ? AND status = ? AND retry_count < ?
+        `, [fileRecord.id, fileRecord.status, FILE_RETRY_MAX_ATTEMPTS]);
+
+        if (claimed.changes === 0) {
+            return res.status(409).json({
+                success: false,
+                error: fileRecord.retry_count >= FILE_RETRY_MAX_ATTEMPTS ?
+                    `Retry limit of ${FILE_RETRY_MAX_ATTEMPTS} reached for this file` :
+                    'File status changed; fetch it again before retrying'
+            });
+        }
+
+        const result = { cid, status: fileRecord.status, tx_hash: fileRecord.tx_hash };
+
+        if (fileRecord.status === 'failed') {
+            if (contractService.isContractReady() && await contractService.checkFileExists(cid)) {
+                await db.run(`
+                    UPDATE file_records SET status = 'confirmed', version = version + 1, updated_at = CURRENT_TIMESTAMP
+                    WHERE id = ? AND status = 'failed'
+                `, [fileRecord.id]);
+                result.status = 'confirmed';
+            } else {
+                const jobId = await withTransaction(async () => {
+                    await db.run(`
+                        UPDATE file_records SET status = 'pending', version = version + 1, updated_at = CURRENT_TIMESTAMP
+                        WHERE id = ? AND status = 'failed'
+                    `, [fileRecord.id]);
+                    return BlockchainJobWorker.enqueue(cid, 'record_upload', {
+                        file_size: fileRecord.file_size,
+                        is_encrypted: !!fileRecord.is_encrypted,
+                        metadata: JSON.parse(fileRecord.metadata || '{}'),
+                        uploader: fileRecord.uploader_addr
+                    });
+                });
+                console.log(`🔁 Re-queued blockchain recording for ${cid} (job ${jobId})`);
+
+                const jobResult = await blockchainJobWorker.runUploadJob(jobId);
+                result.status = jobResult ? 'confirmed' : 'pending';
+                result.tx_hash = jobResult?.txHash || null;
+                result.job_id = jobId;
+            }
+        } else {
+            if (file !== undefined) {
+                const uploadedCid = await StorageService.upload(Buffer.from(file, 'base64'), fileRecord.file_name, fileRecord.content_type, {
+                    provider: fileRecord.storage_provider,
+                    signal: requestSignal(req, res)
+                });
+                if (uploadedCid !== cid) {
+                    return res.status(422).json({
+                        success: false,
+                        error: 'Uploaded content does not match this CID',
+                        uploaded_cid: uploadedCid
+                    });
+                }
+                console.log(`🔁 Re-uploaded ${cid} to ${fileRecord.storage_provider || StorageService.defaultName()}`);
+            }
+
+            const available = await StorageService.isAvailable(cid, {
+                provider: fileRecord.storage_provider,
+                signal: requestSignal(req, res)
+            });
+            if (available) {
+                await db.run(`
+                    UPDATE file_records SET status = 'confirmed', availability_failures = 0,
+                        last_availability_check = CURRENT_TIMESTAMP, version = version + 1
+                    WHERE id = ? AND status = 'unavailable'
+                `, [fileRecord.id]);
+                result.status = 'confirmed';
+            }
+        }
+
+        if (result.status !== fileRecord.status) {
+            fileEventBroker.publish(cid, 'status', { status: result.status, tx_hash: result.tx_hash });
+        }
+
+        res.json({
+            success: true,
+            data: {
+                ...result,
+                retries_remaining: FILE_RETRY_MAX_ATTEMPTS - fileRecord.retry_count - 1
+            }
+        });
+
+    } catch (error) {
+        console.error('File retry error:', error);
+        sendError(res, 'Failed to retry file', error);
+    }
+});
+
+// Public receipt check: anyone holding a receipt can confirm this server signed it
+app.post('/receipts/verify', async (req, res) => {
+    try {
+        const { receipt, signature } = req.body;
+
+        if (!receipt || typeof receipt !== 'object' || typeof signature !== 'string') {
+            return res.status(400).json({
+                success: false,
+                error: 'receipt (object) and signature (string) are required'
+            });
+        }
+
+        const signer = UploadReceiptService.getSigner();
+        if (!signer) {
+            return res.status(503).json({
+                success: false,
+                error: 'Receipt signing is not configured'
+            });
+        }
+
+        const recovered = UploadReceiptService.recover(receipt, signature);
+
+        res.json({
+            success: true,
+            data: {
+                valid: recovered === signer.address,
+                signer: signer.address,
+                recovered_signer: recovered
+            }
+        });
+
+    } catch (error) {
+        console.error('Receipt verify error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to verify receipt'
+        });
+    }
+});
+
+// Manual reward claiming (backup option)
+// Simplified reward claim endpoint - replace the existing /rewards/claim route
+
+app.post('/rewards/claim', requireAuth, idempotent('reward_claim'), async (req, res) => {
+    try {
+        const { cid } = req.body;
+        // Only the uploader may claim, so the claimant is the authenticated caller
+        const user_address = req.user.address;
+        
+        // Basic validation only
+        if (!cid) {
+            return res.status(400).json({
+                success: false,
+                error: 'Missing required field: cid'
+            });
+        }
+        
+        // Check if file exists in database and user is the uploader
+        const fileRecord = await db.get(
+            'SELECT * FROM file_records WHERE cid = ? AND LOWER(uploader_addr) = LOWER(?) AND app_id = ? AND deleted_at IS NULL',
+            [cid, user_address, req.appId]
+        );
+        
+        if (!fileRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'File not found or not owned by user'
+            });
+        }
+        
+        if (!contractService.isContractReady()) {
+            return res.status(503).json({
+                success: false,
+                error: 'Blockchain service not available'
+            });
+        }
+        
+        try {
+            // Claim reward on blockchain
+            const rewardResult = await contractService.claimUploadReward(cid, { signal: requestSignal(req, res) });
+            
+            if (rewardResult) {
+                await db.run(`
+                    UPDATE file_records SET reward_claimed = 1, reward_tx_hash = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+                    WHERE cid = ?
+                `, [rewardResult.txHash, cid]);
+                fileEventBroker.publish(cid, 'reward_claimed', { tx_hash: rewardResult.txHash, amount: rewardResult.amount });
+
+                res.json({
+                    success: true,
+                    data: {
+                        cid,
+                        tx_hash: rewardResult.txHash,
+                        reward_amount: rewardResult.amount,
+                        block_number: rewardResult.blockNumber,
+                        message: `Reward of ${rewardResult.amount} FIL claimed successfully`
+                    }
+                });
+            } else {
+                res.status(400).json({
+                    success: false,
+                    error: 'Failed to claim reward'
+                });
+            }
+            
+        } catch (contractError) {
+            res.status(400).json({
+                success: false,
+                error: contractError.message
+            });
+        }
+        
+    } catch (error) {
+        console.error('Claim reward error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to process reward claim',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// User stats with blockchain data
+app.get('/users/:address/stats', async (req, res) => {
+    try {
+        const { address } = req.params;
+        
+        // Get database stats
+        const dbStats = await readDb(req).get(`
+            SELECT 
+                COUNT(*) as total_files,
+                SUM(file_size) as total_size,
+                SUM(CASE WHEN is_encrypted = 1 THEN 1 ELSE 0 END) as encrypted_files
+            FROM file_records 
+            WHERE uploader_addr = ? AND app_id = ? AND deleted_at IS NULL
+        `, [address, req.appId]);
+        
+        // Get blockchain stats
+        let blockchainStats = {
+            reward_balance: "0",
+            blockchain_files: [],
+            can_claim_rewards: false
+        };
+        
+        try {
+            if (contractService.isReady) {
+                const rewardBalance = await contractService.getUserRewardBalance(address);
+                
+                blockchainStats = {
+                    reward_balance: rewardBalance,
+                    blockchain_files: [],
+                    can_claim_rewards: false
+                };
+            }
+        } catch (error) {
+            console.log('⚠️ Could not fetch blockchain stats');
+        }
+        
+        res.json({
+            success: true,
+            data: {
+                // Database stats
+                total_files: dbStats.total_files || 0,
+                total_size_bytes: dbStats.total_size || 0,
+                encrypted_files: dbStats.encrypted_files || 0,
+                
+                // Blockchain stats
+                reward_balance_fil: blockchainStats.reward_balance,
+                blockchain_files_count: blockchainStats.blockchain_files.length,
+                can_claim_rewards: blockchainStats.can_claim_rewards,
+                
+                // Combined
+                rewards_earned: dbStats.total_files || 0
+            }
+        });
+        
+    } catch (error) {
+        console.error('Stats error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to get user stats'
+        });
+    }
+});
+
+// User files
+app.get('/users/:address/files', async (req, res) => {
+    try {
+        const { address } = req.params;
+        const listParams = parseListParams(req.query, FILE_SORT_COLUMNS);
+
+        if (listParams.errors.length > 0) {
+            return res.status(400).json({
+                success: false,
+                error: 'Validation failed',
+                validation_errors: listParams.errors
+            });
+        }
+
+        const { limit, sortBy, order } = listParams;
+
+        // Filters shared by both pagination modes
+        let where = 'uploader_addr = ? AND app_id = ? AND deleted_at IS NULL';
+        const params = [address, req.appId];
+
+        if (req.query.status) {
+            where += ' AND status = ?';
+            params.push(req.query.status);
+        }
+
+        if (req.query.encrypted !== undefined) {
+            where += ' AND is_encrypted = ?';
+            params.push(req.query.encrypted === 'true' ? 1 : 0);
+        }
+
+        // Metadata filters: ?meta.project=alpha, ?meta.tags.owner=bob
+        for (const [param, value] of Object.entries(req.query)) {
+            if (!param.startsWith('meta.')) continue;
+
+            const key = param.slice(5);
+            if (!METADATA_KEY_PATTERN.test(key)) {
+                return res.status(400).json({
+                    success: false,
+                    error: `Invalid metadata filter key: ${key}`
+                });
+            }
+
+            where += ' AND CAST(json_extract(metadata, ?) AS TEXT) = ?';
+            params.push(`$.${key}`, String(value));
+        }
+
+        if (req.query.q) {
+            const search = buildSearchClause(req.query.q, ['file_name', 'content_type', 'metadata']);
+            where += ` AND ${search.clause}`;
+            params.push(...search.params);
+        }
+
+        // Keyset pagination: ?after=<cursor> (or ?cursor=true for the first page)
+        if (req.query.after !== undefined || req.query.cursor === 'true') {
+            if (sortBy !== 'created_at' || order !== 'DESC') {
+                return res.status(400).json({
+                    success: false,
+                    error: 'Cursor pagination only supports sort_by=created_at&order=desc'
+                });
+            }
+
+            const after = req.query.after ? decodeCursor(req.query.after) : null;
+            if (req.query.after && !after) {
+                return res.status(400).json({
+                    success: false,
+                    error: 'Invalid cursor'
+                });
+            }
+
+            const page = await fetchCursorPage(
+                `SELECT * FROM file_records WHERE ${where}`,
+                params,
+                after,
+                limit,
+                readDb(req)
+            );
+
+            return res.json({
+                success: true,
+                data: {
+                    files: page.rows,
+                    pagination: {
+                        limit,
+                        next_cursor: page.nextCursor,
+                        has_more: page.nextCursor !== null
+                    }
+                }
+            });
+        }
+
+        const page = parseInt(req.query.page) || 1;
+        const offset = (page - 1) * limit;
+        
+        // sortBy and order come from the allowlist in parseListParams, never raw input.
+        // None of the sort columns is unique, so id breaks ties - otherwise rows with
+        // equal values can swap between pages and be skipped or repeated.
+        const files = await readDb(req).all(`
+            SELECT * FROM file_records 
+            WHERE ${where} 
+            ORDER BY ${sortBy} ${order}, id ${order}
+            LIMIT ? OFFSET ?
+        `, [...params, limit, offset]);
+        
+        const total = await readDb(req).get(
+            `SELECT COUNT(*) as count FROM file_records WHERE ${where}`,
+            params
+        );
+        
+        res.json({
+            success: true,
+            data: {
+                files,
+                pagination: {
+                    page,
+                    limit,
+                    total: total.count,
+                    total_pages: Math.ceil(total.count / limit)
+                }
+            }
+        });
+        
+    } catch (error) {
+        console.error('Files error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to get user files'
+        });
+    }
+});
+
+// Files other users have shared with this address
+app.get('/users/:address/shared', requireAuth, async (req, res) => {
+    try {
+        const { address } = req.params;
+
+        // What was shared with someone is only theirs to list
+        if (address.toLowerCase() !== req.user.address.toLowerCase()) {
+            return res.status(403).json({
+                success: false,
+                error: 'Cannot list files shared with another user'
+            });
+        }
+
+        const listParams = parseListParams(req.query, ['created_at']);
+        if (listParams.errors.length > 0) {
+            return res.status(400).json({
+                success: false,
+                error: 'Validation failed',
+                validation_errors: listParams.errors
+            });
+        }
+
+        const { limit } = listParams;
+        const after = req.query.after ? decodeCursor(req.query.after) : null;
+
+        if (req.query.after && !after) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid cursor'
+            });
+        }
+
+        let sql = `
+            SELECT * FROM (
+                SELECT g.id, g.cid, g.granter_addr, g.group_id, g.expires_at, g.created_at,
+                       g.permissions, g.max_downloads, g.downloads_used,
+                       f.file_name, f.file_size, f.content_type, f.is_encrypted
+                FROM access_grants g
+                JOIN file_records f ON f.cid = g.cid
+                WHERE (LOWER(g.grantee_addr) = LOWER(?) OR g.group_id IN (
+                    SELECT group_id FROM access_group_members WHERE member_addr = LOWER(?)
+                ))
+                AND g.app_id = ? AND f.app_id = g.app_id
+                AND f.deleted_at IS NULL
+                AND g.is_active = 1
+                AND (g.expires_at IS NULL OR g.expires_at > ?)
+                AND (g.max_downloads IS NULL OR g.downloads_used < g.max_downloads)
+            ) WHERE 1 = 1
+        `;
+        const params = [address, address, req.appId, new Date().toISOString()];
+
+        if (req.query.granter) {
+            sql += ' AND LOWER(granter_addr) = LOWER(?)';
+            params.push(req.query.granter);
+        }
+
+        const page = await fetchCursorPage(sql, params, after, limit, readDb(req));
+
+        res.json({
+            success: true,
+            data: {
+                grants: page.rows.map(grant => ({ ...grant, permissions: grant.permissions.split(',') })),
+                pagination: {
+                    limit,
+                    next_cursor: page.nextCursor,
+                    has_more: page.nextCursor !== null
+                }
+            }
+        });
+
+    } catch (error) {
+        console.error('Shared files error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to get shared files'
+        });
+    }
+});
+
+// Transaction status lookup
+app.get('/transactions/:txHash/status', async (req, res) => {
+    try {
+        const { txHash } = req.params;
+
+        if (!ethers.isHexString(txHash, 32)) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid transaction hash'
+            });
+        }
+
+        if (!contractService.provider) {
+            return res.status(503).json({
+                success: false,
+                error: 'Blockchain service not available'
+            });
+        }
+
+        const status = await contractService.getTransactionStatus(txHash, { signal: requestSignal(req, res) });
+
+        res.json({
+            success: true,
+            data: {
+                tx_hash: status.txHash,
+                status: status.status,
+                block_number: status.blockNumber ?? null,
+                confirmations: status.confirmations ?? 0,
+                gas_used: status.gasUsed ?? null
+            }
+        });
+
+    } catch (error) {
+        console.error('Transaction status error:', error);
+        res.status(error.message.includes('timed out') ? 504 : 500).json({
+            success: false,
+            error: 'Failed to get transaction status',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Bulk transaction status lookup - returns a map of tx hash to status. Hashes are
+// de-duplicated and looked up with bounded concurrency; one failed lookup does not
+// fail the batch.
+const TX_STATUS_BATCH_MAX = parseInt(process.env.TX_STATUS_BATCH_MAX) || 50;
+const TX_STATUS_CONCURRENCY = parseInt(process.env.TX_STATUS_CONCURRENCY) || 5;
+
+app.post('/transactions/status', async (req, res) => {
+    try {
+        const { tx_hashes } = req.body;
+
+        if (!Array.isArray(tx_hashes) || tx_hashes.length === 0) {
+            return res.status(400).json({
+                success: false,
+                error: 'tx_hashes must be a non-empty array'
+            });
+        }
+
+        const hashes = [...new Set(tx_hashes.map(hash => String(hash).toLowerCase()))];
+
+        if (hashes.length > TX_STATUS_BATCH_MAX) {
+            return res.status(400).json({
+                success: false,
+                error: `At most ${TX_STATUS_BATCH_MAX} transaction hashes per request`
+            });
+        }
+
+        const invalid = hashes.filter(hash => !ethers.isHexString(hash, 32));
+        if (invalid.length > 0) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid transaction hashes',
+                invalid
+            });
+        }
+
+        if (!contractService.provider) {
+            return res.status(503).json({
+                success: false,
+                error: 'Blockchain service not available'
+            });
+        }
+
+        const signal = requestSignal(req, res);
+        const results = await mapWithConcurrency(hashes, TX_STATUS_CONCURRENCY, async (hash) => {
+            try {
+                const status = await contractService.getTransactionStatus(hash, { signal });
+                return {
+                    status: status.status,
+                    block_number: status.blockNumber ?? null,
+                    confirmations: status.confirmations ?? 0,
+                    gas_used: status.gasUsed ?? null
+                };
+            } catch (error) {
+                return { status: 'error', error: error.message };
+            }
+        });
+
+        const statuses = {};
+        hashes.forEach((hash, index) => {
+            statuses[hash] = results[index];
+        });
+
+        res.json({
+            success: true,
+            data: { statuses }
+        });
+
+    } catch (error) {
+        console.error('Bulk transaction status error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to get transaction statuses',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Contract statistics
+app.get('/contract/stats', async (req, res) => {
+    try {
+        if (!contractService.isReady) {
+            return res.json({
+                success: false,
+                error: 'Contract not available'
+            });
+        }
+        
+        const stats = await contractService.getContractStats();
+        
+        if (!stats) {
+            return res.status(500).json({
+                success: false,
+                error: 'Failed to fetch contract statistics'
+            });
+        }
+        
+        res.json({
+            success: true,
+            data: {
+                contract_address: process.env.CONTRACT_ADDRESS,
+                network: "Filecoin Calibration Testnet",
+                total_files_stored: stats.totalFiles,
+                total_rewards_distributed_fil: stats.totalRewardsDistributed,
+                total_storage_used_bytes: stats.totalStorageUsed,
+                reward_config: {
+                    base_reward_fil: stats.baseRewardAmount,
+                    size_multiplier: stats.sizeMultiplier,
+                    encryption_bonus_fil: stats.encryptionBonus
+                }
+            }
+        });
+        
+    } catch (error) {
+        console.error('Contract stats error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to get contract statistics'
+        });
+    }
+});
+
+// Contract status
+app.get('/contract/status', async (req, res) => {
+    try {
+        if (!contractService.provider || !process.env.CONTRACT_ADDRESS) {
+            return res.json({
+                success: false,
+                error: 'Contract not configured'
+            });
+        }
+
+        const code = await contractService.provider.getCode(process.env.CONTRACT_ADDRESS);
+        const balance = await contractService.provider.getBalance(process.env.CONTRACT_ADDRESS);
+        
+        // Get wallet info if available
+        let walletInfo = null;
+        if (contractService.wallet) {
+            const walletBalance = await contractService.provider.getBalance(contractService.wallet.address);
+            walletInfo = {
+                address: contractService.wallet.address,
+                balance_fil: ethers.formatEther(walletBalance)
+            };
+        }
+
+        // Get contract stats if available
+        let contractStats = null;
+        if (contractService.isReady) {
+            contractStats = await contractService.getContractStats();
+        }
+
+        res.json({
+            success: true,
+            data: {
+                contract_address: process.env.CONTRACT_ADDRESS,
+                network: "Filecoin Calibration Testnet",
+                rpc_url: contractService.activeRpcEndpoint(),
+                is_deployed: code !== "0x",
+                bytecode_length: code.length,
+                contract_balance_fil: ethers.formatEther(balance),
+                wallet: walletInfo,
+                can_write: !!contractService.wallet,
+                is_ready: contractService.isReady,
+                stats: contractStats
+            }
+        });
+        
+    } catch (error) {
+        res.status(500).json({
+            success: false,
+            error: 'Failed to check contract status',
+            details: error.message
+        });
+    }
+});
+
+// Key export: moves a user's server-side key elsewhere (disaster recovery, or
+// migrating to client-side encryption). The owner asks with an RSA public key, an
+// admin other than the owner approves, and the owner then collects the key once,
+// RSA-OAEP-SHA256 wrapped under that public key. The key is never returned in plaintext.
+const KEY_EXPORT_MIN_RSA_BITS = 2048;
+const KEY_EXPORT_TTL_HOURS = parseInt(process.env.KEY_EXPORT_TTL_HOURS) || 24;
+
+function parseExportPublicKey(pem) {
+    if (typeof pem !== 'string' || !pem.includes('PUBLIC KEY')) {
+        return { error: 'public_key must be a PEM-encoded RSA public key' };
+    }
+
+    let key;
+    try {
+        key = crypto.createPublicKey(pem);
+    } catch (error) {
+        return { error: 'public_key must be a PEM-encoded RSA public key' };
+    }
+    if (key.asymmetricKeyType !== 'rsa' || key.asymmetricKeyDetails.modulusLength < KEY_EXPORT_MIN_RSA_BITS) {
+        return { error: `public_key must be an RSA key of at least ${KEY_EXPORT_MIN_RSA_BITS} bits` };
+    }
+    return { value: key.export({ type: 'spki', format: 'pem' }) };
+}
+
+app.post('/keys/export', requireAuth, async (req, res) => {
+    try {
+        const publicKey = parseExportPublicKey(req.body.public_key);
+        if (publicKey.error) {
+            return res.status(400).json({
+                success: false,
+                error: publicKey.error
+            });
+        }
+
+        const keyRecord = await db.get(
+            'SELECT key_id FROM encryption_keys WHERE app_id = ? AND LOWER(user_address) = LOWER(?)',
+            [req.appId, req.user.address]
+        );
+        if (!keyRecord) {
+            return res.status(404).json({
+                success: false,
+                error: 'No server-side encryption key exists for this user'
+            });
+        }
+
+        const result = await db.run(`
+            INSERT INTO key_export_requests (app_id, user_address, public_key) VALUES (?, ?, ?)
+        `, [req.appId, req.user.address.toLowerCase(), publicKey.value]);
+
+        console.log(`🔑 Key export ${result.lastID} requested by ${req.user.address}`);
+
+        res.status(201).json({
+            success: true,
+            data: {
+                id: result.lastID,
+                status: 'pending',
+                key_id: keyRecord.key_id
+            }
+        });
+
+    } catch (error) {
+        console.error('Key export request error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to request key export',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Collect an approved export. Succeeds once; afterwards the request is completed.
+app.get('/keys/export/:id', requireAuth, async (req, res) => {
+    try {
+        const request = await db.get(
+            'SELECT * FROM key_export_requests WHERE id = ? AND app_id = ? AND user_address = ?',
+            [req.params.id, req.appId, req.user.address.toLowerCase()]
+        );
+        if (!request) {
+            return res.status(404).json({
+                success: false,
+                error: 'Key export request not found'
+            });
+        }
+
+        if (request.status === 'pending') {
+            return res.status(202).json({
+                success: true,
+                data: { id: request.id, status: request.status }
+            });
+        }
+        if (request.status !== 'approved') {
+            return res.status(410).json({
+                success: false,
+                error: `Key export request is ${request.status}`
+            });
+        }
+
+        // Approval only holds for a limited time after it was given
+        const claim = await db.run(`
+            UPDATE key_export_requests SET status = 'completed', completed_at = CURRENT_TIMESTAMP
+            WHERE id = ? AND status = 'approved' AND decided_at > datetime('now', '-' || ? || ' hours')
+        `, [request.id, KEY_EXPORT_TTL_HOURS]);
+        if (claim.changes === 0) {
+            return res.status(410).json({
+                success: false,
+                error: 'Key export approval has expired, request a new export'
+            });
+        }
+
+        const keyRecord = await db.get(
+            'SELECT key_material, key_wrapping, key_id FROM encryption_keys WHERE app_id = ? AND LOWER(user_address) = LOWER(?)',
+            [request.app_id, request.user_address]
+        );
+        const key = await getKeyStore(keyRecord.key_wrapping).unwrap(keyRecord.key_material);
+        const wrappedKey = crypto.publicEncrypt({
+            key: request.public_key,
+            padding: crypto.constants.RSA_PKCS1_OAEP_PADDING,
+            oaepHash: 'sha256'
+        }, key);
+
+        console.log(`🔑 Key export ${request.id} collected by ${req.user.address}`);
+
+        res.json({
+            success: true,
+            data: {
+                id: request.id,
+                key_id: keyRecord.key_id,
+                wrapping: 'RSA-OAEP-SHA256',
+                wrapped_key: wrappedKey.toString('base64')
+            }
+        });
+
+    } catch (error) {
+        console.error('Key export error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to export key',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Admin: key export requests, newest first
+app.get('/admin/key-exports', requireAdmin, async (req, res) => {
+    try {
+        const status = req.query.status || 'pending';
+        const requests = await db.all(`
+            SELECT id, app_id, user_address, status, decided_by, decided_at, completed_at, created_at
+            FROM key_export_requests WHERE status = ?
+            ORDER BY id DESC LIMIT 100
+        `, [status]);
+
+        res.json({
+            success: true,
+            data: { requests }
+        });
+
+    } catch (error) {
+        console.error('List key exports error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to list key export requests'
+        });
+    }
+});
+
+app.post('/admin/key-exports/:id/:decision(approve|reject)', requireAdmin, async (req, res) => {
+    try {
+        const request = await db.get('SELECT * FROM key_export_requests WHERE id = ?', [req.params.id]);
+        if (!request) {
+            return res.status(404).json({
+                success: false,
+                error: 'Key export request not found'
+            });
+        }
+
+        if (request.user_address === req.user.address.toLowerCase()) {
+            return res.status(403).json({
+                success: false,
+                error: 'Admins cannot decide their own key export'
+            });
+        }
+
+        const status = req.params.decision === 'approve' ? 'approved' : 'rejected';
+        const decided = await db.run(`
+            UPDATE key_export_requests SET status = ?, decided_by = ?, decided_at = CURRENT_TIMESTAMP
+            WHERE id = ? AND status = 'pending'
+        `, [status, req.user.address.toLowerCase(), request.id]);
+        if (decided.changes === 0) {
+            return res.status(409).json({
+                success: false,
+                error: `Key export request is already ${request.status}`
+            });
+        }
+
+        console.log(`🔑 Key export ${request.id} for ${request.user_address} ${status} by ${req.user.address}`);
+
+        res.json({
+            success: true,
+            data: { id: request.id, status }
+        });
+
+    } catch (error) {
+        console.error('Decide key export error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to update key export request'
+        });
+    }
+});
+
+// Admin: user roles
+app.get('/admin/users/:address/role', requireAdmin, async (req, res) => {
+    try {
+        const { address } = req.params;
+
+        if (!AuthService.isValidAddress(address)) {
+            return res.status(400).json({
+                success: false,
                 error: 'Invalid Ethereum address format'
             });
         }
-        
-        // Check if storage is ready
-        if (!w3upClient) {
-            return res.status(503).json({
+
+        const row = await db.get('SELECT * FROM user_roles WHERE user_address = ?', [address.toLowerCase()]);
+
+        res.json({
+            success: true,
+            data: {
+                address,
+                role: row ? row.role : 'user',
+                assigned_by: row ? row.assigned_by : null,
+                updated_at: row ? row.updated_at : null
+            }
+        });
+
+    } catch (error) {
+        console.error('Get role error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to get user role'
+        });
+    }
+});
+
+app.put('/admin/users/:address/role', requireAdmin, async (req, res) => {
+    try {
+        const { address } = req.params;
+        const { role } = req.body;
+
+        if (!AuthService.isValidAddress(address)) {
+            return res.status(400).json({
                 success: false,
-                error: 'Storage service not available. Please check Web3.Storage configuration.'
+                error: 'Invalid Ethereum address format'
             });
         }
-        
-        console.log(`🔄 Processing upload: ${file_name} for ${user_address}`);
-        
-        // Convert base64 to buffer
-        let fileBuffer;
-        try {
-            fileBuffer = Buffer.from(file, 'base64');
-        } catch (error) {
+
+        if (!VALID_ROLES.includes(role)) {
             return res.status(400).json({
                 success: false,
-                error: 'Invalid base64 file data'
+                error: `role must be one of: ${VALID_ROLES.join(', ')}`
+            });
+        }
+
+        if (address.toLowerCase() === req.user.address.toLowerCase() && role !== 'admin') {
+            return res.status(400).json({
+                success: false,
+                error: 'Admins cannot remove their own admin role'
+            });
+        }
+
+        await db.run(`
+            INSERT INTO user_roles (user_address, role, assigned_by) VALUES (?, ?, ?)
+            ON CONFLICT(user_address) DO UPDATE SET
+                role = excluded.role, assigned_by = excluded.assigned_by, updated_at = CURRENT_TIMESTAMP
+        `, [address.toLowerCase(), role, req.user.address]);
+
+        console.log(`👤 Role for ${address} set to ${role} by ${req.user.address}`);
+
+        res.json({
+            success: true,
+            data: {
+                address,
+                role
+            }
+        });
+
+    } catch (error) {
+        console.error('Set role error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to set user role'
+        });
+    }
+});
+
+// Admin: access-control audit trail, newest first, filterable by date range
+app.get('/admin/access-log', requireAdmin, async (req, res) => {
+    try {
+        const { limit } = parseListParams(req.query, ['created_at']);
+        const range = parseDateRange(req.query);
+        const after = req.query.after ? decodeCursor(req.query.after) : null;
+
+        if (range.error) {
+            return res.status(400).json({
+                success: false,
+                error: range.error
+            });
+        }
+        if (req.query.after && !after) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid cursor'
+            });
+        }
+
+        let sql = 'SELECT * FROM access_log WHERE 1 = 1';
+        const params = [];
+
+        if (range.from) {
+            sql += ' AND created_at >= ?';
+            params.push(range.from);
+        }
+        if (range.to) {
+            sql += ' AND created_at <= ?';
+            params.push(range.to);
+        }
+        if (req.query.cid) {
+            sql += ' AND cid = ?';
+            params.push(req.query.cid);
+        }
+        if (req.query.actor) {
+            sql += ' AND actor = ?';
+            params.push(req.query.actor.toLowerCase());
+        }
+        if (req.query.decision) {
+            sql += ' AND decision = ?';
+            params.push(req.query.decision);
+        }
+        if (req.query.action) {
+            sql += ' AND action = ?';
+            params.push(req.query.action);
+        }
+
+        const page = await fetchCursorPage(sql, params, after, limit, readDb(req));
+
+        res.json({
+            success: true,
+            data: {
+                entries: page.rows,
+                pagination: {
+                    limit,
+                    next_cursor: page.nextCursor,
+                    has_more: page.nextCursor !== null
+                }
+            }
+        });
+
+    } catch (error) {
+        console.error('Access log error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to get access log'
+        });
+    }
+});
+
+// Admin: files across all users and tenants
+app.get('/admin/files', requireAdmin, async (req, res) => {
+    try {
+        const { limit } = parseListParams(req.query, ['created_at']);
+        const range = parseDateRange(req.query);
+        const after = req.query.after ? decodeCursor(req.query.after) : null;
+
+        if (range.error) {
+            return res.status(400).json({
+                success: false,
+                error: range.error
+            });
+        }
+        if (req.query.after && !after) {
+            return res.status(400).json({
+                success: false,
+                error: 'Invalid cursor'
+            });
+        }
+
+        let sql = 'SELECT * FROM file_records WHERE 1 = 1';
+        const params = [];
+
+        if (req.query.include_deleted !== 'true') {
+            sql += ' AND deleted_at IS NULL';
+        }
+
+        // created_at is CURRENT_TIMESTAMP text, the range ISO 8601; compare as datetimes
+        if (range.from) {
+            sql += ' AND datetime(created_at) >= datetime(?)';
+            params.push(range.from);
+        }
+        if (range.to) {
+            sql += ' AND datetime(created_at) <= datetime(?)';
+            params.push(range.to);
+        }
+        if (req.query.status) {
+            sql += ' AND status = ?';
+            params.push(req.query.status);
+        }
+        if (req.query.uploader) {
+            sql += ' AND LOWER(uploader_addr) = LOWER(?)';
+            params.push(req.query.uploader);
+        }
+        if (req.query.encrypted !== undefined) {
+            sql += ' AND is_encrypted = ?';
+            params.push(req.query.encrypted === 'true' ? 1 : 0);
+        }
+        if (req.query.app_id) {
+            sql += ' AND app_id = ?';
+            params.push(req.query.app_id);
+        }
+        if (req.query.q) {
+            const search = buildSearchClause(req.query.q, ['cid', 'file_name', 'content_type', 'metadata']);
+            sql += ` AND ${search.clause}`;
+            params.push(...search.params);
+        }
+
+        const page = await fetchCursorPage(sql, params, after, limit, readDb(req));
+
+        res.json({
+            success: true,
+            data: {
+                files: page.rows,
+                pagination: {
+                    limit,
+                    next_cursor: page.nextCursor,
+                    has_more: page.nextCursor !== null
+                }
+            }
+        });
+
+    } catch (error) {
+        console.error('Admin files error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to list files'
+        });
+    }
+});
+
+// Admin: delete every file matching a filter (uploader, status, created_at range, CID
+// list). A dry run reports the matches and a confirmation_token; the real run must send
+// the same filters and token, and is refused if the matching set changed in between.
+// Soft delete (the default) hides the records, which also stops their share links, and
+// deactivates their grants; hard_delete removes the rows. Stored content is never removed from the network.
+// Soft-deleted files can be brought back with POST /admin/files/bulk-restore.
+const BULK_DELETE_MAX_FILES = parseInt(process.env.BULK_DELETE_MAX_FILES) || 1000;
+
+function parseBulkDeleteFilters(body) {
+    const filters = {};
+
+    if (body.uploader !== undefined) {
+        if (typeof body.uploader !== 'string' || !ethers.isAddress(body.uploader)) {
+            return { error: 'uploader must be a valid address' };
+        }
+        filters.uploader = body.uploader.toLowerCase();
+    }
+    if (body.status !== undefined) {
+        if (typeof body.status !== 'string' || !body.status) {
+            return { error: 'status must be a non-empty string' };
+        }
+        filters.status = body.status;
+    }
+    if (body.cids !== undefined) {
+        if (!Array.isArray(body.cids) || body.cids.length === 0 ||
+            body.cids.some(cid => typeof cid !== 'string' || !cid)) {
+            return { error: 'cids must be a non-empty array of CIDs' };
+        }
+        if (body.cids.length > BULK_DELETE_MAX_FILES) {
+            return { error: `At most ${BULK_DELETE_MAX_FILES} CIDs can be deleted at once` };
+        }
+        filters.cids = [...new Set(body.cids)].sort();
+    }
+
+    const range = parseDateRange(body);
+    if (range.error) {
+        return { error: range.error };
+    }
+    if (range.from) filters.from = range.from;
+    if (range.to) filters.to = range.to;
+
+    // Never let an empty filter mean "everything"
+    if (Object.keys(filters).length === 0) {
+        return { error: 'At least one filter (uploader, status, from, to, cids) is required' };
+    }
+    return { value: filters };
+}
+
+// Grants follow their file: a soft delete deactivates every active grant on the CID,
+// stamping it with the file's deleted_at, and a restore reactivates exactly those.
+// Grants revoked before the delete stay revoked. Both return the number of grants changed.
+async function softDeleteFiles(cids) {
+    const placeholders = cids.map(() => '?').join(', ');
+    const now = new Date().toISOString();
+
+    return withTransaction(async () => {
+        const grants = await db.run(
+            `UPDATE access_grants SET is_active = 0, deactivated_at = ? WHERE is_active = 1 AND cid IN (${placeholders})`,
+            [now, ...cids]
+        );
+        await db.run(
+            `UPDATE file_records SET deleted_at = ?, updated_at = CURRENT_TIMESTAMP WHERE deleted_at IS NULL AND cid IN (${placeholders})`,
+            [now, ...cids]
+        );
+        return grants.changes;
+    });
+}
+
+// Returns the CIDs that were deleted and are now restored, and the grant count
+async function restoreFiles(cids) {
+    const placeholders = cids.map(() => '?').join(', ');
+
+    return withTransaction(async () => {
+        const deleted = await db.all(
+            `SELECT cid, deleted_at FROM file_records WHERE deleted_at IS NOT NULL AND cid IN (${placeholders}) ORDER BY id`,
+            cids
+        );
+        let grants = 0;
+        for (const file of deleted) {
+            const reactivated = await db.run(`
+                UPDATE access_grants SET is_active = 1, deactivated_at = NULL
+                WHERE cid = ? AND is_active = 0 AND deactivated_at = ?
+            `, [file.cid, file.deleted_at]);
+            grants += reactivated.changes;
+            await db.run(
+                'UPDATE file_records SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE cid = ?',
+                [file.cid]
+            );
+        }
+        return { cids: deleted.map(file => file.cid), grants };
+    });
+}
+
+// Binds the token to the filters, the delete mode and the exact set of matching rows
+function bulkDeleteConfirmationToken(filters, hardDelete, ids) {
+    return crypto.createHash('sha256')
+        .update(JSON.stringify({ filters, hard_delete: hardDelete, ids }))
+        .digest('hex');
+}
+
+app.post('/admin/files/bulk-delete', requireAdmin, async (req, res) => {
+    try {
+        const { dry_run = false, hard_delete = false, confirmation_token } = req.body;
+
+        if (typeof dry_run !== 'boolean' || typeof hard_delete !== 'boolean') {
+            return res.status(400).json({
+                success: false,
+                error: 'dry_run and hard_delete must be booleans'
+            });
+        }
+
+        const parsed = parseBulkDeleteFilters(req.body);
+        if (parsed.error) {
+            return res.status(400).json({
+                success: false,
+                error: parsed.error
+            });
+        }
+        const filters = parsed.value;
+
+        // Already soft-deleted files only match when purging them for good
+        let sql = hard_delete ? 'SELECT id, cid FROM file_records WHERE 1 = 1' :
+            'SELECT id, cid FROM file_records WHERE deleted_at IS NULL';
+        const params = [];
+
+        if (filters.uploader) {
+            sql += ' AND LOWER(uploader_addr) = ?';
+            params.push(filters.uploader);
+        }
+        if (filters.status) {
+            sql += ' AND status = ?';
+            params.push(filters.status);
+        }
+        // created_at is stored as CURRENT_TIMESTAMP text and the range as ISO 8601;
+        // compare them as datetimes, not strings
+        if (filters.from) {
+            sql += ' AND datetime(created_at) >= datetime(?)';
+            params.push(filters.from);
+        }
+        if (filters.to) {
+            sql += ' AND datetime(created_at) <= datetime(?)';
+            params.push(filters.to);
+        }
+        if (filters.cids) {
+            sql += ` AND cid IN (${filters.cids.map(() => '?').join(', ')})`;
+            params.push(...filters.cids);
+        }
+        sql += ' ORDER BY id LIMIT ?';
+        params.push(BULK_DELETE_MAX_FILES + 1);
+
+        const matches = await db.all(sql, params);
+        if (matches.length > BULK_DELETE_MAX_FILES) {
+            return res.status(400).json({
+                success: false,
+                error: `Filters match more than ${BULK_DELETE_MAX_FILES} files; narrow them and try again`
+            });
+        }
+
+        const cids = matches.map(row => row.cid);
+        const token = bulkDeleteConfirmationToken(filters, hard_delete, matches.map(row => row.id));
+
+        if (dry_run) {
+            const grants = cids.length === 0 ? { count: 0 } : await db.get(
+                `SELECT COUNT(*) as count FROM access_grants WHERE is_active = 1 AND cid IN (${cids.map(() => '?').join(', ')})`,
+                cids
+            );
+            return res.json({
+                success: true,
+                data: {
+                    dry_run: true,
+                    hard_delete,
+                    files: cids.length,
+                    active_grants: grants.count,
+                    cids,
+                    confirmation_token: token
+                }
             });
         }
-        
-        // Validate file size (100MB limit)
-        if (fileBuffer.length > 100 * 1024 * 1024) {
+
+        if (typeof confirmation_token !== 'string' || !confirmation_token) {
             return res.status(400).json({
                 success: false,
-                error: 'File size exceeds 100MB limit'
+                error: 'confirmation_token is required; run with dry_run: true to obtain one'
             });
         }
-        
-        // Encrypt if requested
-        let fileToUpload = fileBuffer;
-        if (should_encrypt) {
-            console.log('🔐 Encrypting file...');
-            const userKey = await EncryptionService.getUserKey(user_address);
-            fileToUpload = EncryptionService.encrypt(fileBuffer, userKey);
+        if (confirmation_token !== token) {
+            return res.status(409).json({
+                success: false,
+                error: 'confirmation_token does not match these filters or the matching files changed; run the dry run again'
+            });
         }
-        
-        // Upload to Web3.Storage
-        console.log('📤 Uploading to Web3.Storage...');
-        const fileObj = new File([fileToUpload], file_name, { 
-            type: content_type || 'application/octet-stream' 
-        });
-        
-        const cid = await w3upClient.uploadFile(fileObj);
-        console.log(`✅ Upload successful! CID: ${cid}`);
-        
-        // Record on blockchain AND automatically claim reward
-        let txHash = null;
-        let rewardTxHash = null;
-        let expectedReward = "0";
-        let actualReward = "0";
 
-        try {
-            // Calculate expected reward
-            expectedReward = await contractService.calculateReward(fileBuffer.length, should_encrypt);
-            console.log(`💰 Expected reward: ${expectedReward} FIL`);
-            
-            // Record upload on blockchain
-            if (contractService.isContractReady()) {
-                console.log(`🔗 Recording file on blockchain...`);
-                txHash = await contractService.recordFileUpload(
-                    cid.toString(),
-                    fileBuffer.length,
-                    should_encrypt,
-                    metadata,
-                    user_address
-                );
-                
-                if (txHash) {
-                    console.log(`✅ File recorded on blockchain: ${txHash}`);
-                    
-                    // AUTOMATICALLY CLAIM REWARD IMMEDIATELY
-                    console.log(`🏆 Automatically claiming reward...`);
-                    try {
-                        const rewardResult = await contractService.claimUploadReward(cid.toString());
-                        if (rewardResult) {
-                            rewardTxHash = rewardResult.txHash;
-                            actualReward = rewardResult.amount;
-                            console.log(`✅ Reward automatically distributed: ${actualReward} FIL`);
-                            console.log(`💸 Reward transaction: ${rewardTxHash}`);
-                        } else {
-                            console.log(`⚠️ Automatic reward failed - user can claim manually later`);
-                        }
-                    } catch (rewardError) {
-                        console.log(`⚠️ Auto-reward error: ${rewardError.message}`);
-                    }
-                } else {
-                    console.log(`⚠️ File recording failed, skipping rewards`);
-                }
-            } else {
-                console.log(`⚠️ Contract not ready, skipping blockchain operations`);
-            }
-        } catch (error) {
-            console.log('⚠️ Blockchain operations failed:', error.message);
+        const placeholders = cids.map(() => '?').join(', ');
+        let grantsAffected = 0;
+
+        if (cids.length > 0 && hard_delete) {
+            await withTransaction(async () => {
+                const grants = await db.run(`DELETE FROM access_grants WHERE cid IN (${placeholders})`, cids);
+                grantsAffected = grants.changes;
+                await db.run(`DELETE FROM share_links WHERE cid IN (${placeholders})`, cids);
+                await db.run(`DELETE FROM file_entries WHERE parent_cid IN (${placeholders})`, cids);
+                await db.run(`DELETE FROM upload_receipts WHERE cid IN (${placeholders})`, cids);
+                await db.run(`DELETE FROM file_records WHERE cid IN (${placeholders})`, cids);
+            });
+        } else if (cids.length > 0) {
+            grantsAffected = await softDeleteFiles(cids);
         }
-        
-        // Store in database
-        await db.run(`
-            INSERT INTO file_records 
-            (cid, uploader_addr, file_size, is_encrypted, file_name, content_type, metadata, status, tx_hash)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-        `, [
-            cid.toString(),
-            user_address,
-            fileBuffer.length,
-            should_encrypt ? 1 : 0,
-            file_name,
-            content_type,
-            JSON.stringify(metadata || {}),
-            'confirmed',
-            txHash
-        ]);
-        
-        // Enhanced response with reward information
+
+        console.log(`🗑️ ${req.user.address} ${hard_delete ? 'hard' : 'soft'}-deleted ${cids.length} files (${grantsAffected} grants) with filters ${JSON.stringify(filters)}`);
+
         res.json({
             success: true,
             data: {
-                cid: cid.toString(),
-                file_size: fileBuffer.length,
-                is_encrypted: should_encrypt,
-                status: 'confirmed',
-                gateway_url: `https://w3s.link/ipfs/${cid}`,
-                
-                // Blockchain info
-                tx_hash: txHash,
-                blockchain_stored: !!txHash,
-                
-                // Reward info
-                reward_tx_hash: rewardTxHash,
-                reward_distributed: !!rewardTxHash,
-                expected_reward_fil: expectedReward,
-                actual_reward_fil: actualReward || expectedReward,
-                
-                // User-friendly message
-                message: rewardTxHash ? 
-                    `File uploaded and ${actualReward} FIL reward sent to your wallet!` : 
-                    txHash ? 
-                        'File uploaded successfully - reward can be claimed manually' :
-                        'File uploaded to storage only'
+                dry_run: false,
+                hard_delete,
+                files: cids.length,
+                grants: grantsAffected,
+                cids
             }
         });
-        
+
     } catch (error) {
-        console.error('Upload error:', error);
+        console.error('Bulk delete error:', error);
         res.status(500).json({
             success: false,
-            error: 'Storage upload failed',
-            details: process.env.NODE_ENV === 'development' ? error.message : undefined
+            error: 'Failed to delete files',
+            details: exposeErrorDetails() ? error.message : undefined
         });
     }
 });
-// File retrieval
-app.post('/retrieve', async (req, res) => {
+
+// Admin: undo a soft delete. Clears deleted_at and reactivates the grants that delete
+// deactivated; grants revoked before it stay revoked. Hard-deleted files are gone for good.
+app.post('/admin/files/bulk-restore', requireAdmin, async (req, res) => {
     try {
-        const { cid, user_address } = req.body;
-        
-        console.log(`🔄 Retrieve request: ${cid} for ${user_address}`);
-        
-        // Basic validation only
-        if (!cid || !user_address) {
+        const { cids } = req.body;
+
+        if (!Array.isArray(cids) || cids.length === 0 ||
+            cids.some(cid => typeof cid !== 'string' || !cid)) {
             return res.status(400).json({
                 success: false,
-                error: 'Missing required fields: cid, user_address'
+                error: 'cids must be a non-empty array of CIDs'
             });
         }
-        
-        // Validate Ethereum address format
-        if (!AuthService.isValidAddress(user_address)) {
+        if (cids.length > BULK_DELETE_MAX_FILES) {
             return res.status(400).json({
                 success: false,
-                error: 'Invalid Ethereum address format'
-            });
-        }
-        
-        // Get file record
-        const fileRecord = await db.get(
-            'SELECT * FROM file_records WHERE cid = ?',
-            [cid]
-        );
-        
-        if (!fileRecord) {
-            console.log(`❌ File not found in database: ${cid}`);
-            return res.status(404).json({
-                success: false,
-                error: 'File not found'
-            });
-        }
-        
-        console.log(`✅ File found in database: ${fileRecord.file_name}`);
-        
-        // Check access permissions - simplified for now
-        const hasAccess = fileRecord.uploader_addr.toLowerCase() === user_address.toLowerCase();
-        if (!hasAccess) {
-            console.log(`❌ Access denied for ${user_address}`);
-            return res.status(403).json({
-                success: false,
-                error: 'Access denied - not the file owner'
+                error: `At most ${BULK_DELETE_MAX_FILES} CIDs can be restored at once`
             });
         }
-        
-        console.log(`✅ Access granted to file owner`);
-        
-        // Retrieve from Web3.Storage
-        console.log(`📥 Retrieving from IPFS: ${cid}`);
-        const response = await fetch(`https://w3s.link/ipfs/${cid}`);
-        
-        if (!response.ok) {
-            console.log(`❌ IPFS retrieval failed: ${response.status}`);
-            throw new Error(`Failed to retrieve file: ${response.status}`);
-        }
-        
-        let fileData = await response.arrayBuffer();
-        console.log(`✅ Retrieved ${fileData.byteLength} bytes from IPFS`);
-        
-        // Handle encryption (if file was encrypted)
-        if (fileRecord.is_encrypted) {
-            console.log('🔓 Decrypting file...');
-            try {
-                const userKey = await EncryptionService.getUserKey(user_address);
-                fileData = EncryptionService.decrypt(Buffer.from(fileData), userKey);
-            } catch (decryptError) {
-                console.error('❌ Decryption failed:', decryptError.message);
-                return res.status(500).json({
-                    success: false,
-                    error: 'Decryption failed'
-                });
-            }
-        }
-        
+
+        const restored = await restoreFiles([...new Set(cids)]);
+
+        console.log(`♻️ ${req.user.address} restored ${restored.cids.length} files (${restored.grants} grants)`);
+
         res.json({
             success: true,
             data: {
-                file: Buffer.from(fileData).toString('base64'),
-                file_name: fileRecord.file_name,
-                content_type: fileRecord.content_type,
-                metadata: fileRecord.metadata,
-                file_size: fileRecord.file_size,
-                is_encrypted: fileRecord.is_encrypted
+                files: restored.cids.length,
+                grants: restored.grants,
+                cids: restored.cids
             }
         });
-        
-        console.log(`✅ File retrieval successful: ${fileRecord.file_name}`);
-        
+
     } catch (error) {
-        console.error('❌ Retrieve error:', error.message);
+        console.error('Bulk restore error:', error);
         res.status(500).json({
             success: false,
-            error: 'File retrieval failed',
-            details: process.env.NODE_ENV === 'development' ? error.message : undefined
+            error: 'Failed to restore files',
+            details: exposeErrorDetails() ? error.message : undefined
         });
     }
 });
 
-// Grant access
-// Simplified access grant endpoint - replace the existing /access/grant route
+// Admin: compare database file records and grants for a CID, or for every file of an
+// uploader, against the contract. Read-only. Only grants the database mirrors on-chain
+// (single grantee, owner-granted, read, no download limit) are compared.
+const RECONCILE_MAX_FILES = parseInt(process.env.RECONCILE_MAX_FILES) || 50;
+const RECONCILE_EXPIRY_TOLERANCE_MS = 10 * 60 * 1000;
 
-app.post('/access/grant', async (req, res) => {
+app.get('/admin/reconcile', requireAdmin, async (req, res) => {
     try {
-        const { cid, grantee, duration, granter } = req.body;
-        
-        // Basic validation only
-        if (!cid || !grantee || !granter) {
+        const { cid, user } = req.query;
+
+        if (!cid && !user) {
             return res.status(400).json({
                 success: false,
-                error: 'Missing required fields: cid, grantee, granter'
+                error: 'Specify cid or user'
             });
         }
-        
-        // Validate Ethereum addresses
-        if (!AuthService.isValidAddress(granter)) {
+        if (user && !AuthService.isValidAddress(user)) {
             return res.status(400).json({
                 success: false,
-                error: 'Invalid granter address format'
+                error: 'Invalid user address format'
             });
         }
-        
-        if (!AuthService.isValidAddress(grantee)) {
-            return res.status(400).json({
+        if (!contractService.isContractReady()) {
+            return res.status(503).json({
                 success: false,
-                error: 'Invalid grantee address format'
+                error: 'Blockchain service not available'
             });
         }
-        
-        // Check if granter owns the file
-        const fileRecord = await db.get(
-            'SELECT * FROM file_records WHERE cid = ? AND uploader_addr = ?',
-            [cid, granter]
-        );
-        
-        if (!fileRecord) {
-            return res.status(403).json({
-                success: false,
-                error: 'Not authorized to grant access - file not found or not owned by granter'
+
+        const files = cid ?
+            await readDb(req).all('SELECT * FROM file_records WHERE cid = ?', [cid]) :
+            await readDb(req).all(
+                'SELECT * FROM file_records WHERE LOWER(uploader_addr) = LOWER(?) ORDER BY created_at DESC, id DESC LIMIT ?',
+                [user, RECONCILE_MAX_FILES + 1]
+            );
+        const truncated = files.length > RECONCILE_MAX_FILES;
+        const signal = requestSignal(req, res);
+        const report = [];
+
+        for (const fileRecord of files.slice(0, RECONCILE_MAX_FILES)) {
+            const discrepancies = [];
+            const chainRecord = await contractService.getFileRecord(fileRecord.cid, { signal });
+
+            if (!chainRecord) {
+                if (fileRecord.status === 'confirmed' || fileRecord.status === 'unavailable') {
+                    discrepancies.push({ type: 'file_missing_on_chain', db: fileRecord.status, chain: null });
+                }
+            } else {
+                if (fileRecord.status === 'pending' || fileRecord.status === 'failed') {
+                    discrepancies.push({ type: 'file_status_behind_chain', db: fileRecord.status, chain: 'recorded' });
+                }
+                // recordUpload is sent by the server wallet, so that is the uploader the
+                // contract stores - never the user in file_records.uploader_addr
+                const signer = contractService.getSignerAddress();
+                if (signer && chainRecord.uploader.toLowerCase() !== signer.toLowerCase()) {
+                    discrepancies.push({ type: 'recorded_by_other_wallet', expected: signer, chain: chainRecord.uploader });
+                }
+                if (chainRecord.fileSize !== String(fileRecord.file_size)) {
+                    discrepancies.push({ type: 'file_size_mismatch', db: fileRecord.file_size, chain: chainRecord.fileSize });
+                }
+                if (chainRecord.isEncrypted !== !!fileRecord.is_encrypted) {
+                    discrepancies.push({ type: 'encryption_mismatch', db: !!fileRecord.is_encrypted, chain: chainRecord.isEncrypted });
+                }
+                if (chainRecord.rewardClaimed !== !!fileRecord.reward_claimed) {
+                    discrepancies.push({ type: 'reward_claimed_mismatch', db: !!fileRecord.reward_claimed, chain: chainRecord.rewardClaimed });
+                }
+            }
+
+            const grants = await readDb(req).all(`
+                SELECT * FROM access_grants
+                WHERE cid = ? AND group_id IS NULL AND grantee_addr != '' AND max_downloads IS NULL
+                AND LOWER(granter_addr) = LOWER(?) AND (',' || permissions || ',') LIKE '%,read,%'
+            `, [fileRecord.cid, fileRecord.uploader_addr]);
+
+            for (const grant of grants) {
+                const chainGrant = await contractService.getAccessGrant(fileRecord.cid, grant.grantee_addr, { signal });
+                const dbActive = !!grant.is_active && grant.expires_at > new Date().toISOString();
+                const chainActive = !!chainGrant && chainGrant.isActive &&
+                    (!chainGrant.expiresAt || chainGrant.expiresAt > new Date().toISOString());
+                const base = { grant_id: grant.id, grantee: grant.grantee_addr.toLowerCase() };
+
+                if (dbActive && !chainActive) {
+                    discrepancies.push({ ...base, type: 'grant_inactive_on_chain', db: 'active', chain: chainGrant ? 'revoked_or_expired' : 'missing' });
+                } else if (!dbActive && chainActive) {
+                    discrepancies.push({ ...base, type: 'grant_active_on_chain_only', db: grant.is_active ? 'expired' : 'revoked', chain: 'active' });
+                } else if (dbActive && chainActive) {
+                    const dbPermanent = grant.expires_at >= PERMANENT_GRANT_EXPIRY;
+                    const drift = dbPermanent || !chainGrant.expiresAt ?
+                        (dbPermanent !== !chainGrant.expiresAt ? Infinity : 0) :
+                        Math.abs(new Date(grant.expires_at).getTime() - new Date(chainGrant.expiresAt).getTime());
+                    if (drift > RECONCILE_EXPIRY_TOLERANCE_MS) {
+                        discrepancies.push({ ...base, type: 'grant_expiry_mismatch', db: grant.expires_at, chain: chainGrant.expiresAt });
+                    }
+                }
+            }
+
+            report.push({
+                cid: fileRecord.cid,
+                status: fileRecord.status,
+                grants_checked: grants.length,
+                consistent: discrepancies.length === 0,
+                discrepancies
             });
         }
-        
-        // Grant access on blockchain (optional)
-        let blockchainTxHash = null;
-        try {
-            if (contractService.isContractReady()) {
-                blockchainTxHash = await contractService.grantFileAccess(cid, grantee, duration || 0);
+
+        res.json({
+            success: true,
+            data: {
+                files_checked: report.length,
+                inconsistent_files: report.filter(entry => !entry.consistent).length,
+                truncated,
+                files: report
             }
-        } catch (error) {
-            console.log('⚠️ Blockchain access grant failed, continuing with database only');
-        }
-        
-        // Create access grant in database
-        const expiresAt = duration ? 
-            new Date(Date.now() + duration * 1000).toISOString() : 
-            new Date('2099-12-31').toISOString();
-        
-        await db.run(`
-            INSERT INTO access_grants (cid, granter_addr, grantee_addr, expires_at, is_active)
-            VALUES (?, ?, ?, ?, ?)
-        `, [cid, granter, grantee, expiresAt, 1]);
-        
+        });
+
+    } catch (error) {
+        console.error('Reconcile error:', error);
+        res.status(error.message.includes('timed out') ? 504 : 500).json({
+            success: false,
+            error: 'Failed to reconcile with the chain',
+            details: exposeErrorDetails() ? error.message : undefined
+        });
+    }
+});
+
+// Admin: contract events that could not be applied
+app.get('/admin/events', requireAdmin, async (req, res) => {
+    try {
+        const status = req.query.status || 'dead_letter';
+        const { limit } = parseListParams(req.query, ['created_at']);
+
+        const events = await db.all(`
+            SELECT * FROM chain_events WHERE status = ?
+            ORDER BY block_number DESC, log_index DESC
+            LIMIT ?
+        `, [status, limit]);
+
         res.json({
             success: true,
             data: {
-                cid,
-                grantee,
-                expires_at: expiresAt,
-                granted_at: new Date().toISOString(),
-                blockchain_tx: blockchainTxHash
+                events: events.map(e => ({ ...e, payload: JSON.parse(e.payload) }))
             }
         });
-        
+
     } catch (error) {
-        console.error('Grant access error:', error);
+        console.error('List events error:', error);
         res.status(500).json({
             success: false,
-            error: 'Failed to grant access',
-            details: process.env.NODE_ENV === 'development' ? error.message : undefined
+            error: 'Failed to list events'
         });
     }
 });
 
-// Manual reward claiming (backup option)
-// Simplified reward claim endpoint - replace the existing /rewards/claim route
-
-app.post('/rewards/claim', async (req, res) => {
+app.post('/admin/events/:eventId/retry', requireAdmin, async (req, res) => {
     try {
-        const { cid, user_address } = req.body;
-        
-        // Basic validation only
-        if (!cid || !user_address) {
-            return res.status(400).json({
-                success: false,
-                error: 'Missing required fields: cid, user_address'
-            });
-        }
-        
-        // Validate Ethereum address
-        if (!AuthService.isValidAddress(user_address)) {
-            return res.status(400).json({
-                success: false,
-                error: 'Invalid Ethereum address format'
-            });
-        }
-        
-        // Check if file exists in database and user is the uploader
-        const fileRecord = await db.get(
-            'SELECT * FROM file_records WHERE cid = ? AND uploader_addr = ?',
-            [cid, user_address]
-        );
-        
-        if (!fileRecord) {
+        const result = await db.run(`
+            UPDATE chain_events
+            SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+            WHERE event_id = ? AND status = 'dead_letter'
+        `, [req.params.eventId]);
+
+        if (result.changes === 0) {
             return res.status(404).json({
                 success: false,
-                error: 'File not found or not owned by user'
-            });
-        }
-        
-        if (!contractService.isContractReady()) {
-            return res.status(503).json({
-                success: false,
-                error: 'Blockchain service not available'
-            });
-        }
-        
-        try {
-            // Claim reward on blockchain
-            const rewardResult = await contractService.claimUploadReward(cid);
-            
-            if (rewardResult) {
-                res.json({
-                    success: true,
-                    data: {
-                        cid,
-                        tx_hash: rewardResult.txHash,
-                        reward_amount: rewardResult.amount,
-                        block_number: rewardResult.blockNumber,
-                        message: `Reward of ${rewardResult.amount} FIL claimed successfully`
-                    }
-                });
-            } else {
-                res.status(400).json({
-                    success: false,
-                    error: 'Failed to claim reward'
-                });
-            }
-            
-        } catch (contractError) {
-            res.status(400).json({
-                success: false,
-                error: contractError.message
+                error: 'Dead-lettered event not found'
             });
         }
-        
+
+        await chainEventIndexer.processPending();
+        const event = await db.get('SELECT * FROM chain_events WHERE event_id = ?', [req.params.eventId]);
+
+        res.json({
+            success: true,
+            data: { ...event, payload: JSON.parse(event.payload) }
+        });
+
+    } catch (error) {
+        console.error('Retry event error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to retry event'
+        });
+    }
+});
+
+// On-demand database backup. VACUUM INTO takes a consistent snapshot without
+// stopping the server; restores are done offline with `npm run db:restore`.
+app.post('/admin/backup', requireAdmin, async (req, res) => {
+    try {
+        const backup = await backupScheduler.createBackup('manual');
+        console.log(`💾 Backup ${backup.id} requested by ${req.user.address}`);
+
+        res.json({
+            success: true,
+            data: backup
+        });
+
     } catch (error) {
-        console.error('Claim reward error:', error);
+        console.error('Backup error:', error);
         res.status(500).json({
             success: false,
-            error: 'Failed to process reward claim',
-            details: process.env.NODE_ENV === 'development' ? error.message : undefined
+            error: 'Database backup failed',
+            details: exposeErrorDetails() ? error.message : undefined
         });
     }
 });
 
-// User stats with blockchain data
-app.get('/users/:address/stats', async (req, res) => {
+// Backup history and schedule
+app.get('/admin/backups', requireAdmin, async (req, res) => {
     try {
-        const { address } = req.params;
-        
-        // Get database stats
-        const dbStats = await db.get(`
-            SELECT 
-                COUNT(*) as total_files,
-                SUM(file_size) as total_size,
-                SUM(CASE WHEN is_encrypted = 1 THEN 1 ELSE 0 END) as encrypted_files
-            FROM file_records 
-            WHERE uploader_addr = ?
-        `, [address]);
-        
-        // Get blockchain stats
-        let blockchainStats = {
-            reward_balance: "0",
-            blockchain_files: [],
-            can_claim_rewards: false
-        };
-        
-        try {
-            if (contractService.isReady) {
-                const rewardBalance = await contractService.getUserRewardBalance(address);
-                
-                blockchainStats = {
-                    reward_balance: rewardBalance,
-                    blockchain_files: [],
-                    can_claim_rewards: false
-                };
-            }
-        } catch (error) {
-            console.log('⚠️ Could not fetch blockchain stats');
-        }
-        
+        const { limit } = parseListParams(req.query, ['created_at']);
+        const backups = await db.all('SELECT * FROM database_backups ORDER BY id DESC LIMIT ?', [limit]);
+
         res.json({
             success: true,
             data: {
-                // Database stats
-                total_files: dbStats.total_files || 0,
-                total_size_bytes: dbStats.total_size || 0,
-                encrypted_files: dbStats.encrypted_files || 0,
-                
-                // Blockchain stats
-                reward_balance_fil: blockchainStats.reward_balance,
-                blockchain_files_count: blockchainStats.blockchain_files.length,
-                can_claim_rewards: blockchainStats.can_claim_rewards,
-                
-                // Combined
-                rewards_earned: dbStats.total_files || 0
+                schedule: backupScheduler.getStatus(),
+                backups
             }
         });
-        
+
     } catch (error) {
-        console.error('Stats error:', error);
+        console.error('List backups error:', error);
         res.status(500).json({
             success: false,
-            error: 'Failed to get user stats'
+            error: 'Failed to list backups'
         });
     }
 });
 
-// User files
-app.get('/users/:address/files', async (req, res) => {
+// Storage availability: how many files are still retrievable, and checker run stats
+app.get('/admin/storage/availability', requireAdmin, async (req, res) => {
     try {
-        const { address } = req.params;
-        const page = parseInt(req.query.page) || 1;
-        const limit = parseInt(req.query.limit) || 20;
-        const offset = (page - 1) * limit;
-        
-        const files = await db.all(`
-            SELECT * FROM file_records 
-            WHERE uploader_addr = ? 
-            ORDER BY created_at DESC 
-            LIMIT ? OFFSET ?
-        `, [address, limit, offset]);
-        
-        const total = await db.get(
-            'SELECT COUNT(*) as count FROM file_records WHERE uploader_addr = ?',
-            [address]
-        );
-        
+        res.json({
+            success: true,
+            data: await storageAvailabilityChecker.getMetrics()
+        });
+
+    } catch (error) {
+        console.error('Storage availability error:', error);
+        res.status(500).json({
+            success: false,
+            error: 'Failed to load storage availability'
+        });
+    }
+});
+
+// Transaction signer to fund: its address and current on-chain balance
+app.get('/admin/signer', requireAdmin, async (req, res) => {
+    try {
+        const address = contractService.getSignerAddress();
+        let balance = null;
+
+        if (address && contractService.provider) {
+            try {
+                balance = await contractService.withDeadline(
+                    () => contractService.provider.getBalance(address),
+                    { signal: requestSignal(req, res) }
+                );
+            } catch (error) {
+                console.log('⚠️ Could not read signer balance:', error.message);
+            }
+        }
+
         res.json({
             success: true,
             data: {
-                files,
-                pagination: {
-                    page,
-                    limit,
-                    total: total.count,
-                    total_pages: Math.ceil(total.count / limit)
-                }
+                address,
+                balance_fil: balance !== null ? ethers.formatEther(balance) : null,
+                balance_wei: balance !== null ? balance.toString() : null,
+                rpc_connected: !!contractService.provider,
+                metadata_signer: MetadataSigner.getSigner()?.address || null
             }
         });
-        
+
     } catch (error) {
-        console.error('Files error:', error);
+        console.error('Signer status error:', error);
         res.status(500).json({
             success: false,
-            error: 'Failed to get user files'
+            error: 'Failed to load signer status'
         });
     }
 });
 
-// Contract statistics
-app.get('/contract/stats', async (req, res) => {
+// Schema as initializeDatabase left it, with the migrations it has applied
+app.get('/admin/schema', requireAdmin, async (req, res) => {
     try {
-        if (!contractService.isReady) {
-            return res.json({
-                success: false,
-                error: 'Contract not available'
-            });
-        }
-        
-        const stats = await contractService.getContractStats();
-        
-        if (!stats) {
-            return res.status(500).json({
-                success: false,
-                error: 'Failed to fetch contract statistics'
-            });
+        const tables = await db.all(`
+            SELECT name FROM sqlite_master
+            WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+            ORDER BY name
+        `);
+
+        const schema = {};
+        for (const { name } of tables) {
+            const columns = await db.all(`PRAGMA table_info(${name})`);
+            const indexes = await db.all(`PRAGMA index_list(${name})`);
+            schema[name] = {
+                columns: columns.map(c => ({
+                    name: c.name,
+                    type: c.type,
+                    not_null: c.notnull === 1,
+                    default: c.dflt_value,
+                    primary_key: c.pk > 0
+                })),
+                indexes: indexes.map(i => ({ name: i.name, unique: i.unique === 1 }))
+            };
         }
-        
+
+        const integrity = await db.get('PRAGMA quick_check');
+        const migrations = await db.all('SELECT name, checksum, applied_at FROM schema_migrations ORDER BY rowid');
+
         res.json({
             success: true,
             data: {
-                contract_address: process.env.CONTRACT_ADDRESS,
-                network: "Filecoin Calibration Testnet",
-                total_files_stored: stats.totalFiles,
-                total_rewards_distributed_fil: stats.totalRewardsDistributed,
-                total_storage_used_bytes: stats.totalStorageUsed,
-                reward_config: {
-                    base_reward_fil: stats.baseRewardAmount,
-                    size_multiplier: stats.sizeMultiplier,
-                    encryption_bonus_fil: stats.encryptionBonus
-                }
+                tables: schema,
+                migrations,
+                integrity: integrity.quick_check
             }
         });
-        
+
     } catch (error) {
-        console.error('Contract stats error:', error);
+        console.error('Schema status error:', error);
         res.status(500).json({
             success: false,
-            error: 'Failed to get contract statistics'
+            error: 'Failed to load schema status'
+        });
+    }
+});
+
+// Body parser failures as JSON instead of Express's default HTML error page
+app.use((error, req, res, next) => {
+    if (error.type === 'entity.too.large') {
+        return res.status(413).json({
+            success: false,
+            error: `Request body exceeds ${error.limit} bytes`
+        });
+    }
+    if (error.type === 'entity.parse.failed') {
+        return res.status(400).json({
+            success: false,
+            error: 'Malformed JSON body'
+        });
+    }
+    next(error);
+});
+
+// Helper functions
+
+const DEFAULT_PAGE_SIZE = 20;
+const MAX_PAGE_SIZE = parseInt(process.env.MAX_PAGE_SIZE) || 100;
+const FILE_SORT_COLUMNS = ['created_at', 'updated_at', 'file_size', 'file_name', 'status'];
+
+// Validate list query params. sort_by must be one of sortColumns and order must be
+// asc/desc, since both end up interpolated into ORDER BY. limit is clamped.
+function parseListParams(query, sortColumns) {
+    const errors = [];
+
+    let limit = parseInt(query.limit) || DEFAULT_PAGE_SIZE;
+    limit = Math.min(Math.max(limit, 1), MAX_PAGE_SIZE);
+
+    const sortBy = query.sort_by || 'created_at';
+    if (!sortColumns.includes(sortBy)) {
+        errors.push({ field: 'sort_by', message: `sort_by must be one of: ${sortColumns.join(', ')}` });
+    }
+
+    const order = (query.order || 'desc').toLowerCase();
+    if (order !== 'asc' && order !== 'desc') {
+        errors.push({ field: 'order', message: 'order must be asc or desc' });
+    }
+
+    return { limit, sortBy, order: order.toUpperCase(), errors };
+}
+
+// Upload response for content the user has already stored
+function deduplicatedUploadResponse(fileRecord) {
+    return {
+        success: true,
+        data: {
+            cid: fileRecord.cid,
+            file_size: fileRecord.file_size,
+            is_encrypted: !!fileRecord.is_encrypted,
+            encryption_algorithm: fileRecord.encryption_algorithm,
+            encryption_mode: fileRecord.encryption_mode,
+            status: fileRecord.status,
+            gateway_url: StorageService.getGatewayUrl(fileRecord.cid),
+            tx_hash: fileRecord.tx_hash,
+            blockchain_stored: !!fileRecord.tx_hash,
+            deduplicated: true,
+            message: 'File already uploaded - returning existing record'
+        }
+    };
+}
+
+// Response for an upload whose CID is already in file_records (CIDs are unique across
+// apps, as on-chain): the existing record if it is the caller's own, otherwise a 409
+// that does not say who holds it
+function respondToExistingCid(req, res, existing, userAddress) {
+    if (existing.deleted_at) {
+        return res.status(409).json({
+            success: false,
+            error: 'This content was deleted by an administrator and cannot be uploaded again',
+            cid: existing.cid
+        });
+    }
+    if (existing.uploader_addr.toLowerCase() === userAddress.toLowerCase() && existing.app_id === req.appId) {
+        return res.json(deduplicatedUploadResponse(existing));
+    }
+    return res.status(409).json({
+        success: false,
+        error: 'This content cannot be registered',
+        cid: existing.cid
+    });
+}
+
+// Caller identity for GET endpoints, which have no JSON body
+function getRequestAuth(req) {
+    return {
+        userAddress: req.headers['x-user-address'] || req.query.user_address,
+        signature: req.headers['x-signature'] || req.query.signature
+    };
+}
+
+// AbortSignal that fires if the client disconnects before the response is sent,
+// so in-flight blockchain calls for that request can be abandoned
+function requestSignal(req, res) {
+    if (!req.abortController) {
+        const controller = new AbortController();
+        res.on('close', () => {
+            if (!res.writableFinished) controller.abort();
+        });
+        req.abortController = controller;
+    }
+    return req.abortController.signal;
+}
+
+// Wallet-encrypted files can only be opened with the uploader's key signature,
+// which the caller must supply. Returns { key } (null for other modes) or { status, error }.
+async function resolveWalletKey(fileRecord, keySignature, requester = null) {
+    if (fileRecord.encryption_mode !== 'wallet') {
+        return { key: null };
+    }
+
+    // Grantees read with the copy escrowed on their grant, never the owner's signature
+    const isOwner = !!requester && requester.toLowerCase() === fileRecord.uploader_addr.toLowerCase();
+    if (fileRecord.owner_wrapped_file_key && requester && !isOwner) {
+        const grant = await findEscrowedFileKey(fileRecord.cid, requester, fileRecord.app_id);
+        if (grant) {
+            return { key: await getKeyStore(grant.file_key_wrapping).unwrap(grant.wrapped_file_key) };
+        }
+    }
+
+    if (!keySignature) {
+        return { status: 400, error: 'key_signature is required for wallet-encrypted files' };
+    }
+
+    const walletKey = await EncryptionService.getWalletKey(fileRecord.uploader_addr, keySignature);
+    if (!walletKey) {
+        return { status: 403, error: "key_signature does not reproduce the file owner's key" };
+    }
+    // Files from before per-file keys were encrypted with the wallet key itself
+    if (!fileRecord.owner_wrapped_file_key) {
+        return { key: walletKey };
+    }
+    return {
+        key: EncryptionService.unwrapFileKey(
+            fileRecord.owner_wrapped_file_key, walletKey, Buffer.from(fileRecord.file_key_salt, 'hex')
+        )
+    };
+}
+
+// Newest active grant on cid escrowing the file key for grantee, directly or through a group
+async function findEscrowedFileKey(cid, grantee, appId) {
+    return db.get(`
+        SELECT wrapped_file_key, file_key_wrapping FROM access_grants
+        WHERE cid = ? AND app_id = ? AND is_active = 1 AND wrapped_file_key IS NOT NULL
+        AND (LOWER(grantee_addr) = LOWER(?) OR group_id IN (
+            SELECT group_id FROM access_group_members WHERE member_addr = LOWER(?)
+        ))
+        AND (expires_at IS NULL OR expires_at > ?)
+        ORDER BY id DESC LIMIT 1
+    `, [cid, appId, grantee, grantee, new Date().toISOString()]);
+}
+
+// The file key to escrow on a new grant of a wallet-encrypted file, wrapped by the key
+// store, so the grantee can read that one file without the owner's key signature.
+// Owners unlock it with key_signature; re-sharers pass on the copy from their own
+// grant. { value: { wrapped, wrapping } }, { value: null } when nothing needs
+// escrowing (other modes, files from before per-file keys), or { status, error }.
+async function escrowFileKeyForGrant(fileRecord, keySignature, sourceGrant = null) {
+    if (!fileRecord || fileRecord.encryption_mode !== 'wallet' || !fileRecord.owner_wrapped_file_key) {
+        return { value: null };
+    }
+
+    let fileKey;
+    if (sourceGrant) {
+        if (!sourceGrant.wrapped_file_key) {
+            return { value: null };
+        }
+        fileKey = await getKeyStore(sourceGrant.file_key_wrapping).unwrap(sourceGrant.wrapped_file_key);
+    } else {
+        const resolved = await resolveWalletKey(fileRecord, keySignature, fileRecord.uploader_addr);
+        if (resolved.error) {
+            return {
+                status: resolved.status,
+                error: resolved.status === 400 ? 'key_signature is required to share a wallet-encrypted file' : resolved.error
+            };
+        }
+        fileKey = resolved.key;
+    }
+    return { value: { wrapped: await keyStore.wrap(fileKey), wrapping: keyStore.name } };
+}
+
+// Server-mode files are encrypted with the uploader's key, so grantees decrypt with it
+// too. Client-encrypted files never reach here: the server holds no key for them.
+// Wallet-encrypted files need the key from resolveWalletKey.
+async function decryptFileContent(fileRecord, encryptedData, walletKey = null) {
+    if (fileRecord.encryption_mode === 'client') {
+        throw new Error('Client-encrypted files cannot be decrypted by the server');
+    }
+    if (fileRecord.encryption_mode === 'wallet' && !walletKey) {
+        throw new Error('Wallet-encrypted files need the owner key signature');
+    }
+
+    console.log('🔓 Decrypting file...');
+    const ownerKey = walletKey || await EncryptionService.getUserKey(fileRecord.uploader_addr, fileRecord.app_id);
+    return EncryptionService.decrypt(
+        Buffer.from(encryptedData),
+        ownerKey,
+        fileRecord.encryption_algorithm || 'aes-256-gcm'
+    );
+}
+
+// Parse a single "bytes=start-end" range. Returns null to serve the whole body
+// (no header, or a multi-range request we don't support) and false if unsatisfiable.
+function parseRangeHeader(header, size) {
+    if (!header) return null;
+
+    const match = /^bytes=(\d*)-(\d*)$/.exec(header.trim());
+    if (!match || (match[1] === '' && match[2] === '')) return null;
+
+    let start;
+    let end;
+    if (match[1] === '') {
+        // Suffix range: last N bytes
+        const suffix = parseInt(match[2]);
+        if (suffix === 0) return false;
+        start = Math.max(size - suffix, 0);
+        end = size - 1;
+    } else {
+        start = parseInt(match[1]);
+        end = match[2] === '' ? size - 1 : Math.min(parseInt(match[2]), size - 1);
+    }
+
+    if (start >= size || start > end) return false;
+    return { start, end };
+}
+
+function contentDisposition(fileName) {
+    const fallback = String(fileName).replace(/[^\x20-\x7e]|["\\]/g, '_');
+    return `attachment; filename="${fallback}"; filename*=UTF-8''${encodeURIComponent(fileName)}`;
+}
+
+function setFileHeaders(res, fileRecord) {
+    res.set('Content-Type', fileRecord.content_type || 'application/octet-stream');
+    res.set('Content-Disposition', contentDisposition(fileRecord.file_name));
+    res.set('Accept-Ranges', 'bytes');
+
+    // Content never changes for a CID. Plaintext files are public on IPFS anyway, so
+    // shared caches may keep them; anything encrypted is only cached by the client.
+    res.set('ETag', `"${fileRecord.cid}"`);
+    res.set('Cache-Control', fileRecord.is_encrypted || fileRecord.encryption_mode !== 'none'
+        ? `private, max-age=${DOWNLOAD_CACHE_MAX_AGE_SECONDS}`
+        : `public, max-age=${DOWNLOAD_CACHE_MAX_AGE_SECONDS}, immutable`);
+
+    // Client-encrypted bytes are sent as stored, so tell the caller how to open them
+    if (fileRecord.encryption_mode === 'client') {
+        res.set('X-Encryption-Mode', 'client');
+        if (fileRecord.wrapped_key) {
+            res.set('X-Wrapped-Key', fileRecord.wrapped_key);
+        }
+    }
+}
+
+// If-None-Match names this file's ETag (or is "*")
+function isNotModified(req, fileRecord) {
+    const header = req.headers['if-none-match'];
+    if (!header) return false;
+
+    return header.split(',')
+        .map(tag => tag.trim().replace(/^W\//, ''))
+        .some(tag => tag === '*' || tag === `"${fileRecord.cid}"`);
+}
+
+// Write an already-extracted byte range as 206 Partial Content
+function sendFileRange(res, chunk, range, totalSize, fileRecord) {
+    setFileHeaders(res, fileRecord);
+    res.status(206);
+    res.set('Content-Range', `bytes ${range.start}-${range.end}/${totalSize}`);
+    res.set('Content-Length', String(chunk.length));
+    res.end(chunk);
+}
+
+// Write file bytes as a binary response, honoring a Range header
+function sendFileBody(req, res, fileData, fileRecord) {
+    const size = fileData.length;
+    const range = parseRangeHeader(req.headers.range, size);
+
+    if (range === false) {
+        setFileHeaders(res, fileRecord);
+        res.set('Content-Range', `bytes */${size}`);
+        return res.status(416).end();
+    }
+
+    if (range) {
+        return sendFileRange(res, fileData.subarray(range.start, range.end + 1), range, size, fileRecord);
+    }
+
+    setFileHeaders(res, fileRecord);
+    res.set('Content-Length', String(size));
+    res.end(fileData);
+}
+
+const FILE_VISIBILITIES = ['private', 'public'];
+
+// Validate the upload fields shared by /upload and upload sessions. Returns
+// { value: { file_name, content_type, should_encrypt, user_address, metadata,
+// encryptionMode, wrappedKey, encryptionAlgorithm, visibility } } or { error }.
+function parseUploadOptions(body) {
+    const { file_name, content_type, should_encrypt, user_address } = body;
+
+    const parsedMetadata = parseMetadata(body.metadata);
+    if (parsedMetadata.error) {
+        return { error: parsedMetadata.error };
+    }
+
+    const encryptionMode = body.encryption_mode || (should_encrypt ? 'server' : 'none');
+    if (!ENCRYPTION_MODES.includes(encryptionMode)) {
+        return { error: `Unsupported encryption_mode. Allowed: ${ENCRYPTION_MODES.join(', ')}` };
+    }
+    const serverEncrypts = SERVER_ENCRYPTION_MODES.includes(encryptionMode);
+    if (!!should_encrypt !== serverEncrypts) {
+        return { error: `should_encrypt must be ${serverEncrypts} when encryption_mode is ${encryptionMode}` };
+    }
+
+    const wrappedKey = encryptionMode === 'client' ? (body.wrapped_key || null) : null;
+    if (wrappedKey !== null && (typeof wrappedKey !== 'string' || wrappedKey.length > MAX_WRAPPED_KEY_LENGTH)) {
+        return { error: `wrapped_key must be a string of at most ${MAX_WRAPPED_KEY_LENGTH} characters` };
+    }
+
+    const encryptionAlgorithm = should_encrypt
+        ? (body.encryption_algorithm || DEFAULT_ENCRYPTION_ALGORITHM)
+        : null;
+    if (should_encrypt && !EncryptionService.isSupportedAlgorithm(encryptionAlgorithm)) {
+        return { error: `Unsupported encryption_algorithm. Allowed: ${ENCRYPTION_ALGORITHMS.join(', ')}` };
+    }
+
+    const visibility = body.visibility || 'private';
+    if (!FILE_VISIBILITIES.includes(visibility)) {
+        return { error: `Unsupported visibility. Allowed: ${FILE_VISIBILITIES.join(', ')}` };
+    }
+    // Anonymous downloaders could never be given the key
+    if (visibility === 'public' && encryptionMode !== 'none') {
+        return { error: 'Encrypted files cannot be public' };
+    }
+
+    // Validate Ethereum address format
+    if (!AuthService.isValidAddress(user_address)) {
+        return { error: 'Invalid Ethereum address format' };
+    }
+
+    return {
+        value: {
+            file_name,
+            content_type,
+            should_encrypt: !!should_encrypt,
+            user_address,
+            metadata: parsedMetadata.value,
+            encryptionMode,
+            wrappedKey,
+            encryptionAlgorithm,
+            visibility
+        }
+    };
+}
+
+// Everything after the bytes are in hand: size check, dedup, quota, encryption,
+// storage, the file record and its blockchain job. Writes the response itself.
+// options come from parseUploadOptions, plus keySignature for wallet encryption.
+async function storeUpload(req, res, fileBuffer, options) {
+    const { file_name, content_type, should_encrypt, user_address, metadata, encryptionMode, wrappedKey, encryptionAlgorithm, visibility = 'private' } = options;
+
+    // Validate file size
+    if (fileBuffer.length > MAX_FILE_SIZE_BYTES) {
+        return res.status(413).json({
+            success: false,
+            error: `File size exceeds ${MAX_FILE_SIZE_LABEL} limit`,
+            code: 'FILE_TOO_LARGE'
+        });
+    }
+    
+    // Same bytes from the same user with the same encryption choice: reuse the
+    // existing record instead of paying for storage and gas again
+    const contentHash = crypto.createHash('sha256').update(fileBuffer).digest('hex');
+    const duplicate = await db.get(`
+        SELECT * FROM file_records
+        WHERE app_id = ? AND content_hash = ? AND LOWER(uploader_addr) = LOWER(?) AND is_encrypted = ? AND encryption_mode = ?
+        AND visibility = ? AND deleted_at IS NULL
+    `, [req.appId, contentHash, user_address, should_encrypt ? 1 : 0, encryptionMode, visibility]);
+
+    if (duplicate) {
+        console.log(`♻️ Duplicate upload of ${duplicate.cid}, returning existing record`);
+        return res.json(deduplicatedUploadResponse(duplicate));
+    }
+
+    const rejected = await scanUpload(fileBuffer, { fileName: file_name, contentType: content_type, uploader: user_address });
+    if (rejected) {
+        return res.status(rejected.status).json({
+            success: false,
+            error: rejected.error,
+            code: rejected.code,
+            reason: rejected.reason
+        });
+    }
+
+    // Rolling 24h quotas by role
+    const quota = await UploadQuotaService.check(user_address, fileBuffer.length);
+    res.set('X-Upload-Quota-Remaining', Number.isFinite(quota.remainingUploads) ? String(quota.remainingUploads) : 'unlimited');
+    res.set('X-Upload-Bytes-Remaining', Number.isFinite(quota.remainingBytes) ? String(quota.remainingBytes) : 'unlimited');
+
+    if (quota.exceeded) {
+        return res.status(429).json({
+            success: false,
+            error: `Daily upload quota exceeded (${quota.exceeded.quota})`,
+            code: 'QUOTA_EXCEEDED',
+            details: quota.exceeded
         });
     }
-});
 
-// Contract status
-app.get('/contract/status', async (req, res) => {
-    try {
-        if (!contractService.provider || !process.env.CONTRACT_ADDRESS) {
-            return res.json({
+    // Encrypt if requested
+    let fileToUpload = fileBuffer;
+    let fileKeySalt = null;
+    let ownerWrappedFileKey = null;
+    if (should_encrypt) {
+        console.log(`🔐 Encrypting file (${encryptionMode}, ${encryptionAlgorithm})...`);
+        const userKey = encryptionMode === 'wallet'
+            ? await EncryptionService.getWalletKey(user_address, options.keySignature)
+            : await EncryptionService.getUserKey(user_address, req.appId);
+
+        if (!userKey) {
+            return res.status(400).json({
                 success: false,
-                error: 'Contract not configured'
+                error: `key_signature must be the uploader's signature over "${WALLET_KEY_MESSAGE}" and match their existing key`
             });
         }
+        try {
+            let fileKey = userKey;
+            if (encryptionMode === 'wallet') {
+                fileKey = EncryptionService.generateKey();
+                const salt = crypto.randomBytes(16);
+                fileKeySalt = salt.toString('hex');
+                ownerWrappedFileKey = EncryptionService.wrapFileKey(fileKey, userKey, salt);
+            }
+            fileToUpload = EncryptionService.encrypt(fileBuffer, fileKey, encryptionAlgorithm);
+        } catch (error) {
+            throw appError('ENCRYPTION_FAILED', `Encryption failed: ${error.message}`);
+        }
+    }
+    
+    const storageProvider = await StorageService.resolveProvider(user_address);
+    console.log(`📤 Uploading to ${storageProvider}...`);
+    const { cid, metadataCid } = await StorageService.uploadWithMeta(fileToUpload, file_name, {
+        content_type,
+        metadata,
+        private: !!should_encrypt
+    }, { provider: storageProvider, signal: requestSignal(req, res) });
+    console.log(`✅ Upload successful! CID: ${cid}${metadataCid ? ` (metadata: ${metadataCid})` : ''}`);
 
-        const code = await contractService.provider.getCode(process.env.CONTRACT_ADDRESS);
-        const balance = await contractService.provider.getBalance(process.env.CONTRACT_ADDRESS);
-        
-        // Get wallet info if available
-        let walletInfo = null;
-        if (contractService.wallet) {
-            const walletBalance = await contractService.provider.getBalance(contractService.wallet.address);
-            walletInfo = {
-                address: contractService.wallet.address,
-                balance_fil: ethers.formatEther(walletBalance)
-            };
+    // Identical plaintext content yields the same CID, which is unique in file_records
+    // across all apps (as it is on-chain). Checked again if the INSERT below loses a
+    // race with a concurrent upload of the same content.
+    const existing = await db.get('SELECT * FROM file_records WHERE cid = ?', [cid.toString()]);
+    if (existing) {
+        return respondToExistingCid(req, res, existing, user_address);
+    }
+    
+    let txHash = null;
+    let rewardTxHash = null;
+    let expectedReward = "0";
+    let actualReward = "0";
+
+    // Calculate expected reward
+    expectedReward = await contractService.calculateReward(fileBuffer.length, should_encrypt);
+    console.log(`💰 Expected reward: ${expectedReward} FIL`);
+
+    const recordOnChain = BlockchainJobWorker.isEnabled();
+
+    // ?simulate=true dry-runs recordUpload first so a revert is reported before
+    // anything is written or any gas is spent
+    if (req.query.simulate === 'true' && recordOnChain) {
+        try {
+            const simulation = await contractService.simulate('recordUpload', [
+                contractService.cidToBytes32(cid.toString()),
+                fileBuffer.length,
+                !!should_encrypt,
+                JSON.stringify(metadata)
+            ], { signal: requestSignal(req, res) });
+
+            if (!simulation.ok) {
+                console.log(`🧪 Simulated recordUpload reverted: ${simulation.reason}`);
+                return res.status(422).json({
+                    success: false,
+                    error: 'Blockchain recording would fail',
+                    reason: simulation.reason,
+                    cid: cid.toString()
+                });
+            }
+        } catch (error) {
+            console.log('⚠️ Could not simulate blockchain recording, continuing:', error.message);
         }
+    }
 
-        // Get contract stats if available
-        let contractStats = null;
-        if (contractService.isReady) {
-            contractStats = await contractService.getContractStats();
+    const metadataSignature = await MetadataSigner.sign(cid.toString(), metadata);
+
+    // Store the file record and its blockchain job atomically, so a crash
+    // before the transaction is sent still leaves a job for the worker
+    const { inserted, jobId } = await withTransaction(async () => {
+        const result = await db.run(`
+            INSERT INTO file_records
+            (app_id, cid, cid_hash, content_hash, uploader_addr, file_size, is_encrypted, encryption_algorithm, encryption_mode, wrapped_key, file_key_salt, owner_wrapped_file_key, visibility, file_name, content_type, metadata, metadata_cid, status, tx_hash, storage_provider, metadata_signature, metadata_signer, metadata_signed_at)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT(cid) DO NOTHING
+        `, [
+            req.appId,
+            cid.toString(),
+            contractService.cidToBytes32(cid.toString()),
+            contentHash,
+            user_address,
+            fileBuffer.length,
+            should_encrypt ? 1 : 0,
+            encryptionAlgorithm,
+            encryptionMode,
+            wrappedKey,
+            fileKeySalt,
+            ownerWrappedFileKey,
+            visibility,
+            file_name,
+            content_type,
+            JSON.stringify(metadata),
+            metadataCid,
+            recordOnChain ? 'pending' : 'confirmed',
+            null,
+            storageProvider,
+            metadataSignature?.signature || null,
+            metadataSignature?.signer || null,
+            metadataSignature?.signedAt || null
+        ]);
+
+        if (result.changes === 0 || !recordOnChain) {
+            return { inserted: result.changes > 0, jobId: null };
         }
 
-        res.json({
-            success: true,
-            data: {
-                contract_address: process.env.CONTRACT_ADDRESS,
-                network: "Filecoin Calibration Testnet",
-                rpc_url: process.env.ETHEREUM_RPC,
-                is_deployed: code !== "0x",
-                bytecode_length: code.length,
-                contract_balance_fil: ethers.formatEther(balance),
-                wallet: walletInfo,
-                can_write: !!contractService.wallet,
-                is_ready: contractService.isReady,
-                stats: contractStats
+        return {
+            inserted: true,
+            jobId: await BlockchainJobWorker.enqueue(cid.toString(), 'record_upload', {
+                file_size: fileBuffer.length,
+                is_encrypted: !!should_encrypt,
+                metadata,
+                uploader: user_address
+            })
+        };
+    });
+
+    if (!inserted) {
+        console.log(`♻️ ${cid} was registered by a concurrent upload`);
+        return respondToExistingCid(req, res, await db.get('SELECT * FROM file_records WHERE cid = ?', [cid.toString()]), user_address);
+    }
+
+    // Try the job right away; if it can't complete now the worker retries it
+    if (jobId) {
+        console.log(`🔗 Recording file on blockchain (job ${jobId})...`);
+        const jobResult = await blockchainJobWorker.runUploadJob(jobId);
+
+        if (jobResult) {
+            txHash = jobResult.txHash;
+            console.log(`✅ File recorded on blockchain: ${txHash}`);
+
+            if (jobResult.reward) {
+                rewardTxHash = jobResult.reward.txHash;
+                actualReward = jobResult.reward.amount;
+                console.log(`✅ Reward automatically distributed: ${actualReward} FIL`);
+                console.log(`💸 Reward transaction: ${rewardTxHash}`);
+            } else {
+                console.log(`⚠️ Automatic reward failed - user can claim manually later`);
             }
-        });
-        
-    } catch (error) {
-        res.status(500).json({
-            success: false,
-            error: 'Failed to check contract status',
-            details: error.message
-        });
+        } else {
+            console.log(`⚠️ Blockchain recording queued for retry`);
+        }
     }
-});
 
-// Helper functions
-async function checkFileAccess(cid, userAddress) {
+    const status = !jobId || txHash ? 'confirmed' : 'pending';
+    // Why recording did not complete now (e.g. the signer is out of funds); the worker retries
+    const blockchainError = jobId && !txHash ?
+        (await db.get('SELECT last_error FROM blockchain_jobs WHERE id = ?', [jobId]))?.last_error || null :
+        null;
+
+    // Enhanced response with reward information
+    res.json({
+        success: true,
+        data: {
+            cid: cid.toString(),
+            file_size: fileBuffer.length,
+            is_encrypted: should_encrypt,
+            encryption_algorithm: encryptionAlgorithm,
+            encryption_mode: encryptionMode,
+            visibility,
+            status,
+            gateway_url: StorageService.getGatewayUrl(cid),
+            metadata_cid: metadataCid,
+
+            // Blockchain info
+            tx_hash: txHash,
+            blockchain_stored: !!txHash,
+            blockchain_job_id: jobId,
+            blockchain_error: blockchainError,
+
+            // Reward info
+            reward_tx_hash: rewardTxHash,
+            reward_distributed: !!rewardTxHash,
+            expected_reward_fil: expectedReward,
+            actual_reward_fil: actualReward || expectedReward,
+
+            // User-friendly message
+            message: rewardTxHash ?
+                `File uploaded and ${actualReward} FIL reward sent to your wallet!` :
+                txHash ?
+                    'File uploaded successfully - reward can be claimed manually' :
+                    jobId ?
+                        'File uploaded - blockchain recording is queued' :
+                        'File uploaded to storage only'
+        }
+    });
+}
+
+function uploadSessionPath(id) {
+    return path.join(UPLOAD_SESSION_DIR, `${id}.part`);
+}
+
+// Unexpired session in the caller's app, or undefined
+async function getUploadSession(id, appId) {
+    return db.get(
+        'SELECT * FROM upload_sessions WHERE id = ? AND app_id = ? AND expires_at > ?',
+        [id, appId, new Date().toISOString()]
+    );
+}
+
+// Drop sessions past their expiry along with their partial files
+async function expireUploadSessions() {
+    const expired = await db.all(
+        "SELECT id FROM upload_sessions WHERE status IN ('open', 'completing') AND expires_at <= ?",
+        [new Date().toISOString()]
+    );
+    for (const session of expired) {
+        await fs.rm(uploadSessionPath(session.id), { force: true });
+        await db.run("UPDATE upload_sessions SET status = 'expired' WHERE id = ?", [session.id]);
+    }
+}
+
+// Strip path separators and characters that are unsafe in file names
+function sanitizeFileName(fileName) {
+    return String(fileName)
+        .replace(/[/\\:*?"<>|\x00-\x1f]/g, '_')
+        .trim()
+        .substring(0, 255);
+}
+
+// Relative path inside a directory upload ("css/site.css"), or null if it is empty,
+// absolute, or escapes the directory
+function normalizeDirectoryPath(entryPath) {
+    if (typeof entryPath !== 'string') return null;
+
+    const segments = entryPath.replace(/\\/g, '/').split('/').filter(s => s && s !== '.');
+    if (segments.length === 0 || entryPath.startsWith('/') || segments.some(s => s === '..' || /[\x00-\x1f]/.test(s))) {
+        return null;
+    }
+    return segments.join('/');
+}
+
+// Dotted path of plain identifiers, e.g. "project" or "tags.owner"
+const METADATA_KEY_PATTERN = /^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$/;
+
+// Normalize upload metadata to a plain object. Accepts an object or a JSON string
+// encoding one; anything else is rejected so the column always holds a JSON object.
+function parseMetadata(metadata) {
+    if (metadata === undefined || metadata === null || metadata === '') {
+        return { value: {} };
+    }
+
+    let value = metadata;
+    if (typeof metadata === 'string') {
+        try {
+            value = JSON.parse(metadata);
+        } catch {
+            return { error: 'metadata must be valid JSON' };
+        }
+    }
+
+    if (typeof value !== 'object' || value === null || Array.isArray(value)) {
+        return { error: 'metadata must be a JSON object' };
+    }
+
+    return { value };
+}
+
+// Case-insensitive substring match of term across columns; % and _ in the term are
+// matched literally. Both sides are lowercased rather than relying on SQLite's
+// case-insensitive LIKE, so the clause means the same on databases where LIKE is
+// case-sensitive (and needs no ILIKE).
+function buildSearchClause(term, columns) {
+    const pattern = `%${String(term).toLowerCase().replace(/[\\%_]/g, c => '\\' + c)}%`;
+    return {
+        clause: '(' + columns.map(col => `LOWER(${col}) LIKE ? ESCAPE '\\'`).join(' OR ') + ')',
+        params: columns.map(() => pattern)
+    };
+}
+
+const ACCESS_GROUP_MAX_MEMBERS = parseInt(process.env.ACCESS_GROUP_MAX_MEMBERS) || 500;
+
+// Group owned by ownerAddress, or undefined
+async function getOwnedGroup(groupId, ownerAddress) {
+    return db.get(
+        'SELECT * FROM access_groups WHERE id = ? AND owner_addr = ?',
+        [parseInt(groupId), ownerAddress.toLowerCase()]
+    );
+}
+
+// Validate a list of member addresses; returns lowercased, de-duplicated { value } or { error }
+function parseMemberList(members) {
+    if (!Array.isArray(members)) {
+        return { error: 'members must be an array of addresses' };
+    }
+    if (members.length > ACCESS_GROUP_MAX_MEMBERS) {
+        return { error: `Groups are limited to ${ACCESS_GROUP_MAX_MEMBERS} members` };
+    }
+
+    const invalid = members.filter(member => !AuthService.isValidAddress(member));
+    if (invalid.length > 0) {
+        return { error: `Invalid member addresses: ${invalid.slice(0, 5).join(', ')}` };
+    }
+    return { value: [...new Set(members.map(member => member.toLowerCase()))] };
+}
+
+// Grant scopes: 'read' lets the grantee fetch the file, 'reshare' lets them grant
+// what they hold to others. Accepts an array or comma-separated string; default read.
+const GRANT_PERMISSIONS = ['read', 'reshare'];
+
+function parseGrantPermissions(permissions) {
+    if (permissions === undefined || permissions === null || permissions === '') {
+        return { value: ['read'] };
+    }
+
+    const list = Array.isArray(permissions) ? permissions : String(permissions).split(',');
+    const value = [...new Set(list.map(permission => String(permission).trim()).filter(Boolean))];
+    const invalid = value.filter(permission => !GRANT_PERMISSIONS.includes(permission));
+
+    if (value.length === 0 || invalid.length > 0) {
+        return { error: `permissions must be any of: ${GRANT_PERMISSIONS.join(', ')}` };
+    }
+    return { value: GRANT_PERMISSIONS.filter(permission => value.includes(permission)) };
+}
+
+// Grants without a duration last DEFAULT_GRANT_DURATION_SECONDS. Access that never
+// expires must be asked for with permanent: true, so a forgotten duration can't
+// share a file forever. Returns the duration in seconds, 0 meaning permanent.
+const DEFAULT_GRANT_DURATION_SECONDS = parseInt(process.env.DEFAULT_GRANT_DURATION_SECONDS) || 30 * 24 * 60 * 60;
+const PERMANENT_GRANT_EXPIRY = new Date('2099-12-31').toISOString();
+
+function parseGrantDuration(duration, permanent) {
+    if (permanent !== undefined && typeof permanent !== 'boolean') {
+        return { error: 'permanent must be a boolean' };
+    }
+    if (permanent) {
+        if (duration !== undefined && duration !== null) {
+            return { error: 'Specify either duration or permanent, not both' };
+        }
+        return { value: 0 };
+    }
+    if (duration === undefined || duration === null) {
+        return { value: DEFAULT_GRANT_DURATION_SECONDS };
+    }
+    if (!Number.isInteger(duration) || duration < 1) {
+        return { error: 'duration must be a positive number of seconds; use permanent: true for access that never expires' };
+    }
+    return { value: duration };
+}
+
+function grantExpiresAt(durationSeconds) {
+    return durationSeconds ? new Date(Date.now() + durationSeconds * 1000).toISOString() : PERMANENT_GRANT_EXPIRY;
+}
+
+// Parse a duration such as "900", "90s", "15m", "2h" or "1d" into milliseconds.
+// Bare numbers are seconds. Returns null for anything else.
+function parseDuration(value) {
+    const match = /^(\d+)\s*(ms|s|m|h|d)?$/.exec(String(value).trim());
+    if (!match) return null;
+
+    const units = { ms: 1, s: 1000, m: 60 * 1000, h: 60 * 60 * 1000, d: 24 * 60 * 60 * 1000 };
+    const ms = parseInt(match[1]) * units[match[2] || 's'];
+    return ms > 0 ? ms : null;
+}
+
+// JSON with object keys sorted at every level, so equal values always serialize
+// identically (used for signing)
+function canonicalJson(value) {
+    if (Array.isArray(value)) {
+        return `[${value.map(canonicalJson).join(',')}]`;
+    }
+    if (value && typeof value === 'object') {
+        return `{${Object.keys(value).sort().map(key => `${JSON.stringify(key)}:${canonicalJson(value[key])}`).join(',')}}`;
+    }
+    return JSON.stringify(value ?? null);
+}
+
+// Map items through an async fn with at most `limit` calls in flight, preserving order
+async function mapWithConcurrency(items, limit, fn) {
+    const results = new Array(items.length);
+    let next = 0;
+
+    const worker = async () => {
+        while (next < items.length) {
+            const index = next++;
+            results[index] = await fn(items[index], index);
+        }
+    };
+
+    await Promise.all(Array.from({ length: Math.min(limit, items.length) }, worker));
+    return results;
+}
+
+// Optional ?from= / ?to= bounds as ISO timestamps, compared against ISO columns
+function parseDateRange(query) {
+    const range = { from: null, to: null };
+
+    for (const field of ['from', 'to']) {
+        if (!query[field]) continue;
+        const date = new Date(query[field]);
+        if (Number.isNaN(date.getTime())) {
+            return { error: `${field} must be a valid date` };
+        }
+        range[field] = date.toISOString();
+    }
+
+    if (range.from && range.to && range.from > range.to) {
+        return { error: 'from must not be after to' };
+    }
+    return range;
+}
+
+// Opaque keyset cursor over (created_at, id)
+function encodeCursor(row) {
+    return Buffer.from(JSON.stringify([row.created_at, row.id])).toString('base64url');
+}
+
+function decodeCursor(cursor) {
+    try {
+        const [createdAt, id] = JSON.parse(Buffer.from(cursor, 'base64url').toString('utf8'));
+        if (typeof createdAt !== 'string' || !Number.isInteger(id)) return null;
+        return { created_at: createdAt, id };
+    } catch {
+        return null;
+    }
+}
+
+// Run a newest-first keyset page over a query whose rows carry created_at and id.
+// Fetches one extra row to know whether another page exists.
+async function fetchCursorPage(baseSql, params, after, limit, database = db) {
+    let sql = baseSql;
+    const queryParams = [...params];
+
+    if (after) {
+        sql += ' AND (created_at < ? OR (created_at = ? AND id < ?))';
+        queryParams.push(after.created_at, after.created_at, after.id);
+    }
+
+    sql += ' ORDER BY created_at DESC, id DESC LIMIT ?';
+    queryParams.push(limit + 1);
+
+    const rows = await database.all(sql, queryParams);
+    const hasMore = rows.length > limit;
+    const pageRows = hasMore ? rows.slice(0, limit) : rows;
+
+    return {
+        rows: pageRows,
+        nextCursor: hasMore ? encodeCursor(pageRows[pageRows.length - 1]) : null
+    };
+}
+// Every decision is written to the access log under options.action (default 'access_check').
+// Only the file's owner and grants within options.appId (default app if omitted) count.
+// With options.consume, access through a grant uses up one of its downloads.
+async function checkFileAccess(cid, userAddress, options = {}) {
+    const access = await resolveFileAccess(cid, userAddress, options);
+    let reason = access ? access.reason : 'no_grant';
+    let allowed = access !== null;
+
+    if (allowed && access.grant && options.consume && !(await consumeGrantDownload(access.grant))) {
+        allowed = false;
+        reason = 'download_limit_reached';
+    }
+
+    accessAuditLog.record(cid, userAddress, options.action || 'access_check', allowed ? 'allowed' : 'denied', reason);
+    return allowed;
+}
+
+// Why userAddress may read cid - { reason: 'owner' | 'grant' | 'on_chain_grant', grant } - or null
+async function resolveFileAccess(cid, userAddress, options = {}) {
     // Check if user is the uploader
+    const appId = options.appId || DEFAULT_APP_ID;
     const fileRecord = await db.get(
-        'SELECT * FROM file_records WHERE cid = ? AND uploader_addr = ?',
-        [cid, userAddress]
+        'SELECT * FROM file_records WHERE cid = ? AND LOWER(uploader_addr) = LOWER(?) AND app_id = ? AND deleted_at IS NULL',
+        [cid, userAddress, appId]
     );
     
-    if (fileRecord) return true;
+    if (fileRecord) return { reason: 'owner', grant: null };
     
     // Check database access grants
-    const grant = await db.get(`
-        SELECT * FROM access_grants 
-        WHERE cid = ? AND grantee_addr = ? AND is_active = 1 
-        AND (expires_at IS NULL OR expires_at > datetime('now'))
-    `, [cid, userAddress]);
+    const grant = await findActiveGrant(cid, userAddress, 'read', appId);
     
-    if (grant) return true;
+    if (grant) return { reason: 'grant', grant };
     
     // Check blockchain access grants if contract is available
     if (contractService.isReady) {
         try {
-            const hasBlockchainAccess = await contractService.checkFileAccess(cid, userAddress);
-            if (hasBlockchainAccess) return true;
+            const hasBlockchainAccess = await contractService.checkFileAccess(cid, userAddress, options);
+            if (hasBlockchainAccess) return { reason: 'on_chain_grant', grant: null };
         } catch (error) {
             console.log('⚠️ Could not check blockchain access');
         }
     }
     
-    return false;
+    return null;
+}
+
+// Newest active, unexpired grant on cid giving grantee the permission, directly or
+// through a group they belong to. Read grants whose download limit is used up no longer count.
+async function findActiveGrant(cid, grantee, permission, appId = DEFAULT_APP_ID) {
+    let sql = `
+        SELECT * FROM access_grants
+        WHERE cid = ? AND app_id = ? AND is_active = 1
+        AND (LOWER(grantee_addr) = LOWER(?) OR group_id IN (
+            SELECT group_id FROM access_group_members WHERE member_addr = LOWER(?)
+        ))
+        AND (expires_at IS NULL OR expires_at > ?)
+        AND (',' || permissions || ',') LIKE ?
+    `;
+    if (permission === 'read') {
+        sql += ' AND (max_downloads IS NULL OR downloads_used < max_downloads)';
+    }
+    sql += ' ORDER BY id DESC LIMIT 1';
+
+    return db.get(sql, [cid, appId, grantee, grantee, new Date().toISOString(), `%,${permission},%`]);
+}
+
+// Count one download against a grant; false if its limit was reached meanwhile
+async function consumeGrantDownload(grant) {
+    const result = await db.run(`
+        UPDATE access_grants SET downloads_used = downloads_used + 1
+        WHERE id = ? AND (max_downloads IS NULL OR downloads_used < max_downloads)
+    `, [grant.id]);
+    return result.changes > 0;
+}
+
+// Startup checks shared by every subcommand; also selects the key store
+function validateConfiguration() {
+    if (!ENVIRONMENTS.includes(ENVIRONMENT)) {
+        throw new Error(`Invalid configuration: NODE_ENV must be one of ${ENVIRONMENTS.join(', ')}`);
+    }
+
+    if (isProduction() && process.env.SKIP_SIGNATURE_VERIFICATION === 'true') {
+        throw new Error('Invalid configuration: SKIP_SIGNATURE_VERIFICATION cannot be enabled in production');
+    }
+    if (isProduction() && exposeErrorDetails()) {
+        throw new Error('Invalid configuration: EXPOSE_ERROR_DETAILS cannot be enabled in production');
+    }
+
+    const storageProvider = process.env.STORAGE_PROVIDER || 'w3up';
+    if (!STORAGE_PROVIDERS.includes(storageProvider)) {
+        throw new Error(`Invalid configuration: STORAGE_PROVIDER must be one of ${STORAGE_PROVIDERS.join(', ')}`);
+    }
+    if (storageProvider === 'memory' && isProduction()) {
+        throw new Error('Invalid configuration: STORAGE_PROVIDER=memory cannot be used in production');
+    }
+    if (storageGateways.error) {
+        throw new Error(`Invalid configuration: ${storageGateways.error}`);
+    }
+    if (storageProviderRules.error) {
+        throw new Error(`Invalid configuration: ${storageProviderRules.error}`);
+    }
+    if (routedStorageProviders().includes('memory') && isProduction()) {
+        throw new Error('Invalid configuration: STORAGE_PROVIDER_RULES cannot route uploads to memory in production');
+    }
+
+    if (trustedProxies.error) {
+        throw new Error(`Invalid configuration: ${trustedProxies.error}`);
+    }
+
+    for (const ipList of [adminIpAllowlist, adminIpDenylist]) {
+        if (ipList.error) {
+            throw new Error(`Invalid configuration: ${ipList.error}`);
+        }
+    }
+
+    if (!AUTH_MAX_AGE_MS || AUTH_MAX_AGE_MS > AUTH_MAX_AGE_LIMIT_MS) {
+        throw new Error('Invalid configuration: AUTH_MAX_AGE must be a duration like 90s, 5m or 1h, at most 24h');
+    }
+
+    if (!EncryptionService.isSupportedAlgorithm(DEFAULT_ENCRYPTION_ALGORITHM)) {
+        throw new Error(`Invalid configuration: ENCRYPTION_ALGORITHM must be one of ${ENCRYPTION_ALGORITHMS.join(', ')}`);
+    }
+
+    try {
+        keyStore = getKeyStore(process.env.KEY_STORE || (process.env.KEY_ENCRYPTION_KEY ? 'local' : 'plain'));
+    } catch (error) {
+        throw new Error(`Invalid configuration: ${error.message}`);
+    }
+    if (keyStore.name === 'plain') {
+        console.log('⚠️  No key store configured - file keys are stored unwrapped. Set KEY_ENCRYPTION_KEY or KEY_STORE=vault.');
+    }
+
+    if (process.env.BACKUP_ENCRYPTION_KEY && !/^[0-9a-fA-F]{64}$/.test(process.env.BACKUP_ENCRYPTION_KEY)) {
+        throw new Error('Invalid configuration: BACKUP_ENCRYPTION_KEY must be 32 bytes of hex');
+    }
+
+    try {
+        contentScanner = createContentScanner(process.env.CONTENT_SCANNER || 'none');
+    } catch (error) {
+        throw new Error(`Invalid configuration: ${error.message}`);
+    }
 }
 
 // Initialize and start server
@@ -1259,20 +10109,52 @@ async function startServer() {
         
         // Show environment info
         console.log('📋 Environment Configuration:');
-        console.log(`   NODE_ENV: ${process.env.NODE_ENV || process.env.ENVIRONMENT || 'development'}`);
+        console.log(`   NODE_ENV: ${ENVIRONMENT}`);
         console.log(`   Database: ${process.env.DATABASE_PATH || './privychain.db'}`);
         console.log(`   Contract: ${process.env.CONTRACT_ADDRESS ? '✅ Configured' : '❌ Not configured'}`);
         console.log(`   Web3 Token: ${process.env.WEB3_STORAGE_TOKEN ? '✅ Found (legacy)' : '❌ Not found'}`);
         console.log(`   Signature Verification: ${process.env.SKIP_SIGNATURE_VERIFICATION === 'true' ? '⚠️  DISABLED' : '✅ ENABLED'}`);
+        console.log(`   Encryption: ${DEFAULT_ENCRYPTION_ALGORITHM}`);
+        console.log(`   Key store: ${process.env.KEY_STORE || (process.env.KEY_ENCRYPTION_KEY ? 'local' : 'plain')}`);
+        console.log(`   Content scanner: ${process.env.CONTENT_SCANNER || 'none'}`);
+        console.log(`   Signer: ${contractService.getSignerAddress() || 'not configured'}`);
+        console.log(`   Signed request lifetime: ${process.env.AUTH_MAX_AGE || '5m'}`);
+        console.log(`   Trusted proxies: ${process.env.TRUSTED_PROXIES || 'none (req.ip is the direct peer)'}`);
         console.log('');
         
+        validateConfiguration();
         await initializeDatabase();
-        const w3upReady = await initializeW3up();
+        const storageReady = await initializeStorage();
+        // Production must be able to store files; elsewhere the API can still run without
+        if (!storageReady && (isProduction() || process.env.STORAGE_REQUIRED === 'true')) {
+            throw new Error(`Invalid configuration: ${STORAGE_NOT_CONFIGURED}`);
+        }
         
         // Initialize contract service
         const contractReady = await contractService.initialize();
         console.log(`📝 Smart Contract: ${contractReady ? '✅ Connected' : '⚠️ Not available'}`);
-        
+
+        if (BlockchainJobWorker.isEnabled()) {
+            blockchainJobWorker.start();
+            fileStatusReconciler.start();
+        }
+
+        if (contractReady && process.env.EVENT_SYNC_ENABLED !== 'false') {
+            await chainEventIndexer.start();
+        }
+
+        if (w3upReady && StorageAvailabilityChecker.isEnabled()) {
+            storageAvailabilityChecker.start();
+        }
+
+        if (GrantExpiryNotifier.isEnabled()) {
+            grantExpiryNotifier.start();
+        }
+
+        if (BackupScheduler.isEnabled()) {
+            backupScheduler.start();
+        }
+
         if (!w3upReady) {
             console.log('⚠️  Storage service not ready. File uploads will not work.');
             console.log('💡 Your existing Web3.Storage configuration should work automatically.');
@@ -1305,4 +10187,44 @@ async function startServer() {
     }
 }
 
-startServer();
\ No newline at end of file
+// One-shot operational commands: bring the schema up to date, do the work, exit
+async function runCommand(name, work) {
+    try {
+        validateConfiguration();
+        await initializeDatabase();
+        await work();
+        await db.close();
+        process.exit(0);
+    } catch (error) {
+        console.error(`❌ ${name} failed:`, error.message);
+        process.exit(1);
+    }
+}
+
+const COMMANDS = {
+    serve: startServer,
+    migrate: () => runCommand('migrate', async () => {
+        console.log('✅ Schema is up to date');
+    }),
+    seed: () => runCommand('seed', () => seedData({ demo: process.argv.includes('--demo') })),
+    backup: () => runCommand('backup', async () => {
+        // Encrypted backups are also uploaded, which needs storage
+        if (process.env.BACKUP_ENCRYPTION_KEY) {
+            await initializeStorage();
+        }
+        await backupScheduler.createBackup('cli');
+    })
+};
+
+// Importing this file (e.g. from a test) builds the app without running anything
+export { app, validateConfiguration, initializeDatabase, onDatabaseSaturation, PrivyChainContractService, contractService, StorageService, MemoryStorageProvider };
+
+// node server.js [serve|migrate|seed [--demo]|backup]; serve is the default
+if (process.argv[1] && path.resolve(process.argv[1]) === fileURLToPath(import.meta.url)) {
+    const command = process.argv[2] && !process.argv[2].startsWith('-') ? process.argv[2] : 'serve';
+    if (!COMMANDS[command]) {
+        console.error(`❌ Unknown command: ${command}. Use one of: ${Object.keys(COMMANDS).join(', ')}`);
+        process.exit(1);
+    }
+    COMMANDS[command]();
+}
\ No newline at end of file
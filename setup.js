@@ -56,6 +56,7 @@ NODE_ENV=development
 # DEVELOPMENT SETTINGS
 SKIP_SIGNATURE_VERIFICATION=${skipSignature}
 DEBUG=${enableDebug}
+EXPOSE_ERROR_DETAILS=${enableDebug}
 
 # =================================
 # DATABASE CONFIGURATION
@@ -38,7 +38,7 @@ export class ApiUsage {
         FROM api_usage 
         WHERE created_at >= datetime('now', '-' || ? || ' hours')
         GROUP BY endpoint
-        ORDER BY request_count DESC
+        ORDER BY request_count DESC, endpoint
       `, [hours]);
     } catch (error) {
       return [];
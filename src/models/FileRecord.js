@@ -33,7 +33,7 @@ export class FileRecord {
     return await db.all(`
       SELECT * FROM file_records 
       WHERE uploader_addr = ? 
-      ORDER BY created_at DESC 
+      ORDER BY created_at DESC, id DESC
       LIMIT ? OFFSET ?
     `, [uploaderAddr, limit, offset]);
   }
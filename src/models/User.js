@@ -23,7 +23,7 @@ export class User {
     const files = await db.all(`
       SELECT * FROM file_records 
       WHERE uploader_addr = ? 
-      ORDER BY created_at DESC 
+      ORDER BY created_at DESC, id DESC
       LIMIT ? OFFSET ?
     `, [userAddress, limit, offset]);
     
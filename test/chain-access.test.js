@@ -0,0 +1,105 @@
+import { test, before, after } from 'node:test';
+import assert from 'node:assert/strict';
+import { ethers } from 'ethers';
+import { apiClient } from './helpers.js';
+import { StubChainProvider } from './stub-chain-provider.js';
+
+const owner = ethers.Wallet.createRandom();
+const viewer = ethers.Wallet.createRandom();
+const stranger = ethers.Wallet.createRandom();
+const admin = ethers.Wallet.createRandom();
+
+// Configuration is read at import time, so it is set before server.js loads.
+// No PRIVATE_KEY: the contract is read-only and uploads are not recorded on-chain.
+process.env.DATABASE_PATH = ':memory:';
+process.env.ETHEREUM_RPC = 'http://chain.test';
+process.env.CONTRACT_ADDRESS = ethers.Wallet.createRandom().address;
+process.env.PRIVATE_KEY = '';
+process.env.ADMIN_ADDRESSES = admin.address;
+process.env.REQUEST_LOGGING = 'false';
+
+const { app, validateConfiguration, initializeDatabase, contractService, StorageService, MemoryStorageProvider } = await import('../server.js');
+
+const CONTRACT_ABI = [
+    'function hasAccess(bytes32 cid, address viewer) external view returns (bool)',
+    'function calculateReward(uint256 fileSize, bool isEncrypted) public view returns (uint256)',
+    'function totalFilesStored() external view returns (uint256)',
+    'function getFileRecord(bytes32 cid) external view returns (tuple(bytes32 cid, address uploader, uint256 timestamp, uint256 fileSize, bool isEncrypted, bool rewardClaimed, string metadata))',
+    'function getAccessGrant(bytes32 cid, address grantee) external view returns (tuple(address granter, address grantee, uint256 expiresAt, bool isActive))'
+];
+
+// Access granted on-chain only, keyed by the contract's bytes32 CID
+const onChainGrants = new Set();
+// Contract state for getFileRecord / getAccessGrant; missing entries read as zeroed structs
+const chainFiles = new Map();
+const chainGrants = new Map();
+
+let server;
+let request;
+
+before(async () => {
+    validateConfiguration();
+    await initializeDatabase();
+    StorageService.useProvider(new MemoryStorageProvider());
+
+    contractService.providerFactory = () => new StubChainProvider(CONTRACT_ABI, {
+        hasAccess: (cid, address) => onChainGrants.has(`${cid}:${address.toLowerCase()}`),
+        calculateReward: () => ethers.parseEther('0.1'),
+        totalFilesStored: () => 0n,
+        getFileRecord: cid => chainFiles.get(cid) || [ethers.ZeroHash, ethers.ZeroAddress, 0n, 0n, false, false, ''],
+        getAccessGrant: (cid, grantee) => chainGrants.get(`${cid}:${grantee.toLowerCase()}`) ||
+            [ethers.ZeroAddress, ethers.ZeroAddress, 0n, false]
+    });
+    assert.equal(await contractService.initialize(), true);
+
+    server = app.listen(0);
+    request = apiClient(`http://127.0.0.1:${server.address().port}`);
+});
+
+after(() => {
+    server.close();
+});
+
+test('an on-chain grant with no database grant allows the download', async () => {
+    const upload = await request('POST', '/upload', owner, {
+        file: Buffer.from('board minutes').toString('base64'),
+        file_name: 'minutes.txt',
+        content_type: 'text/plain'
+    });
+    assert.equal(upload.status, 200);
+    assert.equal(upload.body.data.expected_reward_fil, '0.1');
+    const { cid } = upload.body.data;
+
+    onChainGrants.add(`${contractService.cidToBytes32(cid)}:${viewer.address.toLowerCase()}`);
+
+    const allowed = await request('GET', `/files/${cid}/download`, viewer);
+    assert.equal(allowed.status, 200);
+    assert.equal(allowed.body, 'board minutes');
+
+    const denied = await request('GET', `/files/${cid}/download`, stranger);
+    assert.equal(denied.status, 403);
+});
+
+test('reconcile treats a permanent on-chain grant (uint256 max) as matching a permanent grant', async () => {
+    const content = Buffer.from('signed contract');
+    const upload = await request('POST', '/upload', owner, {
+        file: content.toString('base64'),
+        file_name: 'contract.txt',
+        content_type: 'text/plain'
+    });
+    assert.equal(upload.status, 200);
+    const { cid } = upload.body.data;
+
+    const grant = await request('POST', '/access/grant', owner, { cid, grantee: viewer.address, permanent: true });
+    assert.equal(grant.status, 200);
+
+    const cidHash = contractService.cidToBytes32(cid);
+    chainFiles.set(cidHash, [cidHash, ethers.Wallet.createRandom().address, 1n, BigInt(content.length), false, false, '{}']);
+    chainGrants.set(`${cidHash}:${viewer.address.toLowerCase()}`, [owner.address, viewer.address, ethers.MaxUint256, true]);
+
+    const reconcile = await request('GET', `/admin/reconcile?cid=${cid}`, admin);
+    assert.equal(reconcile.status, 200);
+    const [file] = reconcile.body.data.files;
+    assert.equal(file.grants_checked, 1);
+    assert.deepEqual(file.discrepancies, []);
+});
@@ -0,0 +1,73 @@
+import { test, before, after } from 'node:test';
+import assert from 'node:assert/strict';
+import { ethers } from 'ethers';
+import { apiClient } from './helpers.js';
+
+const owner = ethers.Wallet.createRandom();
+const grantee = ethers.Wallet.createRandom();
+const admin = ethers.Wallet.createRandom();
+
+// Configuration is read at import time, so it is set before server.js loads
+process.env.DATABASE_PATH = ':memory:';
+process.env.ADMIN_ADDRESSES = admin.address;
+process.env.CONTRACT_ADDRESS = '';
+process.env.REQUEST_LOGGING = 'false';
+
+const { app, validateConfiguration, initializeDatabase, StorageService, MemoryStorageProvider } = await import('../server.js');
+
+let server;
+let request;
+
+before(async () => {
+    validateConfiguration();
+    await initializeDatabase();
+    StorageService.useProvider(new MemoryStorageProvider());
+    server = app.listen(0);
+    request = apiClient(`http://127.0.0.1:${server.address().port}`);
+});
+
+after(() => {
+    server.close();
+});
+
+test('a grantee loses access when the file is deleted and regains it on restore', async () => {
+    const upload = await request('POST', '/upload', owner, {
+        file: Buffer.from('quarterly report').toString('base64'),
+        file_name: 'report.txt',
+        content_type: 'text/plain'
+    });
+    assert.equal(upload.status, 200);
+    const { cid } = upload.body.data;
+
+    const grant = await request('POST', '/access/grant', owner, { cid, grantee: grantee.address });
+    assert.equal(grant.status, 200);
+
+    const beforeDelete = await request('GET', `/files/${cid}/download`, grantee);
+    assert.equal(beforeDelete.status, 200);
+    assert.equal(beforeDelete.body, 'quarterly report');
+
+    const dryRun = await request('POST', '/admin/files/bulk-delete', admin, { cids: [cid], dry_run: true });
+    assert.equal(dryRun.status, 200);
+    assert.equal(dryRun.body.data.active_grants, 1);
+
+    const deleted = await request('POST', '/admin/files/bulk-delete', admin, {
+        cids: [cid],
+        confirmation_token: dryRun.body.data.confirmation_token
+    });
+    assert.equal(deleted.status, 200);
+    assert.equal(deleted.body.data.grants, 1);
+
+    const afterDelete = await request('GET', `/files/${cid}/download`, grantee);
+    assert.equal(afterDelete.status, 404);
+    const shared = await request('GET', `/users/${grantee.address}/shared`, grantee);
+    assert.equal(shared.status, 200);
+    assert.deepEqual(shared.body.data.grants, []);
+
+    const restored = await request('POST', '/admin/files/bulk-restore', admin, { cids: [cid] });
+    assert.equal(restored.status, 200);
+    assert.deepEqual(restored.body.data, { files: 1, grants: 1, cids: [cid] });
+
+    const afterRestore = await request('GET', `/files/${cid}/download`, grantee);
+    assert.equal(afterRestore.status, 200);
+    assert.equal(afterRestore.body, 'quarterly report');
+});
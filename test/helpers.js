@@ -0,0 +1,24 @@
+// Requests against a running app, signed the way a wallet client signs them
+// (x-user-address, x-timestamp, x-signature). Pass wallet = null for anonymous calls;
+// extraHeaders are sent as-is (e.g. Accept).
+export function apiClient(baseUrl) {
+    return async function request(method, path, wallet, body, extraHeaders = {}) {
+        const headers = { ...extraHeaders };
+        if (wallet) {
+            const timestamp = String(Date.now());
+            headers['x-user-address'] = wallet.address;
+            headers['x-timestamp'] = timestamp;
+            headers['x-signature'] = await wallet.signMessage(`PrivyChain Authentication\nTimestamp: ${timestamp}`);
+        }
+        if (body !== undefined) {
+            headers['content-type'] = 'application/json';
+        }
+        const response = await fetch(`${baseUrl}${path}`, {
+            method,
+            headers,
+            body: body === undefined ? undefined : JSON.stringify(body)
+        });
+        const type = response.headers.get('content-type') || '';
+        return { status: response.status, body: type.includes('json') ? await response.json() : await response.text() };
+    };
+}
@@ -0,0 +1,59 @@
+import { test, before, after } from 'node:test';
+import assert from 'node:assert/strict';
+import { ethers } from 'ethers';
+import { apiClient } from './helpers.js';
+
+const owner = ethers.Wallet.createRandom();
+const grantee = ethers.Wallet.createRandom();
+const stranger = ethers.Wallet.createRandom();
+
+// Configuration is read at import time, so it is set before server.js loads
+process.env.DATABASE_PATH = ':memory:';
+process.env.CONTRACT_ADDRESS = '';
+process.env.REQUEST_LOGGING = 'false';
+
+const { app, validateConfiguration, initializeDatabase, StorageService, MemoryStorageProvider } = await import('../server.js');
+
+const BINARY = { accept: 'application/octet-stream' };
+
+let server;
+let request;
+
+before(async () => {
+    validateConfiguration();
+    await initializeDatabase();
+    StorageService.useProvider(new MemoryStorageProvider());
+    server = app.listen(0);
+    request = apiClient(`http://127.0.0.1:${server.address().port}`);
+});
+
+after(() => {
+    server.close();
+});
+
+test('a spoofed user_address neither retrieves a private file nor spends the grantee\'s downloads', async () => {
+    const upload = await request('POST', '/upload', owner, {
+        file: Buffer.from('payroll').toString('base64'),
+        file_name: 'payroll.txt',
+        content_type: 'text/plain'
+    });
+    assert.equal(upload.status, 200);
+    const { cid } = upload.body.data;
+
+    const grant = await request('POST', '/access/grant', owner, { cid, grantee: grantee.address, max_downloads: 1 });
+    assert.equal(grant.status, 200);
+
+    const anonymous = await request('POST', '/retrieve', null, { cid, user_address: grantee.address }, BINARY);
+    assert.equal(anonymous.status, 401);
+
+    const spoofed = await request('POST', '/retrieve', stranger, { cid, user_address: grantee.address, consume: true }, BINARY);
+    assert.equal(spoofed.status, 403);
+
+    // The one allowed download is still there for the real grantee
+    const retrieved = await request('POST', '/retrieve', grantee, { cid }, BINARY);
+    assert.equal(retrieved.status, 200);
+    assert.equal(retrieved.body, 'payroll');
+
+    const exhausted = await request('POST', '/retrieve', grantee, { cid }, BINARY);
+    assert.equal(exhausted.status, 403);
+});
@@ -0,0 +1,59 @@
+import { ethers } from 'ethers';
+
+// In-process stand-in for an RPC node, handed out through PrivyChainContractService's
+// providerFactory. Contract reads are decoded with abi and answered by
+// handlers[functionName](...args); a read without a handler reverts. Only the calls
+// the service makes to connect and read are supported - no transactions.
+export class StubChainProvider extends ethers.AbstractProvider {
+    constructor(abi, handlers = {}, { chainId = 314159, blockNumber = 1 } = {}) {
+        const network = ethers.Network.from(chainId);
+        super(network);
+        this.stubNetwork = network;
+        this.interface = new ethers.Interface(abi);
+        this.handlers = handlers;
+        this.blockNumber = blockNumber;
+        this.calls = [];
+    }
+
+    async _detectNetwork() {
+        return this.stubNetwork;
+    }
+
+    async _perform(req) {
+        switch (req.method) {
+            case 'chainId':
+                return this.stubNetwork.chainId;
+            case 'getBlockNumber':
+                return this.blockNumber;
+            case 'getCode':
+                return '0x6080604052';
+            case 'getBalance':
+                return 0n;
+            case 'call':
+                return this.answerCall(req.transaction);
+            default:
+                throw ethers.makeError(`StubChainProvider does not support ${req.method}`, 'UNSUPPORTED_OPERATION', {
+                    operation: req.method
+                });
+        }
+    }
+
+    answerCall(transaction) {
+        const parsed = this.interface.parseTransaction({ data: transaction.data });
+        const handler = parsed && this.handlers[parsed.name];
+        if (!handler) {
+            throw ethers.makeError(`no stub for ${parsed ? parsed.name : transaction.data.slice(0, 10)}`, 'CALL_EXCEPTION', {
+                action: 'call',
+                data: null,
+                reason: null,
+                transaction,
+                invocation: null,
+                revert: null
+            });
+        }
+
+        this.calls.push({ name: parsed.name, args: [...parsed.args] });
+        const result = handler(...parsed.args);
+        return this.interface.encodeFunctionResult(parsed.fragment, parsed.fragment.outputs.length === 1 ? [result] : result);
+    }
+}